@@ -14,6 +14,7 @@ const (
 	FromAppIdHeader           = "x-from-app-id"
 	AuthorizedUserIDHeader    = "x-authorized-user-id"
 	AuthorizedUserRolesHeader = "x-authorized-user-roles"
+	SourceTopicHeader         = "x-source-topic"
 
 	// Header for unauthorized api access in the pub API
 	UnauthorizedPubAccessToken = "x-unauthorized-public-access-token"
@@ -21,6 +22,13 @@ const (
 
 func NewContextFromDelivery(appID app.ApplicationID, delivery amqp.Delivery) (ctx context.Context) {
 
+	return NewContextFromDeliveryWithParent(context.Background(), appID, delivery)
+}
+
+// NewContextFromDeliveryWithParent
+// Same as NewContextFromDelivery, derived from the parent context, so it's cancelled with it
+func NewContextFromDeliveryWithParent(parent context.Context, appID app.ApplicationID, delivery amqp.Delivery) (ctx context.Context) {
+
 	valUserID := delivery.Headers[AuthorizedUserIDHeader]
 	userID := ""
 
@@ -35,13 +43,12 @@ func NewContextFromDelivery(appID app.ApplicationID, delivery amqp.Delivery) (ct
 		userRoles = valUserRoles.(string)
 	}
 
-	ctx = context.Background()
-
-	ctx = context.WithValue(ctx, CorrelationIdHeader, delivery.CorrelationId)
+	ctx = context.WithValue(parent, CorrelationIdHeader, delivery.CorrelationId)
 	ctx = context.WithValue(ctx, AppIdHeader, string(appID))
 	ctx = context.WithValue(ctx, FromAppIdHeader, delivery.AppId)
 	ctx = context.WithValue(ctx, AuthorizedUserIDHeader, userID)
 	ctx = context.WithValue(ctx, AuthorizedUserRolesHeader, userRoles)
+	ctx = context.WithValue(ctx, SourceTopicHeader, delivery.Exchange)
 
 	return ctx
 
@@ -98,6 +105,20 @@ func NewContextFromValuesWithUserRoles(appID app.ApplicationID, correlationID st
 
 }
 
+// GetSourceTopic
+// Returns the topic an event delivery was published to
+func GetSourceTopic(ctx context.Context) (topic string) {
+
+	valueTopic := ctx.Value(SourceTopicHeader)
+
+	if valueTopic != nil {
+		topic = valueTopic.(string)
+	}
+
+	return topic
+
+}
+
 // GetAuthorizedUserID
 // Returns the authorised user Id
 func GetAuthorizedUserID(ctx context.Context) (authorizedUserID string) {
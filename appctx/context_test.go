@@ -32,6 +32,7 @@ func TestNewContextFromDelivery(t *testing.T) {
 	delivery := amqp.Delivery{
 		AppId: "FromAppID",
 		CorrelationId: "CorrelationID",
+		Exchange: "user",
 		Headers: amqp.Table{
 			AuthorizedUserIDHeader :"userID",
 			AuthorizedUserRolesHeader: "Admin,Test",
@@ -51,6 +52,7 @@ func TestNewContextFromDelivery(t *testing.T) {
 	assert.Equal(t, "FromAppID", fromAppID)
 	assert.Equal(t, "userID", userID)
 	assert.Equal(t, "Admin,Test", roles)
+	assert.Equal(t, "user", GetSourceTopic(ctx))
 }
 
 func TestNewContextFromValue(t *testing.T) {
@@ -9,6 +9,7 @@ import (
 type (
 	AppEvent struct {
 		EventType string
+		Version   int `json:",omitempty"`
 		Timestamp int64
 		Data      json.RawMessage
 	}
@@ -32,6 +33,18 @@ func NewAppEventWithTimestamp(eventType string, data json.RawMessage, timestamp
 	}
 }
 
+// NewVersionedAppEvent
+// Creates an event for a specific version of the event type data schema
+func NewVersionedAppEvent(eventType string, version int, data json.RawMessage) AppEvent {
+
+	return AppEvent{
+		EventType: eventType,
+		Version:   version,
+		Timestamp: time.Now().UTC().UnixNano(),
+		Data:      data,
+	}
+}
+
 func NewAppEventFromJSON(event []byte) (appEvent AppEvent, err error) {
 
 	err = json.Unmarshal(event, &appEvent)
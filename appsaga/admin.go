@@ -0,0 +1,362 @@
+package appsaga
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/HelloSundayMorning/apputils/log"
+	"github.com/HelloSundayMorning/apputils/server"
+	"golang.org/x/net/context"
+)
+
+type (
+	// SagaState
+	// State of the sagas listed by ListSagas
+	SagaState string
+
+	// SagaQuery
+	// Filters of ListSagas.
+	// - State: sagas in the state, all the states if empty
+	// - MinAge and MaxAge: sagas started at least / at most that long ago. 0 doesn't filter
+	// - Limit and Offset: page of the sagas, ordered by start. Limit 0 is DefaultSagaQueryLimit
+	SagaQuery struct {
+		State  SagaState
+		MinAge time.Duration
+		MaxAge time.Duration
+		Limit  int
+		Offset int
+	}
+)
+
+const (
+	SagaStateOpen              SagaState = "open"               // waiting for events
+	SagaStateCompleted         SagaState = "completed"          // completed handler succeeded
+	SagaStateCompletionPending SagaState = "completion_pending" // completed handler not run or retrying
+	SagaStateFailed            SagaState = "failed"             // completed handler exceeded the max attempts
+	SagaStateExpired           SagaState = "expired"            // timed out before completing
+
+	DefaultSagaQueryLimit = 100
+)
+
+var (
+	SagaNotFound = fmt.Errorf("saga not found")
+)
+
+// ListSagas
+// Returns the sagas of the manager saga name matching the query, ordered by start
+func (sagaManager *SagaManager) ListSagas(ctx context.Context, query SagaQuery) (sagas []Saga, err error) {
+
+	if query.State != "" && !query.State.valid() {
+		return nil, fmt.Errorf("invalid saga state %s", query.State)
+	}
+
+	if query.Limit <= 0 {
+		query.Limit = DefaultSagaQueryLimit
+	}
+
+	if query.Offset < 0 {
+		query.Offset = 0
+	}
+
+	sagas, err = sagaManager.sagaStore.ListSagas(ctx, sagaManager.SagaName, query)
+
+	if err != nil {
+		return nil, fmt.Errorf("error listing sagas %s, %s", sagaManager.SagaName, err)
+	}
+
+	return sagas, nil
+}
+
+// GetSaga
+// Returns the saga with its events. SagaNotFound if there is no saga with the key
+func (sagaManager *SagaManager) GetSaga(ctx context.Context, sagaKey string) (saga Saga, err error) {
+
+	saga, err = sagaManager.sagaStore.GetSaga(ctx, sagaManager.SagaName, sagaKey)
+
+	if err != nil && err != SagaNotFound {
+		return saga, fmt.Errorf("error finding saga %s key %s, %s", sagaManager.SagaName, sagaKey, err)
+	}
+
+	return saga, err
+}
+
+// ForceComplete
+// Completes the saga with the events it has and runs the completed handler. Failed sagas are retried
+// from the first attempt. Returns the handler error, the saga stays pending completion if it fails.
+func (sagaManager *SagaManager) ForceComplete(ctx context.Context, sagaKey string) (saga Saga, err error) {
+
+	_, err = sagaManager.updateSaga(ctx, sagaKey, func(saga *Saga) error {
+
+		if saga.SagaName == "" {
+			return SagaNotFound
+		}
+
+		if saga.Completed && !saga.CompletionPending && !saga.Failed {
+			return SagaCompletedPreviously
+		}
+
+		saga.Completed = true
+		saga.CompletionPending = true
+		saga.CompletionAttempts = 0
+		saga.CompletionError = ""
+		saga.NextAttemptAt = time.Now().UTC().UnixNano()
+		saga.Failed = false
+
+		return nil
+	})
+
+	if err != nil {
+		return saga, err
+	}
+
+	log.Printf(ctx, "sagaManager", "Saga %s key %s force completed. Handling saga...", sagaManager.SagaName, sagaKey)
+
+	return sagaManager.runCompletion(ctx, sagaKey, false)
+}
+
+// ResetSaga
+// Clears the saga events and state, the next event starts it again.
+// The saga keeps its start and deadline, so a reset doesn't extend its timeout.
+func (sagaManager *SagaManager) ResetSaga(ctx context.Context, sagaKey string) (saga Saga, err error) {
+
+	saga, err = sagaManager.updateSaga(ctx, sagaKey, func(saga *Saga) error {
+
+		if saga.SagaName == "" {
+			return SagaNotFound
+		}
+
+		*saga = Saga{
+			SagaName:   saga.SagaName,
+			SagaKey:    saga.SagaKey,
+			EventTypes: sagaManager.EventTypes,
+			Events:     make(map[string]appevent.AppEvent),
+			History:    []appevent.AppEvent{},
+			Timestamp:  time.Now().UTC().UnixNano(),
+			StartedAt:  saga.StartedAt,
+			ExpiresAt:  saga.ExpiresAt,
+			Version:    saga.Version,
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return saga, err
+	}
+
+	log.Printf(ctx, "sagaManager", "Saga %s key %s reset", sagaManager.SagaName, sagaKey)
+
+	return saga, nil
+}
+
+// DeleteSaga
+// Deletes the saga. SagaNotFound if there is no saga with the key
+func (sagaManager *SagaManager) DeleteSaga(ctx context.Context, sagaKey string) (err error) {
+
+	err = sagaManager.sagaStore.DeleteSaga(ctx, sagaManager.SagaName, sagaKey)
+
+	if err == SagaNotFound {
+		return err
+	}
+
+	if err != nil {
+		return fmt.Errorf("error deleting saga %s key %s, %s", sagaManager.SagaName, sagaKey, err)
+	}
+
+	log.Printf(ctx, "sagaManager", "Saga %s key %s deleted", sagaManager.SagaName, sagaKey)
+
+	return nil
+}
+
+// valid
+// Returns true if the state is one of the saga states
+func (state SagaState) valid() bool {
+
+	switch state {
+	case SagaStateOpen, SagaStateCompleted, SagaStateCompletionPending, SagaStateFailed, SagaStateExpired:
+		return true
+	}
+
+	return false
+}
+
+// matches
+// Returns true if the saga is in the state
+func (state SagaState) matches(saga Saga) bool {
+
+	switch state {
+	case SagaStateOpen:
+		return !saga.Completed && !saga.Expired
+	case SagaStateCompleted:
+		return saga.Completed && !saga.CompletionPending && !saga.Failed
+	case SagaStateCompletionPending:
+		return saga.CompletionPending
+	case SagaStateFailed:
+		return saga.Failed
+	case SagaStateExpired:
+		return saga.Expired
+	}
+
+	return false
+}
+
+// AddAdminRoutes
+// Adds the saga administration routes, authorized for the roles, under the path.
+// ie. for path /admin/sagas and saga name checkin:
+//
+//	GET    /appID/admin/sagas/checkin?state=failed&minAge=24h&maxAge=168h&limit=50&offset=0
+//	GET    /appID/admin/sagas/checkin/{sagaKey}
+//	POST   /appID/admin/sagas/checkin/{sagaKey}/complete
+//	POST   /appID/admin/sagas/checkin/{sagaKey}/reset
+//	DELETE /appID/admin/sagas/checkin/{sagaKey}
+func (sagaManager *SagaManager) AddAdminRoutes(srv *server.AppServer, path string, authorizedRoles []string) (err error) {
+
+	path = fmt.Sprintf("%s/%s", path, sagaManager.SagaName)
+	keyPath := path + "/{sagaKey}"
+
+	routes := []struct {
+		path    string
+		method  string
+		handler http.HandlerFunc
+	}{
+		{path, http.MethodGet, sagaManager.listSagasHandler},
+		{keyPath, http.MethodGet, sagaManager.sagaKeyHandler(srv, func(ctx context.Context, sagaKey string) (interface{}, error) {
+			return sagaManager.GetSaga(ctx, sagaKey)
+		})},
+		{keyPath + "/complete", http.MethodPost, sagaManager.sagaKeyHandler(srv, func(ctx context.Context, sagaKey string) (interface{}, error) {
+			return sagaManager.ForceComplete(ctx, sagaKey)
+		})},
+		{keyPath + "/reset", http.MethodPost, sagaManager.sagaKeyHandler(srv, func(ctx context.Context, sagaKey string) (interface{}, error) {
+			return sagaManager.ResetSaga(ctx, sagaKey)
+		})},
+		{keyPath, http.MethodDelete, sagaManager.sagaKeyHandler(srv, func(ctx context.Context, sagaKey string) (interface{}, error) {
+			return nil, sagaManager.DeleteSaga(ctx, sagaKey)
+		})},
+	}
+
+	for _, route := range routes {
+
+		err = srv.AddAuthorizedRoute(route.path, route.method, authorizedRoles, route.handler)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (sagaManager *SagaManager) listSagasHandler(writer http.ResponseWriter, request *http.Request) {
+
+	ctx := appctx.NewContext(request)
+
+	query, err := parseSagaQuery(request)
+
+	if err != nil {
+		log.Errorf(ctx, "sagaManager", "Invalid saga query, %s", err)
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sagas, err := sagaManager.ListSagas(ctx, query)
+
+	writeSagaResponse(ctx, writer, sagas, err)
+}
+
+func (sagaManager *SagaManager) sagaKeyHandler(srv *server.AppServer, operation func(ctx context.Context, sagaKey string) (interface{}, error)) http.HandlerFunc {
+
+	return func(writer http.ResponseWriter, request *http.Request) {
+
+		ctx := appctx.NewContext(request)
+
+		response, err := operation(ctx, srv.Vars(request)["sagaKey"])
+
+		writeSagaResponse(ctx, writer, response, err)
+	}
+}
+
+func parseSagaQuery(request *http.Request) (query SagaQuery, err error) {
+
+	values := request.URL.Query()
+
+	query.State = SagaState(values.Get("state"))
+
+	if query.State != "" {
+
+		if !query.State.valid() {
+			return query, fmt.Errorf("invalid saga state %s", query.State)
+		}
+	}
+
+	for name, duration := range map[string]*time.Duration{"minAge": &query.MinAge, "maxAge": &query.MaxAge} {
+
+		if values.Get(name) == "" {
+			continue
+		}
+
+		*duration, err = time.ParseDuration(values.Get(name))
+
+		if err != nil {
+			return query, fmt.Errorf("invalid %s, %s", name, err)
+		}
+	}
+
+	for name, number := range map[string]*int{"limit": &query.Limit, "offset": &query.Offset} {
+
+		if values.Get(name) == "" {
+			continue
+		}
+
+		*number, err = strconv.Atoi(values.Get(name))
+
+		if err != nil {
+			return query, fmt.Errorf("invalid %s, %s", name, err)
+		}
+
+		if *number < 0 {
+			return query, fmt.Errorf("invalid %s %d, must not be negative", name, *number)
+		}
+	}
+
+	return query, nil
+}
+
+func writeSagaResponse(ctx context.Context, writer http.ResponseWriter, response interface{}, err error) {
+
+	switch {
+	case err == SagaNotFound:
+		http.Error(writer, err.Error(), http.StatusNotFound)
+		return
+
+	case err == SagaCompletedPreviously:
+		http.Error(writer, err.Error(), http.StatusConflict)
+		return
+
+	case err != nil:
+		log.Errorf(ctx, "sagaManager", "Error handling saga admin request, %s", err)
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if response == nil {
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	responseJSON, err := json.Marshal(response)
+
+	if err != nil {
+		log.Errorf(ctx, "sagaManager", "Error serializing saga admin response, %s", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+
+	_, _ = writer.Write(responseJSON)
+}
@@ -0,0 +1,224 @@
+package appsaga
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/app"
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/db"
+	"github.com/HelloSundayMorning/apputils/server"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestSagaManager_ListSagas(t *testing.T) {
+
+	type testDef struct {
+		Query     SagaQuery
+		Statement string
+		Args      int
+		HasErr    bool
+	}
+
+	Tests := []testDef{
+		{SagaQuery{}, `WHERE saga_name = \$1 ORDER BY started_at, saga_key LIMIT \$2 OFFSET \$3`, 3, false},
+		{SagaQuery{State: SagaStateFailed, Limit: 10}, `WHERE saga_name = \$1 AND failed = true ORDER BY`, 3, false},
+		{SagaQuery{State: SagaStateOpen, MinAge: time.Hour}, `AND completed = false AND expired = false AND started_at <= \$2 ORDER BY started_at, saga_key LIMIT \$3 OFFSET \$4`, 4, false},
+		{SagaQuery{MinAge: time.Hour, MaxAge: 24 * time.Hour}, `AND started_at <= \$2 AND started_at >= \$3 ORDER BY started_at, saga_key LIMIT \$4 OFFSET \$5`, 5, false},
+		{SagaQuery{State: "unknown"}, ``, 0, true},
+	}
+
+	for idx, test := range Tests {
+
+		mockDb, mock, err := db.NewMockDB()
+
+		assert.NoError(t, err)
+
+		manager := &SagaManager{AppID: "testApp", sagaStore: NewPostgresSagaStore(mockDb), SagaName: "testSaga"}
+
+		if !test.HasErr {
+
+			args := []driver.Value{"testSaga"}
+
+			for len(args) < test.Args {
+				args = append(args, sqlmock.AnyArg())
+			}
+
+			rows := sqlmock.NewRows(sagaRowColumns).
+				AddRow("testSaga", "key1", 1, []byte(`{"a":{"EventType":"a"}}`), "{a,b}", false, 1, 0, false,
+					[]byte(`[{"EventType":"a"}]`), false, 0, "", 0, false, 1)
+
+			mock.ExpectQuery(test.Statement).WithArgs(args...).WillReturnRows(rows)
+		}
+
+		ctx := appctx.NewContextFromValues("testApp", "correlationID")
+
+		sagas, err := manager.ListSagas(ctx, test.Query)
+
+		assert.Equalf(t, test.HasErr, err != nil, "Failed test %d", idx)
+		assert.NoErrorf(t, mock.ExpectationsWereMet(), "Failed test %d", idx)
+
+		if !test.HasErr {
+			assert.Lenf(t, sagas, 1, "Failed test %d", idx)
+			assert.Equalf(t, "key1", sagas[0].SagaKey, "Failed test %d", idx)
+		}
+	}
+}
+
+func TestSagaManager_AddAdminRoutes(t *testing.T) {
+
+	_ = os.Setenv(app.AppEnvironmentEnv, app.LocalEnvironment)
+
+	mockDb, mock, err := db.NewMockDB()
+
+	assert.NoError(t, err)
+
+	manager := &SagaManager{AppID: "APPID", sagaStore: NewPostgresSagaStore(mockDb), SagaName: "testSaga", EventTypes: []string{"a", "b"}}
+
+	srv := server.NewServer("APPID", 8000)
+
+	err = manager.AddAdminRoutes(srv, "/admin/sagas", []string{"ADMIN"})
+
+	assert.NoError(t, err)
+
+	type testDef struct {
+		Method         string
+		Path           string
+		Roles          string
+		Expect         func()
+		ExpectedStatus int
+	}
+
+	sagaRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(sagaRowColumns).
+			AddRow("testSaga", "key1", 1, []byte(`{"a":{"EventType":"a"}}`), "{a,b}", false, 1, 0, false,
+				[]byte(`[{"EventType":"a"}]`), false, 0, "", 0, false, 1)
+	}
+
+	Tests := []testDef{
+		{"GET", "/APPID/admin/sagas/testSaga", "USER", func() {}, http.StatusForbidden},
+		{"GET", "/APPID/admin/sagas/testSaga?state=unknown", "ADMIN", func() {}, http.StatusBadRequest},
+		{"GET", "/APPID/admin/sagas/testSaga?offset=-1", "ADMIN", func() {}, http.StatusBadRequest},
+		{"GET", "/APPID/admin/sagas/testSaga?limit=-10", "ADMIN", func() {}, http.StatusBadRequest},
+		{"GET", "/APPID/admin/sagas/testSaga?state=open&minAge=1h", "ADMIN", func() {
+			mock.ExpectQuery("FROM saga_manager").WillReturnRows(sagaRows())
+		}, http.StatusOK},
+		{"GET", "/APPID/admin/sagas/testSaga/key1", "ADMIN", func() {
+			mock.ExpectQuery("FROM saga_manager").WithArgs("testSaga", "key1").WillReturnRows(sagaRows())
+		}, http.StatusOK},
+		{"GET", "/APPID/admin/sagas/testSaga/key2", "ADMIN", func() {
+			mock.ExpectQuery("FROM saga_manager").WithArgs("testSaga", "key2").WillReturnRows(sqlmock.NewRows(sagaRowColumns))
+		}, http.StatusNotFound},
+		{"POST", "/APPID/admin/sagas/testSaga/key1/reset", "ADMIN", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery("FROM saga_manager").WithArgs("testSaga", "key1").WillReturnRows(sagaRows())
+			mock.ExpectExec("UPDATE saga_manager SET").WithArgs("testSaga", "key1", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+				sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), int64(1)).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+		}, http.StatusOK},
+		{"DELETE", "/APPID/admin/sagas/testSaga/key1", "ADMIN", func() {
+			mock.ExpectExec("DELETE FROM saga_manager").WithArgs("testSaga", "key1").WillReturnResult(sqlmock.NewResult(0, 1))
+		}, http.StatusNoContent},
+		{"DELETE", "/APPID/admin/sagas/testSaga/key2", "ADMIN", func() {
+			mock.ExpectExec("DELETE FROM saga_manager").WithArgs("testSaga", "key2").WillReturnResult(sqlmock.NewResult(0, 0))
+		}, http.StatusNotFound},
+	}
+
+	for idx, test := range Tests {
+
+		test.Expect()
+
+		request := httptest.NewRequest(test.Method, test.Path, nil)
+		request.Header.Add(appctx.AuthorizedUserIDHeader, "UserID")
+		request.Header.Add(appctx.AuthorizedUserRolesHeader, test.Roles)
+
+		wri := httptest.NewRecorder()
+
+		srv.Handler.ServeHTTP(wri, request)
+
+		assert.Equalf(t, test.ExpectedStatus, wri.Result().StatusCode, "Failed test %d", idx)
+		assert.NoErrorf(t, mock.ExpectationsWereMet(), "Failed test %d", idx)
+	}
+}
+
+func TestSagaManager_ForceComplete(t *testing.T) {
+
+	mockDb, mock, err := db.NewMockDB()
+
+	assert.NoError(t, err)
+
+	var handled []Saga
+
+	manager := &SagaManager{AppID: "testApp", sagaStore: NewPostgresSagaStore(mockDb), SagaName: "testSaga", EventTypes: []string{"a", "b"}, retryPolicy: DefaultCompletionRetryPolicy}
+
+	manager.completedHandler = func(ctx context.Context, saga Saga) error {
+		handled = append(handled, saga)
+		return nil
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM saga_manager").WithArgs("testSaga", "key1").WillReturnRows(sqlmock.NewRows(sagaRowColumns).
+		AddRow("testSaga", "key1", 1, []byte(`{"a":{"EventType":"a"}}`), "{a,b}", true, 1, 0, false,
+			[]byte(`[{"EventType":"a"}]`), false, 5, "failed", 0, true, 1))
+	mock.ExpectExec("UPDATE saga_manager SET").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FOR UPDATE SKIP LOCKED").WithArgs("testSaga", "key1").WillReturnRows(sqlmock.NewRows(sagaRowColumns).
+		AddRow("testSaga", "key1", 1, []byte(`{"a":{"EventType":"a"}}`), "{a,b}", true, 1, 0, false,
+			[]byte(`[{"EventType":"a"}]`), true, 0, "", 0, false, 1))
+	mock.ExpectExec("UPDATE saga_manager SET").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FOR UPDATE SKIP LOCKED").WithArgs("testSaga", "key1").WillReturnRows(sqlmock.NewRows(sagaRowColumns).
+		AddRow("testSaga", "key1", 1, []byte(`{"a":{"EventType":"a"}}`), "{a,b}", true, 1, 0, false,
+			[]byte(`[{"EventType":"a"}]`), true, 1, "", 0, false, 1))
+	mock.ExpectExec("UPDATE saga_manager SET").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	ctx := appctx.NewContextFromValues("testApp", "correlationID")
+
+	saga, err := manager.ForceComplete(ctx, "key1")
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Len(t, handled, 1)
+	assert.False(t, saga.CompletionPending)
+	assert.False(t, saga.Failed)
+}
+
+func TestSagaManager_ResetSaga(t *testing.T) {
+
+	mockDb, mock, err := db.NewMockDB()
+
+	assert.NoError(t, err)
+
+	manager := &SagaManager{AppID: "testApp", sagaStore: NewPostgresSagaStore(mockDb), SagaName: "testSaga", EventTypes: []string{"a", "b"}}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FROM saga_manager").WithArgs("testSaga", "key1").WillReturnRows(sqlmock.NewRows(sagaRowColumns).
+		AddRow("testSaga", "key1", 1, []byte(`{"a":{"EventType":"a"}}`), "{a,b}", true, 10, 20, false,
+			[]byte(`[{"EventType":"a"}]`), false, 5, "failed", 0, true, 7))
+	mock.ExpectExec("UPDATE saga_manager SET").WithArgs("testSaga", "key1", sqlmock.AnyArg(), []byte("{}"), sqlmock.AnyArg(), false, int64(10), int64(20), false,
+		[]byte("[]"), false, 0, "", int64(0), false, int64(7)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	ctx := appctx.NewContextFromValues("testApp", "correlationID")
+
+	saga, err := manager.ResetSaga(ctx, "key1")
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Empty(t, saga.History)
+	assert.False(t, saga.Completed)
+	assert.False(t, saga.Failed)
+	assert.Equal(t, int64(10), saga.StartedAt)
+	assert.Equal(t, int64(8), saga.Version)
+}
@@ -1,30 +1,50 @@
 package appsaga
 
 import (
-	"database/sql"
-	"encoding/json"
 	"fmt"
 	"github.com/HelloSundayMorning/apputils/app"
 	"github.com/HelloSundayMorning/apputils/appevent"
 	"github.com/HelloSundayMorning/apputils/db"
 	"github.com/HelloSundayMorning/apputils/log"
-	"github.com/lib/pq"
 	"golang.org/x/net/context"
 	"time"
 )
 
 var (
 	SagaCompletedPreviously = fmt.Errorf("saga completed previously, cannot be handled")
+	SagaExpiredPreviously   = fmt.Errorf("saga expired previously, cannot be handled")
 )
 
 type (
+	// Saga
+	// Events holds the last event of each type, History all the events in arrival order.
+	// A completed saga is CompletionPending until its completed handler succeeds, or Failed
+	// when the handler exceeded the max attempts of the retry policy.
 	Saga struct {
+		SagaName           string
+		SagaKey            string
+		Events             map[string]appevent.AppEvent
+		History            []appevent.AppEvent
+		EventTypes         []string
+		Completed          bool
+		Timestamp          int64
+		StartedAt          int64 // first event time, unix nano
+		ExpiresAt          int64 // deadline, unix nano. 0 if the saga has no timeout
+		Expired            bool
+		CompletionPending  bool
+		CompletionAttempts int
+		CompletionError    string
+		NextAttemptAt      int64 // next completed handler attempt, unix nano
+		Failed             bool
+		Version            int64 // incremented on each update, for optimistic locking
+	}
+
+	// SagaDefinition
+	// The event types a saga accepts and its completion predicate, AllOf the event types if nil
+	SagaDefinition struct {
 		SagaName   string
-		SagaKey    string
-		Events     map[string]appevent.AppEvent
 		EventTypes []string
-		Completed  bool
-		Timestamp  int64
+		Completion CompletionPredicate
 	}
 
 	ISagaManager interface {
@@ -32,286 +52,174 @@ type (
 	}
 
 	SagaManager struct {
-		AppID            app.ApplicationID
-		sqlDb            db.AppSqlDb
-		SagaName         string
-		EventTypes       []string
-		completedHandler SagaCompletedHandler
+		AppID              app.ApplicationID
+		sagaStore          SagaStore
+		SagaName           string
+		EventTypes         []string
+		completion         CompletionPredicate
+		completedHandler   SagaCompletedHandler
+		completedTxHandler SagaCompletedTxHandler
+		retryPolicy        CompletionRetryPolicy
+		updateRetryPolicy  SagaUpdateRetryPolicy
+		retrierChan        chan bool
+		timeout            time.Duration
+		timeoutHandler     SagaTimeoutHandler
+		expiredHandler     SagaExpiredEventHandler
+		sweeperChan        chan bool
+		retentionChan      chan bool
 	}
 
 	SagaCompletedHandler func(ctx context.Context, saga Saga) (err error)
 
+	// SagaCompletedTxHandler
+	// Completed handler running in the transaction that commits the saga completion
+	SagaCompletedTxHandler func(ctx context.Context, tx db.AppSqlTx, saga Saga) (err error)
 
-)
+	// SagaTimeoutHandler
+	// Called once with the partial saga when it doesn't complete before its deadline
+	SagaTimeoutHandler func(ctx context.Context, saga Saga) (err error)
+
+	// SagaExpiredEventHandler
+	// Called with the events added to a saga after it expired
+	SagaExpiredEventHandler func(ctx context.Context, saga Saga, appEvent appevent.AppEvent) (err error)
 
-const (
-	createSagaTable = `CREATE TABLE IF NOT EXISTS saga_manager (
-									 saga_name                  varchar(50)               not null,
-									 saga_key                   varchar(500)              not null,
-                                     timestamp                  bigint                    not null,
-                                     events                     json default '{}' :: json not null,
-                                     event_types                text []                   not null,
-                                     completed                  boolean                   not null,
-                                     PRIMARY KEY (saga_name, saga_key));`
-
-	insertSaga = `INSERT INTO saga_manager (saga_name, saga_key, timestamp, events , event_types, completed)
-                                VALUES ($1, $2, $3, $4, $5, $6)
-                                ON CONFLICT (saga_name, saga_key) DO UPDATE SET
-                                timestamp = $3,
-                                events = $4,
-                                event_types = $5,
-                                completed = $6`
-
-	findSaga = `SELECT saga_name, saga_key, timestamp, events , event_types, completed
-                    FROM saga_manager
-                    WHERE saga_name = $1 AND saga_key = $2`
 )
 
 func NewSagaManager(appID app.ApplicationID, sqlDb db.AppSqlDb, sagaName string, eventTypes []string, sagaCompletedHandler SagaCompletedHandler) (manager *SagaManager, err error) {
 
-	manager = &SagaManager{
-		AppID:            appID,
-		sqlDb:            sqlDb,
-		SagaName:         sagaName,
-		EventTypes:       eventTypes,
-		completedHandler: sagaCompletedHandler,
-	}
-
-	err = manager.initialize()
-
-	if err != nil {
-		return nil, err
-	}
-
-	log.PrintfNoContext(manager.AppID, "sagaManager", "Saga Manager %s for eventTypes: %s", sagaName, eventTypes)
-
-	return manager, nil
+	return NewSagaManagerFromDefinition(appID, sqlDb, SagaDefinition{SagaName: sagaName, EventTypes: eventTypes}, sagaCompletedHandler)
 }
 
-func (sagaManager *SagaManager) initialize() (err error) {
-
-	conn := sagaManager.sqlDb.GetDB()
-
-	ctx := context.Background()
-
-	tx, err := conn.BeginTx(ctx, nil)
-
-	if err != nil {
-		return err
-	}
-
-	stmt, err := tx.Prepare(createSagaTable)
-
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-
-	_, err = stmt.Exec()
-
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-
-	err = tx.Commit()
-
-	if err != nil {
-		return err
-	}
+// NewSagaManagerFromDefinition
+// Creates a saga manager completing sagas by the definition completion predicate
+func NewSagaManagerFromDefinition(appID app.ApplicationID, sqlDb db.AppSqlDb, definition SagaDefinition, sagaCompletedHandler SagaCompletedHandler) (manager *SagaManager, err error) {
 
-	return nil
+	return NewSagaManagerWithStore(appID, NewPostgresSagaStore(sqlDb), definition, sagaCompletedHandler)
 }
 
-func (sagaManager *SagaManager) store(ctx context.Context, tx *sql.Tx, saga *Saga) (err error) {
+// NewSagaManagerWithStore
+// Creates a saga manager storing the sagas in the store, ie. NewMemorySagaStore() in tests
+func NewSagaManagerWithStore(appID app.ApplicationID, sagaStore SagaStore, definition SagaDefinition, sagaCompletedHandler SagaCompletedHandler) (manager *SagaManager, err error) {
 
-	stmt, err := tx.Prepare(insertSaga)
-
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
+	sagaName := definition.SagaName
+	eventTypes := definition.EventTypes
 
-	eventsMapJSON, err := json.Marshal(saga.Events)
+	completion := definition.Completion
 
-	if err != nil {
-		tx.Rollback()
-		return err
+	if completion == nil {
+		completion = AllOf(eventTypes...)
 	}
 
-	_, err = stmt.Exec(saga.SagaName, saga.SagaKey, saga.Timestamp, eventsMapJSON, pq.Array(saga.EventTypes), saga.Completed)
-
-	if err != nil {
-		tx.Rollback()
-		return err
+	manager = &SagaManager{
+		AppID:             appID,
+		sagaStore:         sagaStore,
+		SagaName:          sagaName,
+		EventTypes:        eventTypes,
+		completion:        completion,
+		completedHandler:  sagaCompletedHandler,
+		retryPolicy:       DefaultCompletionRetryPolicy,
+		updateRetryPolicy: DefaultSagaUpdateRetryPolicy,
 	}
 
-	return nil
-
-}
-
-func (sagaManager *SagaManager) findSagaByKey(ctx context.Context, tx *sql.Tx, sagaKey string) (userSaga Saga, err error) {
-
-	rows, err := tx.Query(findSaga, sagaManager.SagaName, sagaKey)
+	err = sagaStore.Initialize(context.Background())
 
 	if err != nil {
-		return userSaga, err
+		return nil, err
 	}
 
-	defer rows.Close()
-
-	userSaga.Events = make(map[string]appevent.AppEvent)
-
-	var eventsMapJSON json.RawMessage
-
-	if rows.Next() {
-
-		err = rows.Scan(&userSaga.SagaName, &userSaga.SagaKey, &userSaga.Timestamp, &eventsMapJSON, pq.Array(&userSaga.EventTypes), &userSaga.Completed)
+	log.PrintfNoContext(manager.AppID, "sagaManager", "Saga Manager %s for eventTypes: %s", sagaName, eventTypes)
 
-		if err != nil {
-			return userSaga, err
-		}
+	return manager, nil
+}
 
-		err = json.Unmarshal(eventsMapJSON, &userSaga.Events)
+func (sagaManager *SagaManager) AddEvent(ctx context.Context, sagaKey string, appEvent appevent.AppEvent) (saga Saga, err error) {
 
-		if err != nil {
-			return userSaga, err
-		}
+	saga, err = sagaManager.recordEvent(ctx, sagaKey, appEvent)
 
+	if err != nil || !saga.CompletionPending {
+		return saga, err
 	}
 
-	return userSaga, nil
-
+	return sagaManager.runCompletion(ctx, sagaKey, false)
 }
 
-func (sagaManager *SagaManager) AddEvent(ctx context.Context, sagaKey string, appEvent appevent.AppEvent) (saga Saga, err error) {
+// recordEvent
+// Adds the event to the saga. The saga returned is CompletionPending when the completed handler must run.
+func (sagaManager *SagaManager) recordEvent(ctx context.Context, sagaKey string, appEvent appevent.AppEvent) (saga Saga, err error) {
 
 	if !sagaManager.isValidEvent(appEvent) {
 		return saga, fmt.Errorf("invalid event type %s add attempt to saga %s", appEvent.EventType, sagaManager.SagaName)
 	}
 
-	conn := sagaManager.sqlDb.GetDB()
-
-	sagaCommitAttempt := 0
-
-	for {
-		sagaCommitAttempt++
-		saga, err = sagaManager.processSaga(ctx, conn, sagaKey, appEvent)
+	saga, err = sagaManager.processSaga(ctx, sagaKey, appEvent)
 
-		if err == SagaCompletedPreviously {
-			log.Printf(ctx, "sagaManager", "Saga %s key %s was completed previously. Ignoring handler.", saga.SagaName, saga.SagaKey)
-			return saga, nil
-		}
+	if err == SagaCompletedPreviously && saga.CompletionPending {
+		log.Printf(ctx, "sagaManager", "Saga %s key %s was completed previously. Completion is pending, retrying handler.", saga.SagaName, saga.SagaKey)
+		return saga, nil
+	}
 
-		if err != nil && sagaCommitAttempt < 2 {
-			log.Printf(ctx, "sagaManager", "Saga %s key %s possibly conflicted with concurrent update. Err msg: %s ,Retrying...", saga.SagaName, saga.SagaKey, err)
-			continue
-		}
+	if err == SagaCompletedPreviously {
+		log.Printf(ctx, "sagaManager", "Saga %s key %s was completed previously. Ignoring handler.", saga.SagaName, saga.SagaKey)
+		return saga, nil
+	}
 
-		if err != nil {
-			return saga, err
-		}
+	if err == SagaExpiredPreviously {
+		return saga, sagaManager.handleExpiredEvent(ctx, saga, appEvent)
+	}
 
-		break
+	if err != nil {
+		return saga, err
 	}
 
 	log.Printf(ctx, "sagaManager", "Saga %s key %s updated with event type %s. Completed %t", saga.SagaName, saga.SagaKey, appEvent.EventType, saga.Completed)
 
 	if saga.Completed {
-
 		log.Printf(ctx, "sagaManager", "Saga %s key %s Completed. Handling saga...", saga.SagaName, saga.SagaKey)
-
-		handlerErr := sagaManager.completedHandler(ctx, saga)
-
-		if handlerErr != nil {
-
-			log.Printf(ctx, "sagaManager", "Saga %s key %s Completed. But got error while executing completed handler. Completion will be rolled back..., %s", saga.SagaName, saga.SagaKey, handlerErr)
-
-			tx, err := conn.Begin()
-
-			if err != nil {
-				return saga, err
-			}
-
-			saga.Completed = false
-
-			err = sagaManager.store(ctx, tx, &saga)
-
-			if err != nil {
-				return saga, err
-			}
-
-			err = tx.Commit()
-
-			if err != nil {
-				return saga, err
-			}
-
-			return saga, handlerErr
-		}
-
 	}
 
-
 	return saga, nil
 }
 
-func (sagaManager *SagaManager) processSaga(ctx context.Context, conn *sql.DB, sagaKey string, appEvent appevent.AppEvent) (saga Saga, err error){
+func (sagaManager *SagaManager) processSaga(ctx context.Context, sagaKey string, appEvent appevent.AppEvent) (saga Saga, err error) {
 
-	tx, err := conn.Begin()
+	return sagaManager.updateSaga(ctx, sagaKey, func(saga *Saga) error {
 
-	if err != nil {
-		tx.Rollback()
-		return saga, err
-	}
-
-	//TODO: Test with REPEATABLE READ isolation level
-	_, err = tx.Exec(`set transaction isolation level serializable`)   // <=== SET ISOLATION LEVEL
-
-	if err != nil {
-		tx.Rollback()
-		return saga, err
-	}
-
-	saga, err = sagaManager.findSagaByKey(ctx, tx, sagaKey)
-
-	if err != nil {
-		tx.Rollback()
-		return saga, err
-	}
-
-	if saga.Completed {
-		err = tx.Commit()
-
-		if err != nil {
-			return saga, err
+		if saga.Completed {
+			return SagaCompletedPreviously
 		}
 
-		return saga, SagaCompletedPreviously
-	}
-
-	saga.SagaName = sagaManager.SagaName
-	saga.EventTypes = sagaManager.EventTypes
-	saga.SagaKey = sagaKey
-	saga.Timestamp = time.Now().UTC().UnixNano()
-	saga.Events[appEvent.EventType] = appEvent
+		now := time.Now().UTC().UnixNano()
 
-	saga.Completed = sagaManager.validateCompleted(saga)
+		// a saga past its deadline is expired, even before the sweeper marks it
+		if saga.Expired || (saga.ExpiresAt > 0 && saga.ExpiresAt <= now) {
+			return SagaExpiredPreviously
+		}
 
-	err = sagaManager.store(ctx, tx, &saga)
+		saga.SagaName = sagaManager.SagaName
+		saga.EventTypes = sagaManager.EventTypes
+		saga.SagaKey = sagaKey
+		saga.Timestamp = now
+		saga.Events[appEvent.EventType] = appEvent
+		saga.History = append(saga.History, appEvent)
 
-	if err != nil {
-		return saga, err
-	}
+		if saga.StartedAt == 0 {
+			saga.StartedAt = now
 
-	err = tx.Commit()
+			if sagaManager.timeout > 0 {
+				saga.ExpiresAt = now + sagaManager.timeout.Nanoseconds()
+			}
+		}
 
-	if err != nil {
-		return saga, err
-	}
+		saga.Completed = sagaManager.validateCompleted(*saga)
 
-	return saga, err
+		// the completed handler runs after commit, the saga is pending until it succeeds
+		if saga.Completed {
+			saga.CompletionPending = true
+			saga.NextAttemptAt = now
+		}
 
+		return nil
+	})
 }
 
 func (sagaManager *SagaManager) isValidEvent(appEvent appevent.AppEvent) bool {
@@ -329,11 +237,7 @@ func (sagaManager *SagaManager) isValidEvent(appEvent appevent.AppEvent) bool {
 
 func (sagaManager *SagaManager) validateCompleted(saga Saga) bool {
 
-	if len(sagaManager.EventTypes) == len(saga.Events) {
-		return true
-	}
-
-	return false
+	return sagaManager.completion(saga)
 }
 
 
@@ -0,0 +1,483 @@
+package appsaga
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/HelloSundayMorning/apputils/db"
+	"github.com/HelloSundayMorning/apputils/eventpubsub"
+	"github.com/HelloSundayMorning/apputils/log"
+	"github.com/gofrs/uuid"
+	"golang.org/x/net/context"
+)
+
+type (
+	// CompletionPredicate
+	// Returns true when the saga events complete it
+	CompletionPredicate func(saga Saga) bool
+
+	// CompletionRetryPolicy
+	// Retries of the completed handler of the sagas pending completion.
+	// - MaxAttempts: attempts before the saga is marked failed and the alert is raised. 0 retries forever
+	// - InitialBackoff: wait after the first failure, doubled on each failure up to MaxBackoff, see db.Backoff
+	// - AlertPubSub and AlertTopic: publish the saga_completion_failed alert event. nil only logs the failure
+	CompletionRetryPolicy struct {
+		MaxAttempts    int
+		InitialBackoff time.Duration
+		MaxBackoff     time.Duration
+		AlertPubSub    eventpubsub.EventPubSub
+		AlertTopic     string
+	}
+
+	// SagaCompletionFailed
+	// Data of the alert event raised when a saga completed handler exceeds the max attempts
+	SagaCompletionFailed struct {
+		SagaName  string
+		SagaKey   string
+		Attempts  int
+		LastError string
+	}
+)
+
+const (
+	SagaCompletionFailedEventType = "saga_completion_failed"
+
+	DefaultCompletionRetrierInterval = 10 * time.Second
+
+	// completionLease
+	// Time an attempt of the completed handler is leased to the replica running it
+	completionLease = 5 * time.Minute
+)
+
+var (
+	errCompletionNotDue = fmt.Errorf("saga completion not due")
+
+	DefaultCompletionRetryPolicy = CompletionRetryPolicy{
+		MaxAttempts:    10,
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Minute,
+	}
+)
+
+// AllOf
+// Completes the saga when it has events of all the types
+func AllOf(eventTypes ...string) CompletionPredicate {
+
+	return func(saga Saga) bool {
+
+		for _, eventType := range eventTypes {
+
+			if _, ok := saga.Events[eventType]; !ok {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+// AnyOf
+// Completes the saga when it has an event of any of the types
+func AnyOf(eventTypes ...string) CompletionPredicate {
+
+	return func(saga Saga) bool {
+
+		for _, eventType := range eventTypes {
+
+			if _, ok := saga.Events[eventType]; ok {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// Count
+// Completes the saga when it has at least count events of the type, e.g. 3 check-ins
+func Count(eventType string, count int) CompletionPredicate {
+
+	return func(saga Saga) bool {
+
+		found := 0
+
+		for _, event := range saga.History {
+
+			if event.EventType == eventType {
+				found++
+			}
+		}
+
+		return found >= count
+	}
+}
+
+// InOrder
+// Completes the saga when it has events of the types in that order, e.g. A then B.
+// Other events in between are allowed.
+func InOrder(eventTypes ...string) CompletionPredicate {
+
+	return func(saga Saga) bool {
+
+		next := 0
+
+		for _, event := range saga.History {
+
+			if next < len(eventTypes) && event.EventType == eventTypes[next] {
+				next++
+			}
+		}
+
+		return next == len(eventTypes)
+	}
+}
+
+// And
+// Completes the saga when all the predicates do
+func And(predicates ...CompletionPredicate) CompletionPredicate {
+
+	return func(saga Saga) bool {
+
+		for _, predicate := range predicates {
+
+			if !predicate(saga) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+// Or
+// Completes the saga when any of the predicates does
+func Or(predicates ...CompletionPredicate) CompletionPredicate {
+
+	return func(saga Saga) bool {
+
+		for _, predicate := range predicates {
+
+			if predicate(saga) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// SetCompletionRetryPolicy
+// Sets the retry policy of the completed handler, DefaultCompletionRetryPolicy if not set
+func (sagaManager *SagaManager) SetCompletionRetryPolicy(policy CompletionRetryPolicy) {
+
+	sagaManager.retryPolicy = policy
+}
+
+// SetCompletedTxHandler
+// Replaces the completed handler with a handler running in the transaction that marks the saga
+// handled, so the handler writes, and the events published with eventpubsub PublishWithSqlTx,
+// commit atomically with the saga state. If the handler fails its writes are rolled back and
+// the saga stays pending completion. With a store without transactions the tx is nil.
+func (sagaManager *SagaManager) SetCompletedTxHandler(completedTxHandler SagaCompletedTxHandler) {
+
+	sagaManager.completedTxHandler = completedTxHandler
+}
+
+// StartCompletionRetrier
+// Periodically runs the completed handler of the sagas pending completion when their next attempt is due.
+// Each attempt is leased while handled, so retriers on several replicas don't run it twice.
+func (sagaManager *SagaManager) StartCompletionRetrier(interval time.Duration) (err error) {
+
+	if sagaManager.retrierChan != nil {
+		return fmt.Errorf("completion retrier already started for saga %s", sagaManager.SagaName)
+	}
+
+	retrierChan := make(chan bool)
+	sagaManager.retrierChan = retrierChan
+
+	go func() {
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				sagaManager.retryPending()
+			case <-retrierChan:
+				return
+			}
+		}
+	}()
+
+	log.PrintfNoContext(sagaManager.AppID, "sagaManager", "Saga %s completion retrier started. Interval %s", sagaManager.SagaName, interval)
+
+	return nil
+}
+
+// StopCompletionRetrier
+// Stops the completion retrier, if started
+func (sagaManager *SagaManager) StopCompletionRetrier() {
+
+	if sagaManager.retrierChan != nil {
+		close(sagaManager.retrierChan)
+		sagaManager.retrierChan = nil
+	}
+}
+
+func (sagaManager *SagaManager) retryPending() {
+
+	sagaKeys, err := sagaManager.sagaStore.FindDuePendingSagaKeys(context.Background(), sagaManager.SagaName, time.Now().UTC().UnixNano())
+
+	if err != nil {
+		log.ErrorfNoContext(sagaManager.AppID, "sagaManager", "Error finding sagas %s pending completion, %s", sagaManager.SagaName, err)
+		return
+	}
+
+	for _, sagaKey := range sagaKeys {
+
+		correlationID, _ := uuid.NewV4()
+
+		ctx := appctx.NewContextFromValues(sagaManager.AppID, correlationID.String())
+
+		_, err := sagaManager.runCompletion(ctx, sagaKey, true)
+
+		if err != nil {
+			log.Errorf(ctx, "sagaManager", "Error retrying completion of saga %s key %s, %s", sagaManager.SagaName, sagaKey, err)
+		}
+	}
+}
+
+// runCompletion
+// Runs the completed handler of a saga pending completion and records the attempt.
+// onlyDue skips the saga if its next attempt is not due yet.
+// Returns the handler error, nil if the saga is not pending or is being handled by other replica,
+// in which case the saga is returned as stored.
+func (sagaManager *SagaManager) runCompletion(ctx context.Context, sagaKey string, onlyDue bool) (saga Saga, err error) {
+
+	if sagaManager.completedTxHandler != nil {
+		return sagaManager.runCompletionTx(ctx, sagaKey, onlyDue)
+	}
+
+	// the attempt is claimed in a short transaction, the handler runs without holding the saga lock.
+	// The next attempt is leased meanwhile, so retriers on other replicas don't run it
+	saga, err = sagaManager.sagaStore.UpdatePendingSaga(ctx, sagaManager.SagaName, sagaKey, func(tx db.AppSqlTx, saga *Saga) error {
+
+		now := time.Now().UTC()
+
+		if onlyDue && saga.NextAttemptAt > now.UnixNano() {
+			return errCompletionNotDue
+		}
+
+		saga.CompletionAttempts++
+		saga.NextAttemptAt = now.Add(completionLease).UnixNano()
+
+		return nil
+	})
+
+	if err == SagaNotFound || err == errCompletionNotDue {
+		return sagaManager.findSkippedSaga(ctx, sagaKey)
+	}
+
+	if err != nil {
+		return saga, err
+	}
+
+	attempts := saga.CompletionAttempts
+
+	handlerErr := sagaManager.completedHandler(ctx, saga)
+
+	saga, err = sagaManager.sagaStore.UpdatePendingSaga(ctx, sagaManager.SagaName, sagaKey, func(tx db.AppSqlTx, saga *Saga) error {
+
+		// a later attempt was claimed meanwhile, it records its own result
+		if handlerErr != nil && saga.CompletionAttempts != attempts {
+			return errCompletionNotDue
+		}
+
+		sagaManager.recordCompletionAttempt(ctx, saga, handlerErr)
+
+		return nil
+	})
+
+	if err == SagaNotFound || err == errCompletionNotDue {
+		saga, err = sagaManager.findSkippedSaga(ctx, sagaKey)
+
+		if err != nil {
+			return saga, err
+		}
+
+		return saga, handlerErr
+	}
+
+	if err != nil {
+		return saga, err
+	}
+
+	if saga.Failed {
+		sagaManager.raiseCompletionFailed(ctx, saga)
+	}
+
+	return saga, handlerErr
+}
+
+// runCompletionTx
+// Runs the transactional completed handler in the transaction recording the attempt
+func (sagaManager *SagaManager) runCompletionTx(ctx context.Context, sagaKey string, onlyDue bool) (saga Saga, err error) {
+
+	var handlerErr error
+
+	saga, err = sagaManager.sagaStore.UpdatePendingSaga(ctx, sagaManager.SagaName, sagaKey, func(tx db.AppSqlTx, saga *Saga) error {
+
+		if onlyDue && saga.NextAttemptAt > time.Now().UTC().UnixNano() {
+			return errCompletionNotDue
+		}
+
+		handlerErr = sagaManager.handleCompletedTx(ctx, tx, *saga)
+
+		saga.CompletionAttempts++
+
+		sagaManager.recordCompletionAttempt(ctx, saga, handlerErr)
+
+		return nil
+	})
+
+	if err == SagaNotFound || err == errCompletionNotDue {
+		return sagaManager.findSkippedSaga(ctx, sagaKey)
+	}
+
+	if err != nil {
+		return saga, err
+	}
+
+	if saga.Failed {
+		sagaManager.raiseCompletionFailed(ctx, saga)
+	}
+
+	return saga, handlerErr
+}
+
+// recordCompletionAttempt
+// Completes the saga if the handler succeeded. Otherwise schedules the next attempt,
+// or marks the saga failed when the attempts reach the max attempts of the retry policy
+func (sagaManager *SagaManager) recordCompletionAttempt(ctx context.Context, saga *Saga, handlerErr error) {
+
+	policy := sagaManager.retryPolicy
+
+	switch {
+	case handlerErr == nil:
+		saga.CompletionPending = false
+		saga.CompletionError = ""
+		saga.NextAttemptAt = 0
+
+	case policy.MaxAttempts > 0 && saga.CompletionAttempts >= policy.MaxAttempts:
+		log.Errorf(ctx, "sagaManager", "Saga %s key %s completed handler failed %d times. Marking saga failed, %s", saga.SagaName, saga.SagaKey, saga.CompletionAttempts, handlerErr)
+
+		saga.CompletionPending = false
+		saga.CompletionError = handlerErr.Error()
+		saga.NextAttemptAt = 0
+		saga.Failed = true
+
+	default:
+		log.Printf(ctx, "sagaManager", "Saga %s key %s completed handler failed, attempt %d. Completion is pending..., %s", saga.SagaName, saga.SagaKey, saga.CompletionAttempts, handlerErr)
+
+		saga.CompletionError = handlerErr.Error()
+		saga.NextAttemptAt = time.Now().UTC().Add(policy.backoff(saga.CompletionAttempts)).UnixNano()
+	}
+}
+
+// findSkippedSaga
+// Returns the saga whose completion was skipped. No saga, and no error, if it was deleted meanwhile
+func (sagaManager *SagaManager) findSkippedSaga(ctx context.Context, sagaKey string) (saga Saga, err error) {
+
+	saga, err = sagaManager.sagaStore.GetSaga(ctx, sagaManager.SagaName, sagaKey)
+
+	if err == SagaNotFound {
+		return saga, nil
+	}
+
+	if err != nil {
+		return saga, fmt.Errorf("error finding saga %s key %s, %s", sagaManager.SagaName, sagaKey, err)
+	}
+
+	return saga, nil
+}
+
+// handleCompletedTx
+// Runs the transactional completed handler in a savepoint of the transaction storing the saga,
+// so its writes are rolled back when it fails and the attempt is still recorded.
+func (sagaManager *SagaManager) handleCompletedTx(ctx context.Context, tx db.AppSqlTx, saga Saga) (err error) {
+
+	if tx == nil {
+		return sagaManager.completedTxHandler(ctx, tx, saga)
+	}
+
+	_, err = tx.GetTx().Exec(`SAVEPOINT saga_completed_handler`)
+
+	if err != nil {
+		return err
+	}
+
+	err = sagaManager.completedTxHandler(ctx, tx, saga)
+
+	if err == nil {
+		_, err = tx.GetTx().Exec(`RELEASE SAVEPOINT saga_completed_handler`)
+		return err
+	}
+
+	_, rollbackErr := tx.GetTx().Exec(`ROLLBACK TO SAVEPOINT saga_completed_handler`)
+
+	if rollbackErr != nil {
+		log.Errorf(ctx, "sagaManager", "Error rolling back completed handler of saga %s key %s, %s", saga.SagaName, saga.SagaKey, rollbackErr)
+	}
+
+	return err
+}
+
+func (sagaManager *SagaManager) raiseCompletionFailed(ctx context.Context, saga Saga) {
+
+	policy := sagaManager.retryPolicy
+
+	if policy.AlertPubSub == nil {
+		return
+	}
+
+	data, err := json.Marshal(SagaCompletionFailed{
+		SagaName:  saga.SagaName,
+		SagaKey:   saga.SagaKey,
+		Attempts:  saga.CompletionAttempts,
+		LastError: saga.CompletionError,
+	})
+
+	if err != nil {
+		log.Errorf(ctx, "sagaManager", "Error raising completion failed alert for saga %s key %s, %s", saga.SagaName, saga.SagaKey, err)
+		return
+	}
+
+	alert := appevent.NewAppEvent(SagaCompletionFailedEventType, data)
+
+	event, err := alert.ToJSON()
+
+	if err == nil {
+		err = policy.AlertPubSub.PublishToTopic(ctx, policy.AlertTopic, event, "application/json")
+	}
+
+	if err != nil {
+		log.Errorf(ctx, "sagaManager", "Error raising completion failed alert for saga %s key %s, %s", saga.SagaName, saga.SagaKey, err)
+	}
+}
+
+// backoff
+// Returns the wait after the attempt failed
+func (policy CompletionRetryPolicy) backoff(attempts int) time.Duration {
+
+	maxBackoff := policy.MaxBackoff
+
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultCompletionRetryPolicy.MaxBackoff
+	}
+
+	return db.Backoff(attempts, policy.InitialBackoff, maxBackoff)
+}
@@ -0,0 +1,290 @@
+package appsaga
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/HelloSundayMorning/apputils/db"
+	"github.com/HelloSundayMorning/apputils/eventpubsub/testkit"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func newTestHistorySaga(eventTypes ...string) Saga {
+
+	saga := Saga{Events: make(map[string]appevent.AppEvent)}
+
+	for _, eventType := range eventTypes {
+
+		event := appevent.AppEvent{EventType: eventType}
+
+		saga.Events[eventType] = event
+		saga.History = append(saga.History, event)
+	}
+
+	return saga
+}
+
+func TestCompletionPredicates(t *testing.T) {
+
+	type testDef struct {
+		Predicate CompletionPredicate
+		Saga      Saga
+		Completed bool
+	}
+
+	Tests := []testDef{
+		{AllOf("a", "b"), newTestHistorySaga("a"), false},
+		{AllOf("a", "b"), newTestHistorySaga("b", "a"), true},
+		{AnyOf("a", "b"), newTestHistorySaga("c"), false},
+		{AnyOf("a", "b"), newTestHistorySaga("b"), true},
+		{Count("checkin", 3), newTestHistorySaga("checkin", "checkin"), false},
+		{Count("checkin", 3), newTestHistorySaga("checkin", "other", "checkin", "checkin"), true},
+		{InOrder("a", "b"), newTestHistorySaga("b", "a"), false},
+		{InOrder("a", "b"), newTestHistorySaga("a", "c", "b"), true},
+		{And(AnyOf("a"), Count("b", 2)), newTestHistorySaga("a", "b"), false},
+		{And(AnyOf("a"), Count("b", 2)), newTestHistorySaga("a", "b", "b"), true},
+		{Or(AllOf("a", "b"), AnyOf("c")), newTestHistorySaga("a"), false},
+		{Or(AllOf("a", "b"), AnyOf("c")), newTestHistorySaga("c"), true},
+	}
+
+	for idx, test := range Tests {
+
+		assert.Equalf(t, test.Completed, test.Predicate(test.Saga), "Failed test %d", idx)
+	}
+}
+
+func TestCompletionRetryPolicy_Backoff(t *testing.T) {
+
+	type testDef struct {
+		Policy   CompletionRetryPolicy
+		Attempts int
+		Min      time.Duration
+		Max      time.Duration
+	}
+
+	Tests := []testDef{
+		{CompletionRetryPolicy{InitialBackoff: time.Second, MaxBackoff: time.Minute}, 1, time.Second / 2, time.Second},
+		{CompletionRetryPolicy{InitialBackoff: time.Second, MaxBackoff: time.Minute}, 3, 2 * time.Second, 4 * time.Second},
+		{CompletionRetryPolicy{InitialBackoff: time.Second, MaxBackoff: time.Minute}, 100, time.Minute / 2, time.Minute},
+		{CompletionRetryPolicy{InitialBackoff: time.Second}, 100, DefaultCompletionRetryPolicy.MaxBackoff / 2, DefaultCompletionRetryPolicy.MaxBackoff},
+	}
+
+	for idx, test := range Tests {
+
+		backoff := test.Policy.backoff(test.Attempts)
+
+		assert.Truef(t, backoff >= test.Min && backoff <= test.Max, "Failed test %d, backoff %s", idx, backoff)
+	}
+}
+
+func TestSagaManager_RunCompletion(t *testing.T) {
+
+	type testDef struct {
+		Found      bool
+		Attempts   int
+		HandlerErr error
+		Pending    bool
+		Failed     bool
+		Alerts     int
+	}
+
+	Tests := []testDef{
+		{false, 0, nil, true, false, 0},
+		{true, 0, nil, false, false, 0},
+		{true, 0, errors.New("failed"), true, false, 0},
+		{true, 2, errors.New("failed"), false, true, 1},
+	}
+
+	for idx, test := range Tests {
+
+		mockDb, mock, err := db.NewMockDB()
+
+		assert.NoError(t, err)
+
+		recorder := testkit.NewRecorder("testApp")
+
+		var handled []Saga
+
+		manager := &SagaManager{
+			AppID:      "testApp",
+			sagaStore:  NewPostgresSagaStore(mockDb),
+			SagaName:   "testSaga",
+			EventTypes: []string{"a", "b"},
+			completedHandler: func(ctx context.Context, saga Saga) error {
+				handled = append(handled, saga)
+				return test.HandlerErr
+			},
+		}
+
+		manager.SetCompletionRetryPolicy(CompletionRetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: time.Second,
+			MaxBackoff:     time.Minute,
+			AlertPubSub:    recorder,
+			AlertTopic:     "alerts",
+		})
+
+		rows := sqlmock.NewRows(sagaRowColumns)
+
+		if test.Found {
+			rows.AddRow("testSaga", "key1", 1, []byte(`{"a":{"EventType":"a"},"b":{"EventType":"b"}}`), "{a,b}", true, 1, 0, false,
+				[]byte(`[{"EventType":"a"},{"EventType":"b"}]`), true, test.Attempts, "", 0, false, 1)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("FOR UPDATE SKIP LOCKED").WithArgs("testSaga", "key1").WillReturnRows(rows)
+
+		if test.Found {
+			// the attempt is claimed, then its result recorded after the handler ran
+			mock.ExpectExec("UPDATE saga_manager SET").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			mock.ExpectBegin()
+			mock.ExpectQuery("FOR UPDATE SKIP LOCKED").WithArgs("testSaga", "key1").WillReturnRows(sqlmock.NewRows(sagaRowColumns).
+				AddRow("testSaga", "key1", 1, []byte(`{"a":{"EventType":"a"},"b":{"EventType":"b"}}`), "{a,b}", true, 1, 0, false,
+					[]byte(`[{"EventType":"a"},{"EventType":"b"}]`), true, test.Attempts+1, "", time.Now().Add(completionLease).UnixNano(), false, 1))
+			mock.ExpectExec("UPDATE saga_manager SET").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+		} else {
+			// handled by other replica, the saga is returned as stored
+			mock.ExpectRollback()
+			mock.ExpectQuery("FROM saga_manager").WithArgs("testSaga", "key1").WillReturnRows(sqlmock.NewRows(sagaRowColumns).
+				AddRow("testSaga", "key1", 1, []byte(`{"a":{"EventType":"a"},"b":{"EventType":"b"}}`), "{a,b}", true, 1, 0, false,
+					[]byte(`[{"EventType":"a"},{"EventType":"b"}]`), true, 0, "", 0, false, 1))
+		}
+
+		ctx := appctx.NewContextFromValues("testApp", "correlationID")
+
+		saga, err := manager.runCompletion(ctx, "key1", false)
+
+		assert.Equalf(t, test.HandlerErr, err, "Failed test %d", idx)
+		assert.NoErrorf(t, mock.ExpectationsWereMet(), "Failed test %d", idx)
+		assert.Equalf(t, test.Pending, saga.CompletionPending, "Failed test %d", idx)
+		assert.Equalf(t, test.Failed, saga.Failed, "Failed test %d", idx)
+		assert.Lenf(t, recorder.PublishedOfType(SagaCompletionFailedEventType), test.Alerts, "Failed test %d", idx)
+
+		assert.Equalf(t, "key1", saga.SagaKey, "Failed test %d", idx)
+
+		if !test.Found {
+			assert.Emptyf(t, handled, "Failed test %d", idx)
+			continue
+		}
+
+		assert.Lenf(t, handled, 1, "Failed test %d", idx)
+		assert.Lenf(t, handled[0].History, 2, "Failed test %d", idx)
+		assert.Equalf(t, test.Attempts+1, saga.CompletionAttempts, "Failed test %d", idx)
+
+		if test.Pending {
+			assert.Equalf(t, test.HandlerErr.Error(), saga.CompletionError, "Failed test %d", idx)
+			assert.Truef(t, saga.NextAttemptAt > time.Now().UTC().UnixNano(), "Failed test %d", idx)
+		}
+	}
+}
+
+func TestSagaManager_RunCompletionClaimed(t *testing.T) {
+
+	calls := 0
+
+	var manager *SagaManager
+
+	// the first attempt runs without the saga locked, a second attempt is claimed while it runs
+	manager, err := NewSagaManagerWithStore("testApp", NewMemorySagaStore(), SagaDefinition{SagaName: "testSaga", EventTypes: []string{"a"}}, func(ctx context.Context, saga Saga) error {
+
+		calls++
+
+		if calls == 1 {
+			_, err := manager.runCompletion(ctx, saga.SagaKey, false)
+
+			assert.EqualError(t, err, "second attempt")
+
+			return errors.New("first attempt")
+		}
+
+		return errors.New("second attempt")
+	})
+
+	assert.NoError(t, err)
+
+	ctx := appctx.NewContextFromValues("testApp", "correlationID")
+
+	saga, err := manager.AddEvent(ctx, "key1", appevent.AppEvent{EventType: "a"})
+
+	assert.EqualError(t, err, "first attempt")
+	assert.Equal(t, 2, calls)
+
+	// the result of the first attempt doesn't overwrite the later attempt
+	assert.True(t, saga.CompletionPending)
+	assert.Equal(t, 2, saga.CompletionAttempts)
+	assert.Equal(t, "second attempt", saga.CompletionError)
+	assert.True(t, saga.NextAttemptAt < time.Now().UTC().Add(completionLease).UnixNano())
+}
+
+func TestSagaManager_RunCompletionTx(t *testing.T) {
+
+	type testDef struct {
+		HandlerErr error
+		Pending    bool
+	}
+
+	Tests := []testDef{
+		{nil, false},
+		{errors.New("failed"), true},
+	}
+
+	for idx, test := range Tests {
+
+		mockDb, mock, err := db.NewMockDB()
+
+		assert.NoError(t, err)
+
+		manager := &SagaManager{
+			AppID:      "testApp",
+			sagaStore:  NewPostgresSagaStore(mockDb),
+			SagaName:   "testSaga",
+			EventTypes: []string{"a", "b"},
+		}
+
+		manager.SetCompletionRetryPolicy(CompletionRetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: time.Minute})
+
+		manager.SetCompletedTxHandler(func(ctx context.Context, tx db.AppSqlTx, saga Saga) error {
+
+			_, err := tx.GetTx().Exec(`INSERT INTO user_plan (user_id) VALUES ($1)`, saga.SagaKey)
+
+			if err != nil {
+				return err
+			}
+
+			return test.HandlerErr
+		})
+
+		rows := sqlmock.NewRows(sagaRowColumns).
+			AddRow("testSaga", "key1", 1, []byte(`{"a":{"EventType":"a"},"b":{"EventType":"b"}}`), "{a,b}", true, 1, 0, false,
+				[]byte(`[{"EventType":"a"},{"EventType":"b"}]`), true, 0, "", 0, false, 1)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("FOR UPDATE SKIP LOCKED").WithArgs("testSaga", "key1").WillReturnRows(rows)
+		mock.ExpectExec("SAVEPOINT saga_completed_handler").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO user_plan").WithArgs("key1").WillReturnResult(sqlmock.NewResult(0, 1))
+
+		if test.HandlerErr == nil {
+			mock.ExpectExec("RELEASE SAVEPOINT saga_completed_handler").WillReturnResult(sqlmock.NewResult(0, 0))
+		} else {
+			mock.ExpectExec("ROLLBACK TO SAVEPOINT saga_completed_handler").WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+
+		mock.ExpectExec("UPDATE saga_manager SET").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		saga, err := manager.runCompletion(appctx.NewContextFromValues("testApp", "correlationID"), "key1", false)
+
+		assert.Equalf(t, test.HandlerErr, err, "Failed test %d", idx)
+		assert.NoErrorf(t, mock.ExpectationsWereMet(), "Failed test %d", idx)
+		assert.Equalf(t, test.Pending, saga.CompletionPending, "Failed test %d", idx)
+		assert.Equalf(t, 1, saga.CompletionAttempts, "Failed test %d", idx)
+	}
+}
@@ -0,0 +1,59 @@
+package appsaga
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/db"
+	"github.com/HelloSundayMorning/apputils/log"
+	"golang.org/x/net/context"
+)
+
+type (
+	// SagaUpdateRetryPolicy
+	// Retries of the saga updates that conflicted with a concurrent update of the same saga.
+	// - MaxAttempts: attempts before the conflict is returned
+	// - InitialBackoff: wait after the first conflict, doubled on each conflict up to MaxBackoff, see db.Backoff
+	SagaUpdateRetryPolicy struct {
+		MaxAttempts    int
+		InitialBackoff time.Duration
+		MaxBackoff     time.Duration
+	}
+)
+
+var (
+	SagaConflict = fmt.Errorf("saga updated concurrently, %w", db.ErrConflict)
+
+	DefaultSagaUpdateRetryPolicy = SagaUpdateRetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     500 * time.Millisecond,
+	}
+)
+
+// SetUpdateRetryPolicy
+// Sets the retry policy of the conflicting saga updates, DefaultSagaUpdateRetryPolicy if not set
+func (sagaManager *SagaManager) SetUpdateRetryPolicy(policy SagaUpdateRetryPolicy) {
+
+	sagaManager.updateRetryPolicy = policy
+}
+
+// updateSaga
+// Updates the saga in the store, retrying the update on conflicts. Other errors return immediately.
+func (sagaManager *SagaManager) updateSaga(ctx context.Context, sagaKey string, update SagaUpdate) (saga Saga, err error) {
+
+	policy := sagaManager.updateRetryPolicy
+
+	err = db.WithRetry(ctx, db.TxOptions{MaxAttempts: policy.MaxAttempts, InitialBackoff: policy.InitialBackoff, MaxBackoff: policy.MaxBackoff}, func() (err error) {
+
+		saga, err = sagaManager.sagaStore.UpdateSaga(ctx, sagaManager.SagaName, sagaKey, update)
+
+		if db.IsRetryableError(err) {
+			log.Printf(ctx, "sagaManager", "Saga %s key %s conflicted with concurrent update, %s", sagaManager.SagaName, sagaKey, err)
+		}
+
+		return err
+	})
+
+	return saga, err
+}
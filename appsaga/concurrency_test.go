@@ -0,0 +1,135 @@
+package appsaga
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/HelloSundayMorning/apputils/db"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+type failingSagaStore struct {
+	*MemorySagaStore
+	failures int
+	err      error
+	attempts int
+}
+
+func (store *failingSagaStore) UpdateSaga(ctx context.Context, sagaName, sagaKey string, update SagaUpdate) (saga Saga, err error) {
+
+	store.attempts++
+
+	if store.attempts <= store.failures {
+		return saga, store.err
+	}
+
+	return store.MemorySagaStore.UpdateSaga(ctx, sagaName, sagaKey, update)
+}
+
+func TestSagaManager_UpdateSagaRetry(t *testing.T) {
+
+	type testDef struct {
+		Err      error
+		Failures int
+		Attempts int
+		HasErr   bool
+	}
+
+	Tests := []testDef{
+		{SagaConflict, 2, 3, false},
+		{&pq.Error{Code: db.SerializationFailureCode}, 1, 2, false},
+		{&pq.Error{Code: db.DeadlockDetectedCode}, 1, 2, false},
+		{&pq.Error{Code: "23505"}, 1, 1, true},
+		{errors.New("connection refused"), 1, 1, true},
+		{SagaConflict, 5, 3, true},
+	}
+
+	for idx, test := range Tests {
+
+		store := &failingSagaStore{MemorySagaStore: NewMemorySagaStore(), failures: test.Failures, err: test.Err}
+
+		manager, err := NewSagaManagerWithStore("testApp", store, SagaDefinition{SagaName: "testSaga", EventTypes: []string{"a", "b"}}, func(ctx context.Context, saga Saga) error {
+			return nil
+		})
+
+		assert.NoError(t, err)
+
+		manager.SetUpdateRetryPolicy(SagaUpdateRetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond})
+
+		ctx := appctx.NewContextFromValues("testApp", "correlationID")
+
+		saga, err := manager.AddEvent(ctx, "key1", appevent.NewAppEvent("a", nil))
+
+		assert.Equalf(t, test.HasErr, err != nil, "Failed test %d", idx)
+		assert.Equalf(t, test.Attempts, store.attempts, "Failed test %d", idx)
+
+		if !test.HasErr {
+			assert.Equalf(t, int64(1), saga.Version, "Failed test %d", idx)
+		}
+	}
+}
+
+func TestPostgresSagaStore_UpdateSagaConflict(t *testing.T) {
+
+	type testDef struct {
+		Found    bool
+		Affected int64
+		Err      error
+	}
+
+	Tests := []testDef{
+		{false, 1, nil},
+		{false, 0, SagaConflict},
+		{true, 1, nil},
+		{true, 0, SagaConflict},
+	}
+
+	for idx, test := range Tests {
+
+		mockDb, mock, err := db.NewMockDB()
+
+		assert.NoError(t, err)
+
+		rows := sqlmock.NewRows(sagaRowColumns)
+
+		if test.Found {
+			rows.AddRow("testSaga", "key1", 1, []byte(`{"a":{"EventType":"a"}}`), "{a,b}", false, 1, 0, false,
+				[]byte(`[{"EventType":"a"}]`), false, 0, "", 0, false, 3)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("FROM saga_manager").WithArgs("testSaga", "key1").WillReturnRows(rows)
+
+		if test.Found {
+			mock.ExpectExec("UPDATE saga_manager SET").WithArgs("testSaga", "key1", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(),
+				sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), int64(3)).WillReturnResult(sqlmock.NewResult(0, test.Affected))
+		} else {
+			mock.ExpectExec("INSERT INTO saga_manager").WillReturnResult(sqlmock.NewResult(0, test.Affected))
+		}
+
+		if test.Err == nil {
+			mock.ExpectCommit()
+		} else {
+			mock.ExpectRollback()
+		}
+
+		saga, err := NewPostgresSagaStore(mockDb).UpdateSaga(context.Background(), "testSaga", "key1", func(saga *Saga) error {
+			saga.SagaName = "testSaga"
+			saga.SagaKey = "key1"
+			return nil
+		})
+
+		assert.Equalf(t, test.Err, err, "Failed test %d", idx)
+		assert.NoErrorf(t, mock.ExpectationsWereMet(), "Failed test %d", idx)
+
+		if test.Err == nil && test.Found {
+			assert.Equalf(t, int64(4), saga.Version, "Failed test %d", idx)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package appsaga
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"golang.org/x/net/context"
+)
+
+type (
+	// MemorySagaStore
+	// SagaStore in memory, to test saga handlers without a database. Updates of a saga wait for the
+	// update locking it, so they never conflict. As in Postgres, the sweepers skip the locked sagas.
+	MemorySagaStore struct {
+		mu       sync.Mutex
+		unlocked *sync.Cond
+		sagas    map[string]map[string]Saga // saga name -> saga key -> saga
+		locked   map[string]map[string]bool
+		archived map[string][]Saga
+	}
+)
+
+var (
+	_ SagaStore = &MemorySagaStore{}
+)
+
+// NewMemorySagaStore
+// Creates an empty saga store in memory
+func NewMemorySagaStore() *MemorySagaStore {
+
+	store := &MemorySagaStore{
+		sagas:    make(map[string]map[string]Saga),
+		locked:   make(map[string]map[string]bool),
+		archived: make(map[string][]Saga),
+	}
+
+	store.unlocked = sync.NewCond(&store.mu)
+
+	return store
+}
+
+func (store *MemorySagaStore) Initialize(ctx context.Context) (err error) {
+
+	return nil
+}
+
+func (store *MemorySagaStore) UpdateSaga(ctx context.Context, sagaName, sagaKey string, update SagaUpdate) (saga Saga, err error) {
+
+	store.mu.Lock()
+
+	for store.locked[sagaName][sagaKey] {
+		store.unlocked.Wait()
+	}
+
+	saga, ok := store.sagas[sagaName][sagaKey]
+
+	if !ok {
+		saga = Saga{Events: make(map[string]appevent.AppEvent)}
+	}
+
+	store.lock(sagaName, sagaKey)
+
+	store.mu.Unlock()
+
+	return store.updateAndUnlock(sagaName, sagaKey, copySaga(saga), update)
+}
+
+func (store *MemorySagaStore) UpdatePendingSaga(ctx context.Context, sagaName, sagaKey string, update SagaTxUpdate) (saga Saga, err error) {
+
+	store.mu.Lock()
+
+	saga, ok := store.sagas[sagaName][sagaKey]
+
+	if !ok || !saga.CompletionPending || store.locked[sagaName][sagaKey] {
+		store.mu.Unlock()
+		return Saga{}, SagaNotFound
+	}
+
+	store.lock(sagaName, sagaKey)
+
+	store.mu.Unlock()
+
+	return store.updateAndUnlock(sagaName, sagaKey, copySaga(saga), func(saga *Saga) error {
+		return update(nil, saga)
+	})
+}
+
+func (store *MemorySagaStore) UpdateNextExpiredSaga(ctx context.Context, sagaName string, now int64, skipKeys []string, update SagaUpdate) (saga Saga, err error) {
+
+	store.mu.Lock()
+
+	found := false
+
+	for sagaKey, candidate := range store.sagas[sagaName] {
+
+		if candidate.Completed || candidate.Expired || candidate.ExpiresAt == 0 || candidate.ExpiresAt > now || store.locked[sagaName][sagaKey] || containsString(skipKeys, sagaKey) {
+			continue
+		}
+
+		if !found || candidate.ExpiresAt < saga.ExpiresAt {
+			saga = candidate
+			found = true
+		}
+	}
+
+	if !found {
+		store.mu.Unlock()
+		return Saga{}, SagaNotFound
+	}
+
+	store.lock(sagaName, saga.SagaKey)
+
+	store.mu.Unlock()
+
+	return store.updateAndUnlock(sagaName, saga.SagaKey, copySaga(saga), update)
+}
+
+func (store *MemorySagaStore) FindDuePendingSagaKeys(ctx context.Context, sagaName string, now int64) (sagaKeys []string, err error) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var due []Saga
+
+	for _, saga := range store.sagas[sagaName] {
+
+		if saga.CompletionPending && saga.NextAttemptAt <= now {
+			due = append(due, saga)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextAttemptAt < due[j].NextAttemptAt
+	})
+
+	for _, saga := range due {
+		sagaKeys = append(sagaKeys, saga.SagaKey)
+	}
+
+	return sagaKeys, nil
+}
+
+func (store *MemorySagaStore) GetSaga(ctx context.Context, sagaName, sagaKey string) (saga Saga, err error) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	saga, ok := store.sagas[sagaName][sagaKey]
+
+	if !ok {
+		return Saga{}, SagaNotFound
+	}
+
+	return copySaga(saga), nil
+}
+
+func (store *MemorySagaStore) ListSagas(ctx context.Context, sagaName string, query SagaQuery) (sagas []Saga, err error) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now().UTC()
+
+	sagas = []Saga{}
+
+	for _, saga := range store.sagas[sagaName] {
+
+		if query.State != "" && !query.State.matches(saga) {
+			continue
+		}
+
+		if query.MinAge > 0 && saga.StartedAt > now.Add(-query.MinAge).UnixNano() {
+			continue
+		}
+
+		if query.MaxAge > 0 && saga.StartedAt < now.Add(-query.MaxAge).UnixNano() {
+			continue
+		}
+
+		sagas = append(sagas, copySaga(saga))
+	}
+
+	sort.Slice(sagas, func(i, j int) bool {
+
+		if sagas[i].StartedAt == sagas[j].StartedAt {
+			return sagas[i].SagaKey < sagas[j].SagaKey
+		}
+
+		return sagas[i].StartedAt < sagas[j].StartedAt
+	})
+
+	if query.Offset >= len(sagas) {
+		return []Saga{}, nil
+	}
+
+	if query.Offset > 0 {
+		sagas = sagas[query.Offset:]
+	}
+
+	if query.Limit > 0 && query.Limit < len(sagas) {
+		sagas = sagas[:query.Limit]
+	}
+
+	return sagas, nil
+}
+
+func (store *MemorySagaStore) DeleteSaga(ctx context.Context, sagaName, sagaKey string) (err error) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for store.locked[sagaName][sagaKey] {
+		store.unlocked.Wait()
+	}
+
+	if _, ok := store.sagas[sagaName][sagaKey]; !ok {
+		return SagaNotFound
+	}
+
+	delete(store.sagas[sagaName], sagaKey)
+
+	return nil
+}
+
+func (store *MemorySagaStore) PurgeSagas(ctx context.Context, sagaName string, states []SagaState, before int64, archive bool, limit int) (purged int, err error) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var expired []Saga
+
+	for sagaKey, saga := range store.sagas[sagaName] {
+
+		if saga.Timestamp > before || store.locked[sagaName][sagaKey] || !anyStateMatches(states, saga) {
+			continue
+		}
+
+		expired = append(expired, saga)
+	}
+
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].Timestamp < expired[j].Timestamp
+	})
+
+	if limit > 0 && limit < len(expired) {
+		expired = expired[:limit]
+	}
+
+	for _, saga := range expired {
+
+		delete(store.sagas[sagaName], saga.SagaKey)
+
+		if archive {
+			store.archived[sagaName] = append(store.archived[sagaName], saga)
+		}
+	}
+
+	return len(expired), nil
+}
+
+// ArchivedSagas
+// Returns the sagas archived by PurgeSagas, in the order they were archived
+func (store *MemorySagaStore) ArchivedSagas(sagaName string) (sagas []Saga) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, saga := range store.archived[sagaName] {
+		sagas = append(sagas, copySaga(saga))
+	}
+
+	return sagas
+}
+
+// lock
+// Marks the saga locked. Must be called holding the store mutex
+func (store *MemorySagaStore) lock(sagaName, sagaKey string) {
+
+	if store.locked[sagaName] == nil {
+		store.locked[sagaName] = make(map[string]bool)
+	}
+
+	store.locked[sagaName][sagaKey] = true
+}
+
+// updateAndUnlock
+// Applies the update to the locked saga outside the store mutex, so the update can use the store,
+// stores the saga if the update succeeds and unlocks it
+func (store *MemorySagaStore) updateAndUnlock(sagaName, sagaKey string, saga Saga, update SagaUpdate) (Saga, error) {
+
+	err := update(&saga)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.locked[sagaName], sagaKey)
+	store.unlocked.Broadcast()
+
+	if err != nil {
+		return saga, err
+	}
+
+	if store.sagas[sagaName] == nil {
+		store.sagas[sagaName] = make(map[string]Saga)
+	}
+
+	saga.Version++
+
+	store.sagas[sagaName][sagaKey] = copySaga(saga)
+
+	return saga, nil
+}
@@ -0,0 +1,188 @@
+package appsaga
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestMemorySagaStore_AddEvent(t *testing.T) {
+
+	type testDef struct {
+		Completion CompletionPredicate
+		Events     []string
+		Completed  bool
+		Handled    int
+	}
+
+	Tests := []testDef{
+		{nil, []string{"a"}, false, 0},
+		{nil, []string{"a", "b"}, true, 1},
+		{nil, []string{"a", "b", "a"}, true, 1},
+		{Count("a", 3), []string{"a", "b", "a"}, false, 0},
+		{Count("a", 3), []string{"a", "a", "a"}, true, 1},
+		{InOrder("b", "a"), []string{"a", "b"}, false, 0},
+		{InOrder("b", "a"), []string{"a", "b", "a"}, true, 1},
+	}
+
+	for idx, test := range Tests {
+
+		var handled []Saga
+
+		manager, err := NewSagaManagerWithStore("testApp", NewMemorySagaStore(), SagaDefinition{SagaName: "testSaga", EventTypes: []string{"a", "b"}, Completion: test.Completion}, func(ctx context.Context, saga Saga) error {
+			handled = append(handled, saga)
+			return nil
+		})
+
+		assert.NoError(t, err)
+
+		ctx := appctx.NewContextFromValues("testApp", "correlationID")
+
+		var saga Saga
+
+		for _, eventType := range test.Events {
+
+			saga, err = manager.AddEvent(ctx, "key1", appevent.NewAppEvent(eventType, nil))
+
+			assert.NoErrorf(t, err, "Failed test %d", idx)
+		}
+
+		assert.Equalf(t, test.Completed, saga.Completed, "Failed test %d", idx)
+		assert.Lenf(t, handled, test.Handled, "Failed test %d", idx)
+
+		stored, err := manager.GetSaga(ctx, "key1")
+
+		assert.NoErrorf(t, err, "Failed test %d", idx)
+		assert.Falsef(t, stored.CompletionPending, "Failed test %d", idx)
+	}
+}
+
+func TestMemorySagaStore_ConcurrentAddEvent(t *testing.T) {
+
+	var mu sync.Mutex
+
+	handled := 0
+
+	manager, err := NewSagaManagerWithStore("testApp", NewMemorySagaStore(), SagaDefinition{SagaName: "testSaga", EventTypes: []string{"checkin"}, Completion: Count("checkin", 5)}, func(ctx context.Context, saga Saga) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		handled++
+
+		return nil
+	})
+
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			ctx := appctx.NewContextFromValues("testApp", "correlationID")
+
+			_, err := manager.AddEvent(ctx, "key1", appevent.NewAppEvent("checkin", nil))
+
+			assert.NoError(t, err)
+		}()
+	}
+
+	wg.Wait()
+
+	saga, err := manager.GetSaga(context.Background(), "key1")
+
+	assert.NoError(t, err)
+	assert.Len(t, saga.History, 5)
+	assert.True(t, saga.Completed)
+	assert.Equal(t, 1, handled)
+}
+
+func TestMemorySagaStore_CompletionRetryAndExpiry(t *testing.T) {
+
+	handlerErr := errors.New("failed")
+
+	var timedOut []Saga
+
+	manager, err := NewSagaManagerWithStore("testApp", NewMemorySagaStore(), SagaDefinition{SagaName: "testSaga", EventTypes: []string{"a", "b"}}, func(ctx context.Context, saga Saga) error {
+		return handlerErr
+	})
+
+	assert.NoError(t, err)
+
+	manager.SetCompletionRetryPolicy(CompletionRetryPolicy{MaxAttempts: 2, InitialBackoff: time.Minute})
+
+	manager.SetTimeout(100*time.Millisecond, func(ctx context.Context, saga Saga) error {
+		timedOut = append(timedOut, saga)
+		return nil
+	})
+
+	ctx := appctx.NewContextFromValues("testApp", "correlationID")
+
+	_, err = manager.AddEvent(ctx, "completed", appevent.NewAppEvent("a", nil))
+	assert.NoError(t, err)
+
+	_, err = manager.AddEvent(ctx, "completed", appevent.NewAppEvent("b", nil))
+	assert.Equal(t, handlerErr, err)
+
+	_, err = manager.AddEvent(ctx, "partial", appevent.NewAppEvent("a", nil))
+	assert.NoError(t, err)
+
+	pending, err := manager.ListSagas(ctx, SagaQuery{State: SagaStateCompletionPending})
+
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+
+	all, err := manager.ListSagas(ctx, SagaQuery{Offset: -1})
+
+	assert.NoError(t, err)
+	assert.Len(t, all, 2)
+
+	time.Sleep(110 * time.Millisecond)
+
+	// the backoff is not due yet, the retrier skips the saga
+	manager.retryPending()
+
+	saga, err := manager.GetSaga(ctx, "completed")
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, saga.CompletionAttempts)
+
+	_, err = manager.runCompletion(ctx, "completed", false)
+	assert.Equal(t, handlerErr, err)
+
+	failed, err := manager.ListSagas(ctx, SagaQuery{State: SagaStateFailed})
+
+	assert.NoError(t, err)
+	assert.Len(t, failed, 1)
+	assert.Equal(t, 2, failed[0].CompletionAttempts)
+
+	manager.sweepExpired()
+
+	assert.Len(t, timedOut, 1)
+	assert.Equal(t, "partial", timedOut[0].SagaKey)
+
+	expired, err := manager.ListSagas(ctx, SagaQuery{State: SagaStateExpired})
+
+	assert.NoError(t, err)
+	assert.Len(t, expired, 1)
+
+	handlerErr = nil
+
+	saga, err = manager.ForceComplete(ctx, "completed")
+
+	assert.NoError(t, err)
+	assert.False(t, saga.Failed)
+
+	assert.NoError(t, manager.DeleteSaga(ctx, "partial"))
+	assert.Equal(t, SagaNotFound, manager.DeleteSaga(ctx, "partial"))
+}
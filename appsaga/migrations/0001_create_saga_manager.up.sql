@@ -0,0 +1,23 @@
+-- adopts the saga_manager table created before the schema was versioned, in any of its previous versions.
+-- New tables store the events as jsonb, existing tables are converted by PostgresSagaStore.Upgrade.
+-- The indexes are built concurrently by Upgrade, building them here would block the writes to existing tables
+CREATE TABLE IF NOT EXISTS saga_manager (
+    saga_name                  varchar(50)               not null,
+    saga_key                   varchar(500)              not null,
+    timestamp                  bigint                    not null,
+    events                     jsonb default '{}' :: jsonb not null,
+    event_types                text []                   not null,
+    completed                  boolean                   not null,
+    PRIMARY KEY (saga_name, saga_key));
+
+ALTER TABLE saga_manager
+    ADD COLUMN IF NOT EXISTS started_at bigint default 0 not null,
+    ADD COLUMN IF NOT EXISTS expires_at bigint default 0 not null,
+    ADD COLUMN IF NOT EXISTS expired boolean default false not null,
+    ADD COLUMN IF NOT EXISTS history jsonb default '[]' :: jsonb not null,
+    ADD COLUMN IF NOT EXISTS completion_pending boolean default false not null,
+    ADD COLUMN IF NOT EXISTS completion_attempts int default 0 not null,
+    ADD COLUMN IF NOT EXISTS completion_error text default '' not null,
+    ADD COLUMN IF NOT EXISTS next_attempt_at bigint default 0 not null,
+    ADD COLUMN IF NOT EXISTS failed boolean default false not null,
+    ADD COLUMN IF NOT EXISTS version bigint default 0 not null;
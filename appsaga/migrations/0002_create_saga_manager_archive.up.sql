@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS saga_manager_archive (
+    saga_name                  varchar(50)               not null,
+    saga_key                   varchar(500)              not null,
+    timestamp                  bigint                    not null,
+    events                     jsonb                     not null,
+    event_types                text []                   not null,
+    completed                  boolean                   not null,
+    started_at                 bigint                    not null,
+    expires_at                 bigint                    not null,
+    expired                    boolean                   not null,
+    history                    jsonb                     not null,
+    completion_pending         boolean                   not null,
+    completion_attempts        int                       not null,
+    completion_error           text                      not null,
+    next_attempt_at            bigint                    not null,
+    failed                     boolean                   not null,
+    version                    bigint                    not null,
+    archived_at                bigint                    not null);
+
+CREATE INDEX IF NOT EXISTS saga_manager_archive_key_idx ON saga_manager_archive (saga_name, saga_key);
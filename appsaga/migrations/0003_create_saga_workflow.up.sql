@@ -0,0 +1,23 @@
+-- workflows of the saga orchestrator
+CREATE TABLE IF NOT EXISTS saga_workflow (
+    workflow_name              varchar(50)                 not null,
+    workflow_key               varchar(500)                not null,
+    data                       jsonb                       not null,
+    status                     varchar(20)                 not null,
+    current_step               int                         not null,
+    events                     jsonb default '{}' :: jsonb not null,
+    failed_step                varchar(255) default ''     not null,
+    failure_reason             text default ''             not null,
+    step_deadline              bigint default 0            not null,
+    started_at                 bigint                      not null,
+    timestamp                  bigint                      not null,
+    pending_commands           jsonb default '[]' :: jsonb not null,
+    publish_at                 bigint default 0            not null,
+    PRIMARY KEY (workflow_name, workflow_key));
+
+CREATE INDEX IF NOT EXISTS saga_workflow_step_deadline_idx ON saga_workflow (workflow_name, step_deadline)
+    WHERE status = 'running' AND step_deadline > 0;
+
+-- workflows with commands to publish again
+CREATE INDEX IF NOT EXISTS saga_workflow_publish_at_idx ON saga_workflow (workflow_name, publish_at)
+    WHERE publish_at > 0;
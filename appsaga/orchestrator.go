@@ -0,0 +1,835 @@
+package appsaga
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/app"
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/HelloSundayMorning/apputils/db"
+	"github.com/HelloSundayMorning/apputils/eventpubsub"
+	"github.com/HelloSundayMorning/apputils/log"
+	"github.com/HelloSundayMorning/apputils/tracing"
+	"github.com/gofrs/uuid"
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+)
+
+var (
+	WorkflowStartedPreviously = fmt.Errorf("workflow started previously, cannot be started again")
+	WorkflowNotFound          = fmt.Errorf("workflow not found")
+)
+
+type (
+	// WorkflowStatus
+	// - WorkflowRunning: waiting for the result event of the current step
+	// - WorkflowCompleted: all steps succeeded
+	// - WorkflowFailed: a step failed or timed out, and the completed steps were compensated
+	WorkflowStatus string
+
+	// Workflow
+	// State of an orchestrated saga. Events holds the result events by step name.
+	Workflow struct {
+		WorkflowName  string
+		WorkflowKey   string
+		Data          json.RawMessage
+		Status        WorkflowStatus
+		CurrentStep   int
+		Events        map[string]appevent.AppEvent
+		FailedStep    string
+		FailureReason string
+		StepDeadline  int64 // current step deadline, unix nano. 0 if the step has no timeout
+		StartedAt     int64
+		Timestamp     int64
+
+		pendingCommands []workflowCommand // stored with the workflow until published
+		publishAt       int64             // when the pending commands are published again. 0 if none
+	}
+
+	// WorkflowCommand
+	// Returns the command event of a step, or of its compensation, for the workflow
+	WorkflowCommand func(ctx context.Context, workflow Workflow) (command appevent.AppEvent, err error)
+
+	// WorkflowHandler
+	// Called when a workflow completes or fails
+	WorkflowHandler func(ctx context.Context, workflow Workflow) (err error)
+
+	// WorkflowStep
+	// A step publishes its command to the topic and waits for the success or failure event.
+	// - Compensation: command undoing the step when a later step fails. nil if there's nothing to undo
+	// - Timeout: max wait for the result event. 0 waits forever
+	WorkflowStep struct {
+		Name             string
+		Topic            string
+		Command          WorkflowCommand
+		SuccessEventType string
+		FailureEventType string
+		Compensation     WorkflowCommand
+		Timeout          time.Duration
+	}
+
+	// Orchestrator
+	// Runs the steps of a workflow in order. When a step fails or times out, the compensation
+	// commands of the completed steps are published in reverse order.
+	// The result events of the steps must be passed to HandleEvent with the workflow key.
+	// The commands are stored with the workflow and published once it's stored, so a workflow that
+	// fails to be stored publishes nothing. Commands failing to publish stay pending, and are published
+	// again by the timeout sweeper or when the event is redelivered. A command can be published twice.
+	Orchestrator struct {
+		AppID            app.ApplicationID
+		sqlDb            db.AppSqlDb
+		pubSub           eventpubsub.EventPubSub
+		WorkflowName     string
+		Steps            []WorkflowStep
+		completedHandler WorkflowHandler
+		failedHandler    WorkflowHandler
+		sweeperChan      chan bool
+	}
+
+	// workflowCommand
+	// Command event to publish to the topic once the workflow is stored
+	workflowCommand struct {
+		ID      string
+		Topic   string
+		Segment string
+		Event   appevent.AppEvent
+	}
+)
+
+const (
+	WorkflowRunning   = WorkflowStatus("running")
+	WorkflowCompleted = WorkflowStatus("completed")
+	WorkflowFailed    = WorkflowStatus("failed")
+
+	// lease of the pending commands being published. Past it they are published again
+	commandPublishLease = 30 * time.Second
+
+	insertWorkflow = `INSERT INTO saga_workflow (workflow_name, workflow_key, data, status, current_step, events, failed_step, failure_reason, step_deadline, started_at, timestamp,
+                                pending_commands, publish_at)
+                                VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+                                ON CONFLICT (workflow_name, workflow_key) DO UPDATE SET
+                                status = $4,
+                                current_step = $5,
+                                events = $6,
+                                failed_step = $7,
+                                failure_reason = $8,
+                                step_deadline = $9,
+                                timestamp = $11,
+                                pending_commands = $12,
+                                publish_at = $13`
+
+	workflowColumns = `workflow_name, workflow_key, data, status, current_step, events, failed_step, failure_reason, step_deadline, started_at, timestamp,
+                    pending_commands, publish_at`
+
+	findWorkflow = `SELECT ` + workflowColumns + `
+                    FROM saga_workflow
+                    WHERE workflow_name = $1 AND workflow_key = $2`
+
+	// locks one running workflow past its step deadline, skipping the ones locked by the sweeper of other replicas
+	// and the skipped keys
+	lockTimedOutWorkflow = `SELECT ` + workflowColumns + `
+                    FROM saga_workflow
+                    WHERE workflow_name = $1 AND status = 'running' AND step_deadline > 0 AND step_deadline <= $2
+                    AND NOT (workflow_key = ANY($3))
+                    ORDER BY step_deadline
+                    LIMIT 1
+                    FOR UPDATE SKIP LOCKED`
+
+	findDuePendingWorkflows = `SELECT workflow_key
+                    FROM saga_workflow
+                    WHERE workflow_name = $1 AND publish_at > 0 AND publish_at <= $2
+                    ORDER BY publish_at
+                    LIMIT 100`
+)
+
+// NewOrchestrator
+// Creates the orchestrator of the workflow steps, publishing the commands with pubSub.
+// The app must be registered to the topics of the steps.
+func NewOrchestrator(appID app.ApplicationID, sqlDb db.AppSqlDb, pubSub eventpubsub.EventPubSub, workflowName string, steps []WorkflowStep) (orchestrator *Orchestrator, err error) {
+
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("workflow %s has no steps", workflowName)
+	}
+
+	stepNames := make(map[string]bool)
+
+	for _, step := range steps {
+
+		if step.Name == "" || step.Command == nil || step.SuccessEventType == "" {
+			return nil, fmt.Errorf("workflow %s step %s needs a name, command and success event type", workflowName, step.Name)
+		}
+
+		if stepNames[step.Name] {
+			return nil, fmt.Errorf("workflow %s has duplicated step %s", workflowName, step.Name)
+		}
+
+		stepNames[step.Name] = true
+	}
+
+	orchestrator = &Orchestrator{
+		AppID:        appID,
+		sqlDb:        sqlDb,
+		pubSub:       pubSub,
+		WorkflowName: workflowName,
+		Steps:        steps,
+	}
+
+	// saga_workflow is versioned with the saga tables
+	err = db.MigrateSchema(context.Background(), sqlDb, sagaMigrations, "migrations", sagaMigrationsTable)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.PrintfNoContext(appID, "sagaOrchestrator", "Orchestrator %s for %d steps", workflowName, len(steps))
+
+	return orchestrator, nil
+}
+
+// SetCompletedHandler
+// Sets the handler called when all the steps of a workflow succeed
+func (orchestrator *Orchestrator) SetCompletedHandler(handler WorkflowHandler) {
+
+	orchestrator.completedHandler = handler
+}
+
+// SetFailedHandler
+// Sets the handler called after a workflow failed and its compensations were stored to publish
+func (orchestrator *Orchestrator) SetFailedHandler(handler WorkflowHandler) {
+
+	orchestrator.failedHandler = handler
+}
+
+// EventTypes
+// Returns the success and failure event types of all the steps, to subscribe to
+func (orchestrator *Orchestrator) EventTypes() (eventTypes []string) {
+
+	for _, step := range orchestrator.Steps {
+
+		eventTypes = append(eventTypes, step.SuccessEventType)
+
+		if step.FailureEventType != "" {
+			eventTypes = append(eventTypes, step.FailureEventType)
+		}
+	}
+
+	return eventTypes
+}
+
+// Start
+// Creates the workflow with its input data and publishes the command of the first step
+func (orchestrator *Orchestrator) Start(ctx context.Context, workflowKey string, data json.RawMessage) (workflow Workflow, err error) {
+
+	err = orchestrator.withTx(ctx, func(tx *sql.Tx) (err error) {
+
+		workflow, err = orchestrator.findWorkflowByKey(tx, workflowKey)
+
+		if err != nil && err != WorkflowNotFound {
+			return err
+		}
+
+		if err == nil {
+			return WorkflowStartedPreviously
+		}
+
+		now := time.Now().UTC().UnixNano()
+
+		if len(data) == 0 {
+			data = json.RawMessage("null")
+		}
+
+		workflow = Workflow{
+			WorkflowName: orchestrator.WorkflowName,
+			WorkflowKey:  workflowKey,
+			Data:         data,
+			Status:       WorkflowRunning,
+			Events:       make(map[string]appevent.AppEvent),
+			StartedAt:    now,
+			Timestamp:    now,
+		}
+
+		command, err := orchestrator.executeStep(ctx, &workflow)
+
+		if err != nil {
+			return err
+		}
+
+		leasePendingCommands(&workflow, []workflowCommand{command})
+
+		return orchestrator.store(tx, &workflow)
+	})
+
+	if err != nil {
+		return workflow, err
+	}
+
+	log.Printf(ctx, "sagaOrchestrator", "Workflow %s key %s started", workflow.WorkflowName, workflow.WorkflowKey)
+
+	return workflow, orchestrator.publishPendingCommands(ctx, workflow)
+}
+
+// HandleEvent
+// Handles the result event of the current step: on success the next step command is published,
+// on failure the completed steps are compensated. Events of other steps, or for workflows
+// not running anymore, are ignored, publishing the commands of the workflow that failed to publish.
+// Returns the publish error once the workflow is stored, so the event is redelivered.
+func (orchestrator *Orchestrator) HandleEvent(ctx context.Context, workflowKey string, appEvent appevent.AppEvent) (workflow Workflow, err error) {
+
+	var previousStatus WorkflowStatus
+	var publish bool
+
+	err = orchestrator.withTx(ctx, func(tx *sql.Tx) (err error) {
+
+		workflow, err = orchestrator.findWorkflowByKey(tx, workflowKey)
+
+		if err != nil {
+			return err
+		}
+
+		previousStatus = workflow.Status
+
+		if workflow.Status != WorkflowRunning {
+			log.Printf(ctx, "sagaOrchestrator", "Workflow %s key %s is %s. Ignoring event type %s.", workflow.WorkflowName, workflowKey, workflow.Status, appEvent.EventType)
+			return orchestrator.leaseDueCommands(tx, &workflow, &publish)
+		}
+
+		var commands []workflowCommand
+
+		step := orchestrator.Steps[workflow.CurrentStep]
+
+		workflow.Timestamp = time.Now().UTC().UnixNano()
+
+		switch appEvent.EventType {
+		case step.SuccessEventType:
+
+			workflow.Events[step.Name] = appEvent
+			workflow.CurrentStep++
+
+			if workflow.CurrentStep == len(orchestrator.Steps) {
+				workflow.Status = WorkflowCompleted
+				workflow.StepDeadline = 0
+				break
+			}
+
+			var command workflowCommand
+
+			command, err = orchestrator.executeStep(ctx, &workflow)
+			commands = []workflowCommand{command}
+
+		case step.FailureEventType:
+
+			workflow.Events[step.Name] = appEvent
+
+			commands, err = orchestrator.compensate(ctx, &workflow, fmt.Sprintf("step %s failed with event %s", step.Name, appEvent.EventType))
+
+		default:
+			log.Printf(ctx, "sagaOrchestrator", "Workflow %s key %s is waiting for step %s. Ignoring event type %s.", workflow.WorkflowName, workflowKey, step.Name, appEvent.EventType)
+			return orchestrator.leaseDueCommands(tx, &workflow, &publish)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		publish = leasePendingCommands(&workflow, commands)
+
+		return orchestrator.store(tx, &workflow)
+	})
+
+	if err != nil {
+		return workflow, err
+	}
+
+	if publish {
+		err = orchestrator.publishPendingCommands(ctx, workflow)
+	}
+
+	// the handler runs once, when the workflow finishes, even if its compensations are published later
+	if previousStatus == WorkflowRunning {
+
+		handlerErr := orchestrator.handleFinished(ctx, workflow)
+
+		if err == nil {
+			err = handlerErr
+		}
+	}
+
+	return workflow, err
+}
+
+// StartTimeoutSweeper
+// Periodically fails the workflows waiting past their step timeout and compensates them, and publishes
+// the commands that failed to publish. Each workflow is locked while handled, so sweepers on several
+// replicas don't handle it twice.
+func (orchestrator *Orchestrator) StartTimeoutSweeper(interval time.Duration) (err error) {
+
+	if orchestrator.sweeperChan != nil {
+		return fmt.Errorf("timeout sweeper already started for workflow %s", orchestrator.WorkflowName)
+	}
+
+	sweeperChan := make(chan bool)
+	orchestrator.sweeperChan = sweeperChan
+
+	go func() {
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				orchestrator.sweepTimedOut()
+				orchestrator.publishDueCommands()
+			case <-sweeperChan:
+				return
+			}
+		}
+	}()
+
+	log.PrintfNoContext(orchestrator.AppID, "sagaOrchestrator", "Workflow %s timeout sweeper started. Interval %s", orchestrator.WorkflowName, interval)
+
+	return nil
+}
+
+// StopTimeoutSweeper
+// Stops the timeout sweeper, if started
+func (orchestrator *Orchestrator) StopTimeoutSweeper() {
+
+	if orchestrator.sweeperChan != nil {
+		close(orchestrator.sweeperChan)
+		orchestrator.sweeperChan = nil
+	}
+}
+
+// sweepTimedOut
+// Compensates the timed out workflows until there are none left. The workflows failing, ie. a compensation
+// can't be built, are skipped until the next sweep
+func (orchestrator *Orchestrator) sweepTimedOut() {
+
+	var failedKeys []string
+
+	for {
+
+		timedOut, workflowKey, err := orchestrator.timeOutNext(failedKeys)
+
+		if err != nil && workflowKey == "" {
+			log.ErrorfNoContext(orchestrator.AppID, "sagaOrchestrator", "Error sweeping timed out workflows %s, %s", orchestrator.WorkflowName, err)
+			return
+		}
+
+		if err != nil {
+			log.ErrorfNoContext(orchestrator.AppID, "sagaOrchestrator", "Error sweeping timed out workflow %s key %s. Retrying on the next sweep, %s", orchestrator.WorkflowName, workflowKey, err)
+			failedKeys = append(failedKeys, workflowKey)
+			continue
+		}
+
+		if !timedOut {
+			return
+		}
+	}
+}
+
+// timeOutNext
+// Locks the next workflow past its step deadline, not skipped, and compensates it.
+// Returns the key of the workflow handled, empty if the error happened before
+func (orchestrator *Orchestrator) timeOutNext(skipKeys []string) (timedOut bool, workflowKey string, err error) {
+
+	tx, err := orchestrator.sqlDb.GetDB().Begin()
+
+	if err != nil {
+		return false, "", err
+	}
+
+	workflow, err := scanWorkflow(tx.QueryRow(lockTimedOutWorkflow, orchestrator.WorkflowName, time.Now().UTC().UnixNano(), pq.Array(skipKeys)))
+
+	if err == WorkflowNotFound {
+		tx.Rollback()
+		return false, "", nil
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return false, "", err
+	}
+
+	correlationID, _ := uuid.NewV4()
+
+	ctx := appctx.NewContextFromValues(orchestrator.AppID, correlationID.String())
+
+	step := orchestrator.Steps[workflow.CurrentStep]
+
+	workflow.Timestamp = time.Now().UTC().UnixNano()
+
+	commands, err := orchestrator.compensate(ctx, &workflow, fmt.Sprintf("step %s timed out", step.Name))
+
+	if err == nil {
+		leasePendingCommands(&workflow, commands)
+		err = orchestrator.store(tx, &workflow)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return false, workflow.WorkflowKey, err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return false, workflow.WorkflowKey, err
+	}
+
+	// compensations failing to publish stay pending, the workflow is done
+	err = orchestrator.publishPendingCommands(ctx, workflow)
+
+	if err != nil {
+		log.Errorf(ctx, "sagaOrchestrator", "Workflow %s key %s. Compensations pending, %s", workflow.WorkflowName, workflow.WorkflowKey, err)
+	}
+
+	return true, workflow.WorkflowKey, orchestrator.handleFinished(ctx, workflow)
+}
+
+// executeStep
+// Returns the command of the current step, to publish once the workflow is stored, and sets its deadline
+func (orchestrator *Orchestrator) executeStep(ctx context.Context, workflow *Workflow) (command workflowCommand, err error) {
+
+	step := orchestrator.Steps[workflow.CurrentStep]
+
+	event, err := step.Command(ctx, *workflow)
+
+	if err != nil {
+		return command, fmt.Errorf("error executing workflow %s step %s, %s", orchestrator.WorkflowName, step.Name, err)
+	}
+
+	workflow.StepDeadline = 0
+
+	if step.Timeout > 0 {
+		workflow.StepDeadline = time.Now().UTC().Add(step.Timeout).UnixNano()
+	}
+
+	log.Printf(ctx, "sagaOrchestrator", "Workflow %s key %s executing step %s", workflow.WorkflowName, workflow.WorkflowKey, step.Name)
+
+	return newWorkflowCommand(step.Topic, fmt.Sprintf("%s.%s", orchestrator.WorkflowName, step.Name), event), nil
+}
+
+// compensate
+// Fails the workflow and returns the compensations of the completed steps in reverse order,
+// to publish once the workflow is stored
+func (orchestrator *Orchestrator) compensate(ctx context.Context, workflow *Workflow, reason string) (commands []workflowCommand, err error) {
+
+	log.Printf(ctx, "sagaOrchestrator", "Workflow %s key %s failed, %s. Compensating completed steps...", workflow.WorkflowName, workflow.WorkflowKey, reason)
+
+	for i := workflow.CurrentStep - 1; i >= 0; i-- {
+
+		step := orchestrator.Steps[i]
+
+		if step.Compensation == nil {
+			continue
+		}
+
+		event, err := step.Compensation(ctx, *workflow)
+
+		if err != nil {
+			return nil, fmt.Errorf("error compensating workflow %s step %s, %s", orchestrator.WorkflowName, step.Name, err)
+		}
+
+		commands = append(commands, newWorkflowCommand(step.Topic, fmt.Sprintf("%s.%s.compensation", orchestrator.WorkflowName, step.Name), event))
+	}
+
+	workflow.Status = WorkflowFailed
+	workflow.FailedStep = orchestrator.Steps[workflow.CurrentStep].Name
+	workflow.FailureReason = reason
+	workflow.StepDeadline = 0
+
+	return commands, nil
+}
+
+// publishPendingCommands
+// Publishes the pending commands of the stored workflow in order, stopping at the first that fails,
+// and removes the published ones from the workflow. The ones not published are due to publish again.
+func (orchestrator *Orchestrator) publishPendingCommands(ctx context.Context, workflow Workflow) (err error) {
+
+	if len(workflow.pendingCommands) == 0 {
+		return nil
+	}
+
+	published := make(map[string]bool)
+
+	var publishErr error
+
+	for _, command := range workflow.pendingCommands {
+
+		stepCtx, seg := tracing.BeginWorkflowStepSegment(ctx, orchestrator.AppID, command.Segment)
+
+		publishErr = orchestrator.publishCommand(stepCtx, command)
+
+		seg.Close(publishErr)
+
+		if publishErr != nil {
+			log.Errorf(ctx, "sagaOrchestrator", "Workflow %s key %s. Error publishing command %s to %s, %s", workflow.WorkflowName, workflow.WorkflowKey, command.Event.EventType, command.Topic, publishErr)
+			break
+		}
+
+		published[command.ID] = true
+	}
+
+	err = orchestrator.withTx(ctx, func(tx *sql.Tx) error {
+
+		stored, err := orchestrator.findWorkflowByKey(tx, workflow.WorkflowKey)
+
+		if err != nil {
+			return err
+		}
+
+		var pending []workflowCommand
+
+		for _, command := range stored.pendingCommands {
+
+			if !published[command.ID] {
+				pending = append(pending, command)
+			}
+		}
+
+		stored.pendingCommands = pending
+
+		switch {
+		case len(pending) == 0:
+			stored.publishAt = 0
+		case publishErr != nil:
+			stored.publishAt = time.Now().UTC().UnixNano()
+		}
+
+		return orchestrator.store(tx, &stored)
+	})
+
+	if err != nil {
+		return fmt.Errorf("error storing published workflow %s key %s commands, %s", orchestrator.WorkflowName, workflow.WorkflowKey, err)
+	}
+
+	if publishErr != nil {
+		return fmt.Errorf("error publishing workflow %s key %s commands, %s", orchestrator.WorkflowName, workflow.WorkflowKey, publishErr)
+	}
+
+	return nil
+}
+
+// publishDueCommands
+// Publishes the pending commands of the workflows whose publish failed, or whose publisher stopped
+func (orchestrator *Orchestrator) publishDueCommands() {
+
+	correlationID, _ := uuid.NewV4()
+
+	ctx := appctx.NewContextFromValues(orchestrator.AppID, correlationID.String())
+
+	rows, err := orchestrator.sqlDb.GetDB().QueryContext(ctx, findDuePendingWorkflows, orchestrator.WorkflowName, time.Now().UTC().UnixNano())
+
+	if err != nil {
+		log.Errorf(ctx, "sagaOrchestrator", "Error finding workflows %s with pending commands, %s", orchestrator.WorkflowName, err)
+		return
+	}
+
+	var workflowKeys []string
+
+	for rows.Next() {
+
+		var workflowKey string
+
+		err = rows.Scan(&workflowKey)
+
+		if err != nil {
+			break
+		}
+
+		workflowKeys = append(workflowKeys, workflowKey)
+	}
+
+	if err == nil {
+		err = rows.Err()
+	}
+
+	_ = rows.Close()
+
+	if err != nil {
+		log.Errorf(ctx, "sagaOrchestrator", "Error finding workflows %s with pending commands, %s", orchestrator.WorkflowName, err)
+		return
+	}
+
+	// a workflow failing to publish doesn't stop the others
+	for _, workflowKey := range workflowKeys {
+
+		var workflow Workflow
+		var publish bool
+
+		err = orchestrator.withTx(ctx, func(tx *sql.Tx) (err error) {
+
+			workflow, err = orchestrator.findWorkflowByKey(tx, workflowKey)
+
+			if err != nil {
+				return err
+			}
+
+			return orchestrator.leaseDueCommands(tx, &workflow, &publish)
+		})
+
+		if err == nil && publish {
+			err = orchestrator.publishPendingCommands(ctx, workflow)
+		}
+
+		if err != nil {
+			log.Errorf(ctx, "sagaOrchestrator", "Error publishing workflow %s key %s pending commands, %s", orchestrator.WorkflowName, workflowKey, err)
+		}
+	}
+}
+
+// leaseDueCommands
+// Leases the pending commands of the workflow due to publish again, and stores it. publish is false if there are none
+func (orchestrator *Orchestrator) leaseDueCommands(tx *sql.Tx, workflow *Workflow, publish *bool) (err error) {
+
+	if len(workflow.pendingCommands) == 0 || workflow.publishAt > time.Now().UTC().UnixNano() {
+		*publish = false
+		return nil
+	}
+
+	*publish = leasePendingCommands(workflow, nil)
+
+	return orchestrator.store(tx, workflow)
+}
+
+// leasePendingCommands
+// Adds the commands to the pending ones and leases them to publish once the workflow is stored.
+// Returns false if there are no commands to publish
+func leasePendingCommands(workflow *Workflow, commands []workflowCommand) bool {
+
+	workflow.pendingCommands = append(workflow.pendingCommands, commands...)
+
+	if len(workflow.pendingCommands) == 0 {
+		return false
+	}
+
+	workflow.publishAt = time.Now().UTC().Add(commandPublishLease).UnixNano()
+
+	return true
+}
+
+func newWorkflowCommand(topic, segment string, event appevent.AppEvent) workflowCommand {
+
+	id, _ := uuid.NewV4()
+
+	return workflowCommand{
+		ID:      id.String(),
+		Topic:   topic,
+		Segment: segment,
+		Event:   event,
+	}
+}
+
+func (orchestrator *Orchestrator) publishCommand(ctx context.Context, command workflowCommand) (err error) {
+
+	event, err := command.Event.ToJSON()
+
+	if err != nil {
+		return err
+	}
+
+	return orchestrator.pubSub.PublishToTopic(ctx, command.Topic, event, "application/json")
+}
+
+func (orchestrator *Orchestrator) handleFinished(ctx context.Context, workflow Workflow) (err error) {
+
+	handler := orchestrator.completedHandler
+
+	if workflow.Status == WorkflowFailed {
+		handler = orchestrator.failedHandler
+	}
+
+	if workflow.Status == WorkflowRunning || handler == nil {
+		return nil
+	}
+
+	err = handler(ctx, workflow)
+
+	if err != nil {
+		log.Errorf(ctx, "sagaOrchestrator", "Workflow %s key %s %s. Error executing handler, %s", workflow.WorkflowName, workflow.WorkflowKey, workflow.Status, err)
+		return err
+	}
+
+	return nil
+}
+
+// withTx
+// Runs the func in a serializable transaction, retried while it fails with a serialization failure
+// or deadlock of a concurrent update, see db.WithTxContext
+func (orchestrator *Orchestrator) withTx(ctx context.Context, txFunc func(tx *sql.Tx) error) (err error) {
+
+	return orchestrator.sqlDb.WithTxContext(ctx, db.TxOptions{Isolation: sql.LevelSerializable}, func(tx db.AppSqlTx) error {
+		return txFunc(tx.GetTx())
+	})
+}
+
+func (orchestrator *Orchestrator) store(tx *sql.Tx, workflow *Workflow) (err error) {
+
+	eventsMapJSON, err := json.Marshal(workflow.Events)
+
+	if err != nil {
+		return err
+	}
+
+	pendingCommands := workflow.pendingCommands
+
+	if pendingCommands == nil {
+		pendingCommands = []workflowCommand{}
+	}
+
+	pendingCommandsJSON, err := json.Marshal(pendingCommands)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(insertWorkflow, workflow.WorkflowName, workflow.WorkflowKey, []byte(workflow.Data), string(workflow.Status), workflow.CurrentStep, eventsMapJSON,
+		workflow.FailedStep, workflow.FailureReason, workflow.StepDeadline, workflow.StartedAt, workflow.Timestamp, pendingCommandsJSON, workflow.publishAt)
+
+	return err
+}
+
+func (orchestrator *Orchestrator) findWorkflowByKey(tx *sql.Tx, workflowKey string) (workflow Workflow, err error) {
+
+	return scanWorkflow(tx.QueryRow(findWorkflow, orchestrator.WorkflowName, workflowKey))
+}
+
+func scanWorkflow(row *sql.Row) (workflow Workflow, err error) {
+
+	var status string
+	var data, eventsMapJSON, pendingCommandsJSON []byte
+
+	err = row.Scan(&workflow.WorkflowName, &workflow.WorkflowKey, &data, &status, &workflow.CurrentStep, &eventsMapJSON,
+		&workflow.FailedStep, &workflow.FailureReason, &workflow.StepDeadline, &workflow.StartedAt, &workflow.Timestamp, &pendingCommandsJSON, &workflow.publishAt)
+
+	if err == sql.ErrNoRows {
+		return workflow, WorkflowNotFound
+	}
+
+	if err != nil {
+		return workflow, err
+	}
+
+	workflow.Status = WorkflowStatus(status)
+	workflow.Data = data
+	workflow.Events = make(map[string]appevent.AppEvent)
+
+	err = json.Unmarshal(eventsMapJSON, &workflow.Events)
+
+	if err != nil {
+		return workflow, err
+	}
+
+	err = json.Unmarshal(pendingCommandsJSON, &workflow.pendingCommands)
+
+	if err != nil {
+		return workflow, err
+	}
+
+	return workflow, nil
+}
@@ -0,0 +1,309 @@
+package appsaga
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/HelloSundayMorning/apputils/db"
+	"github.com/HelloSundayMorning/apputils/eventpubsub/testkit"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+var workflowRowColumns = []string{"workflow_name", "workflow_key", "data", "status", "current_step", "events", "failed_step", "failure_reason", "step_deadline", "started_at", "timestamp", "pending_commands", "publish_at"}
+
+// pending compensation of the account step, due to publish
+var pendingCompensationJSON = []byte(`[{"ID":"c1","Topic":"account","Segment":"signup.account.compensation","Event":{"EventType":"delete_account","Timestamp":1,"Data":{}}}]`)
+
+func command(eventType string) WorkflowCommand {
+
+	return func(ctx context.Context, workflow Workflow) (appevent.AppEvent, error) {
+		return appevent.NewAppEvent(eventType, workflow.Data), nil
+	}
+}
+
+func newTestOrchestrator(t *testing.T) (*Orchestrator, sqlmock.Sqlmock, *testkit.Recorder) {
+
+	mockDb, mock, err := db.NewMockDB()
+
+	assert.NoError(t, err)
+
+	expectSagaMigrationsApplied(t, mock)
+
+	recorder := testkit.NewRecorder("testApp")
+
+	orchestrator, err := NewOrchestrator("testApp", mockDb, recorder, "signup", []WorkflowStep{
+		{Name: "account", Topic: "account", Command: command("create_account"), SuccessEventType: "account_created", FailureEventType: "account_failed", Compensation: command("delete_account")},
+		{Name: "payment", Topic: "payment", Command: command("charge"), SuccessEventType: "charged", FailureEventType: "charge_failed"},
+	})
+
+	assert.NoError(t, err)
+
+	return orchestrator, mock, recorder
+}
+
+// expectSagaMigrationsApplied
+// Expects the saga migrations, saga_workflow included, to be all applied
+func expectSagaMigrationsApplied(t *testing.T, mock sqlmock.Sqlmock) {
+
+	migrations, err := db.LoadMigrations(sagaMigrations, "migrations")
+
+	assert.NoError(t, err)
+
+	rows := sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"})
+
+	for _, migration := range migrations {
+		rows.AddRow(migration.Version, migration.Name, migration.Checksum(), time.Now())
+	}
+
+	mock.ExpectQuery("pg_try_advisory_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery("to_regclass").WithArgs(sagaMigrationsTable).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(`FROM "saga_manager_migrations"`).WillReturnRows(rows)
+	mock.ExpectExec("pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func expectWorkflowTx(mock sqlmock.Sqlmock, rows *sqlmock.Rows, store bool) {
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM saga_workflow").WithArgs("signup", "key1").WillReturnRows(rows)
+
+	if store {
+		mock.ExpectExec("INSERT INTO saga_workflow").WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	mock.ExpectCommit()
+}
+
+// expectPublishedTx
+// Expects the published commands to be removed from the stored workflow
+func expectPublishedTx(mock sqlmock.Sqlmock, workflowKey string) {
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM saga_workflow").WithArgs("signup", workflowKey).WillReturnRows(sqlmock.NewRows(workflowRowColumns).
+		AddRow("signup", workflowKey, []byte(`{}`), "running", 0, []byte(`{}`), "", "", 0, 1, 1, []byte(`[]`), 1))
+	mock.ExpectExec("INSERT INTO saga_workflow").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func TestOrchestrator_Start(t *testing.T) {
+
+	orchestrator, mock, recorder := newTestOrchestrator(t)
+
+	ctx := appctx.NewContextFromValues("testApp", "corrID")
+
+	expectWorkflowTx(mock, sqlmock.NewRows(workflowRowColumns), true)
+	expectPublishedTx(mock, "key1")
+
+	workflow, err := orchestrator.Start(ctx, "key1", json.RawMessage(`{"userID":"1"}`))
+
+	assert.NoError(t, err)
+	assert.Equal(t, WorkflowRunning, workflow.Status)
+	assert.Equal(t, 0, workflow.CurrentStep)
+	recorder.AssertPublishedOnce(t, "create_account", map[string]string{"userID": "1"})
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOrchestrator_StartCommitFails(t *testing.T) {
+
+	orchestrator, mock, recorder := newTestOrchestrator(t)
+
+	ctx := appctx.NewContextFromValues("testApp", "corrID")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM saga_workflow").WithArgs("signup", "key1").WillReturnRows(sqlmock.NewRows(workflowRowColumns))
+	mock.ExpectExec("INSERT INTO saga_workflow").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit().WillReturnError(fmt.Errorf("connection reset"))
+
+	_, err := orchestrator.Start(ctx, "key1", json.RawMessage(`{"userID":"1"}`))
+
+	assert.Error(t, err)
+	assert.Empty(t, recorder.Published())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOrchestrator_HandleEvent(t *testing.T) {
+
+	type testDef struct {
+		CurrentStep int
+		Status      WorkflowStatus
+		EventType   string
+		Expected    WorkflowStatus
+		Stored      bool
+		Published   []string
+	}
+
+	Tests := []testDef{
+		{0, WorkflowRunning, "account_created", WorkflowRunning, true, []string{"charge"}},
+		{1, WorkflowRunning, "charged", WorkflowCompleted, true, nil},
+		{1, WorkflowRunning, "charge_failed", WorkflowFailed, true, []string{"delete_account"}},
+		{0, WorkflowRunning, "account_failed", WorkflowFailed, true, nil},
+		{1, WorkflowRunning, "account_created", WorkflowRunning, false, nil},
+		{1, WorkflowCompleted, "charged", WorkflowCompleted, false, nil},
+	}
+
+	for idx, test := range Tests {
+
+		orchestrator, mock, recorder := newTestOrchestrator(t)
+
+		var finished []Workflow
+
+		orchestrator.SetCompletedHandler(func(ctx context.Context, workflow Workflow) error {
+			finished = append(finished, workflow)
+			return nil
+		})
+
+		orchestrator.SetFailedHandler(func(ctx context.Context, workflow Workflow) error {
+			finished = append(finished, workflow)
+			return nil
+		})
+
+		ctx := appctx.NewContextFromValues("testApp", "corrID")
+
+		rows := sqlmock.NewRows(workflowRowColumns).
+			AddRow("signup", "key1", []byte(`{}`), string(test.Status), test.CurrentStep, []byte(`{}`), "", "", 0, 1, 1, []byte(`[]`), 0)
+
+		expectWorkflowTx(mock, rows, test.Stored)
+
+		if test.Published != nil {
+			expectPublishedTx(mock, "key1")
+		}
+
+		workflow, err := orchestrator.HandleEvent(ctx, "key1", appevent.NewAppEvent(test.EventType, json.RawMessage(`{}`)))
+
+		assert.NoErrorf(t, err, "Failed test %d", idx)
+		assert.Equalf(t, test.Expected, workflow.Status, "Failed test %d", idx)
+		assert.NoErrorf(t, mock.ExpectationsWereMet(), "Failed test %d", idx)
+
+		var published []string
+
+		for _, event := range recorder.Published() {
+			published = append(published, event.AppEvent.EventType)
+		}
+
+		assert.Equalf(t, test.Published, published, "Failed test %d", idx)
+
+		finishedNow := test.Status == WorkflowRunning && test.Expected != WorkflowRunning
+
+		assert.Equalf(t, finishedNow, len(finished) == 1, "Failed test %d", idx)
+	}
+}
+
+func TestOrchestrator_HandleEventPublishFails(t *testing.T) {
+
+	orchestrator, mock, recorder := newTestOrchestrator(t)
+
+	var failed []Workflow
+
+	orchestrator.SetFailedHandler(func(ctx context.Context, workflow Workflow) error {
+		failed = append(failed, workflow)
+		return nil
+	})
+
+	ctx := appctx.NewContextFromValues("testApp", "corrID")
+
+	recorder.PublishErr = fmt.Errorf("connection closed")
+
+	// the compensation stays pending, due to publish again
+	expectWorkflowTx(mock, sqlmock.NewRows(workflowRowColumns).
+		AddRow("signup", "key1", []byte(`{}`), "running", 1, []byte(`{}`), "", "", 0, 1, 1, []byte(`[]`), 0), true)
+	expectPublishedTx(mock, "key1")
+
+	_, err := orchestrator.HandleEvent(ctx, "key1", appevent.NewAppEvent("charge_failed", json.RawMessage(`{}`)))
+
+	assert.Error(t, err)
+	assert.Empty(t, recorder.Published())
+	assert.Len(t, failed, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// the redelivered event publishes the pending compensation of the failed workflow
+	recorder.PublishErr = nil
+
+	expectWorkflowTx(mock, sqlmock.NewRows(workflowRowColumns).
+		AddRow("signup", "key1", []byte(`{}`), "failed", 1, []byte(`{}`), "payment", "failed", 0, 1, 1, pendingCompensationJSON, 1), true)
+	expectPublishedTx(mock, "key1")
+
+	workflow, err := orchestrator.HandleEvent(ctx, "key1", appevent.NewAppEvent("charge_failed", json.RawMessage(`{}`)))
+
+	assert.NoError(t, err)
+	assert.Equal(t, WorkflowFailed, workflow.Status)
+	recorder.AssertPublishedOnce(t, "delete_account", map[string]string{})
+	assert.Len(t, failed, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOrchestrator_PublishDueCommands(t *testing.T) {
+
+	orchestrator, mock, recorder := newTestOrchestrator(t)
+
+	mock.ExpectQuery("FROM saga_workflow").WithArgs("signup", sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows([]string{"workflow_key"}).AddRow("key1").AddRow("key2"))
+
+	// a workflow failing doesn't stop the others
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM saga_workflow").WithArgs("signup", "key1").WillReturnError(fmt.Errorf("invalid workflow"))
+	mock.ExpectRollback()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM saga_workflow").WithArgs("signup", "key2").WillReturnRows(sqlmock.NewRows(workflowRowColumns).
+		AddRow("signup", "key2", []byte(`{}`), "failed", 1, []byte(`{}`), "payment", "failed", 0, 1, 1, pendingCompensationJSON, 1))
+	mock.ExpectExec("INSERT INTO saga_workflow").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectPublishedTx(mock, "key2")
+
+	orchestrator.publishDueCommands()
+
+	recorder.AssertPublishedOnce(t, "delete_account", map[string]string{})
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestOrchestrator_SweepTimedOut(t *testing.T) {
+
+	orchestrator, mock, recorder := newTestOrchestrator(t)
+
+	// the compensation of key1 can't be built, it doesn't block key2
+	orchestrator.Steps[0].Compensation = func(ctx context.Context, workflow Workflow) (appevent.AppEvent, error) {
+
+		if workflow.WorkflowKey == "key1" {
+			return appevent.AppEvent{}, fmt.Errorf("invalid workflow data")
+		}
+
+		return appevent.NewAppEvent("delete_account", json.RawMessage(`{}`)), nil
+	}
+
+	var failed []Workflow
+
+	orchestrator.SetFailedHandler(func(ctx context.Context, workflow Workflow) error {
+		failed = append(failed, workflow)
+		return nil
+	})
+
+	timedOutRow := func(workflowKey string) *sqlmock.Rows {
+		return sqlmock.NewRows(workflowRowColumns).
+			AddRow("signup", workflowKey, []byte(`{}`), "running", 1, []byte(`{}`), "", "", 1, 1, 1, []byte(`[]`), 0)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FOR UPDATE SKIP LOCKED").WithArgs("signup", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnRows(timedOutRow("key1"))
+	mock.ExpectRollback()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FOR UPDATE SKIP LOCKED").WithArgs("signup", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnRows(timedOutRow("key2"))
+	mock.ExpectExec("INSERT INTO saga_workflow").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectPublishedTx(mock, "key2")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("FOR UPDATE SKIP LOCKED").WithArgs("signup", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows(workflowRowColumns))
+	mock.ExpectRollback()
+
+	orchestrator.sweepTimedOut()
+
+	recorder.AssertPublishedOnce(t, "delete_account", map[string]string{})
+	assert.Len(t, failed, 1)
+	assert.Equal(t, "key2", failed[0].WorkflowKey)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
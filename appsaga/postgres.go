@@ -0,0 +1,638 @@
+package appsaga
+
+import (
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/HelloSundayMorning/apputils/db"
+	"github.com/HelloSundayMorning/apputils/log"
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+)
+
+type (
+	// PostgresSagaStore
+	// SagaStore in the saga_manager table. Sagas are updated with optimistic locking on their version,
+	// an update conflicting with a concurrent one fails with SagaConflict. The sweepers lock the sagas
+	// skipping the ones locked by other replicas.
+	PostgresSagaStore struct {
+		sqlDb db.AppSqlDb
+	}
+
+	// sagaTx
+	// Transaction storing the saga, passed to the SagaTxUpdate
+	sagaTx struct {
+		tx *sql.Tx
+	}
+
+	// rowScanner
+	// sql.Row or sql.Rows
+	rowScanner interface {
+		Scan(dest ...interface{}) error
+	}
+)
+
+const (
+	// table recording the applied saga_manager migrations
+	sagaMigrationsTable = "saga_manager_migrations"
+
+	// the upgrade of existing tables builds the indexes without blocking writes, before the new
+	// version runs Initialize, and converts the json columns to jsonb rewriting the table
+	sagaStorageLockTimeout = `SET lock_timeout = '5s'`
+
+	findInvalidSagaIndex = `SELECT count(*)
+                    FROM pg_index JOIN pg_class ON pg_class.oid = pg_index.indexrelid
+                    WHERE pg_class.relname = $1 AND pg_index.indisvalid = false`
+
+	findJSONSagaColumns = `SELECT column_name
+                    FROM information_schema.columns
+                    WHERE table_name = 'saga_manager' AND column_name IN ('events', 'history') AND data_type = 'json'`
+
+	alterSagaColumnToJSONB = `ALTER TABLE saga_manager
+                                     ALTER COLUMN %[1]s DROP DEFAULT,
+                                     ALTER COLUMN %[1]s TYPE jsonb USING %[1]s :: jsonb,
+                                     ALTER COLUMN %[1]s SET DEFAULT %[2]s :: jsonb`
+
+	// a concurrent insert of the same saga makes it insert no row
+	insertNewSaga = `INSERT INTO saga_manager (saga_name, saga_key, timestamp, events , event_types, completed, started_at, expires_at, expired,
+                                history, completion_pending, completion_attempts, completion_error, next_attempt_at, failed, version)
+                                VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, 1)
+                                ON CONFLICT (saga_name, saga_key) DO NOTHING`
+
+	// a concurrent update of the saga changes its version, making it update no row
+	updateSagaVersion = `UPDATE saga_manager SET
+                                timestamp = $3,
+                                events = $4,
+                                event_types = $5,
+                                completed = $6,
+                                started_at = $7,
+                                expires_at = $8,
+                                expired = $9,
+                                history = $10,
+                                completion_pending = $11,
+                                completion_attempts = $12,
+                                completion_error = $13,
+                                next_attempt_at = $14,
+                                failed = $15,
+                                version = version + 1
+                                WHERE saga_name = $1 AND saga_key = $2 AND version = $16`
+
+	sagaColumns = `saga_name, saga_key, timestamp, events , event_types, completed, started_at, expires_at, expired,
+                    history, completion_pending, completion_attempts, completion_error, next_attempt_at, failed, version`
+
+	findSaga = `SELECT ` + sagaColumns + `
+                    FROM saga_manager
+                    WHERE saga_name = $1 AND saga_key = $2`
+
+	// locks one expired saga, skipping the ones locked by the sweeper of other replicas and the skipped keys
+	lockExpiredSaga = `SELECT ` + sagaColumns + `
+                    FROM saga_manager
+                    WHERE saga_name = $1 AND completed = false AND expired = false AND expires_at > 0 AND expires_at <= $2
+                    AND NOT (saga_key = ANY($3))
+                    ORDER BY expires_at
+                    LIMIT 1
+                    FOR UPDATE SKIP LOCKED`
+
+	// locks the saga pending completion, skipping it if it's being handled by other replica
+	lockPendingSaga = `SELECT ` + sagaColumns + `
+                    FROM saga_manager
+                    WHERE saga_name = $1 AND saga_key = $2 AND completion_pending = true
+                    FOR UPDATE SKIP LOCKED`
+
+	findDuePendingSagas = `SELECT saga_key
+                    FROM saga_manager
+                    WHERE saga_name = $1 AND completion_pending = true AND next_attempt_at <= $2
+                    ORDER BY next_attempt_at
+                    LIMIT 100`
+
+	deleteSaga = `DELETE FROM saga_manager WHERE saga_name = $1 AND saga_key = $2`
+
+	// deletes a batch of sagas, skipping the ones being updated, and optionally moves them to the archive
+	purgeSagas = `DELETE FROM saga_manager
+                    WHERE (saga_name, saga_key) IN (
+                        SELECT saga_name, saga_key
+                        FROM saga_manager
+                        WHERE saga_name = $1 AND timestamp <= $2 AND (%s)
+                        ORDER BY timestamp
+                        LIMIT $3
+                        FOR UPDATE SKIP LOCKED)`
+
+	archiveSagas = `WITH purged AS (` + purgeSagas + ` RETURNING ` + sagaColumns + `)
+                    INSERT INTO saga_manager_archive (` + sagaColumns + `, archived_at)
+                    SELECT ` + sagaColumns + `, $4 FROM purged`
+)
+
+var (
+	_ SagaStore = &PostgresSagaStore{}
+
+	//go:embed migrations/*.sql
+	sagaMigrations embed.FS
+
+	// indexes built by Upgrade without blocking writes, the startup migrations don't build them
+	sagaStorageIndexes = []struct {
+		Name       string
+		Definition string
+	}{
+		{"saga_manager_expires_at_idx", `ON saga_manager (saga_name, expires_at) WHERE completed = false AND expired = false AND expires_at > 0`},
+		{"saga_manager_completion_pending_idx", `ON saga_manager (saga_name, next_attempt_at) WHERE completion_pending = true`},
+		{"saga_manager_state_timestamp_idx", `ON saga_manager (saga_name, completed, timestamp)`},
+		{"saga_manager_started_at_idx", `ON saga_manager (saga_name, started_at)`},
+	}
+
+	sagaStateConditions = map[SagaState]string{
+		SagaStateOpen:              `completed = false AND expired = false`,
+		SagaStateCompleted:         `completed = true AND completion_pending = false AND failed = false`,
+		SagaStateCompletionPending: `completion_pending = true`,
+		SagaStateFailed:            `failed = true`,
+		SagaStateExpired:           `expired = true`,
+	}
+)
+
+// NewPostgresSagaStore
+// Creates the saga store in the saga_manager table of the database
+func NewPostgresSagaStore(sqlDb db.AppSqlDb) *PostgresSagaStore {
+
+	return &PostgresSagaStore{
+		sqlDb: sqlDb,
+	}
+}
+
+// Initialize
+// Applies the pending migrations of the saga tables, see the migrations directory.
+// The migrations don't rewrite the saga_manager table, see Upgrade.
+func (store *PostgresSagaStore) Initialize(ctx context.Context) (err error) {
+
+	return db.MigrateSchema(ctx, store.sqlDb, sagaMigrations, "migrations", sagaMigrationsTable)
+}
+
+func (store *PostgresSagaStore) UpdateSaga(ctx context.Context, sagaName, sagaKey string, update SagaUpdate) (saga Saga, err error) {
+
+	tx, err := store.sqlDb.GetDB().BeginTx(ctx, nil)
+
+	if err != nil {
+		return saga, err
+	}
+
+	saga, err = store.findSagaByKey(tx, sagaName, sagaKey)
+
+	if err != nil {
+		tx.Rollback()
+		return saga, err
+	}
+
+	return saga, store.updateAndCommit(tx, &saga, withoutTx(update))
+}
+
+func (store *PostgresSagaStore) UpdatePendingSaga(ctx context.Context, sagaName, sagaKey string, update SagaTxUpdate) (saga Saga, err error) {
+
+	return store.lockAndUpdate(ctx, update, lockPendingSaga, sagaName, sagaKey)
+}
+
+func (store *PostgresSagaStore) UpdateNextExpiredSaga(ctx context.Context, sagaName string, now int64, skipKeys []string, update SagaUpdate) (saga Saga, err error) {
+
+	return store.lockAndUpdate(ctx, withoutTx(update), lockExpiredSaga, sagaName, now, pq.Array(skipKeys))
+}
+
+func (store *PostgresSagaStore) FindDuePendingSagaKeys(ctx context.Context, sagaName string, now int64) (sagaKeys []string, err error) {
+
+	rows, err := store.sqlDb.GetDB().QueryContext(ctx, findDuePendingSagas, sagaName, now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var sagaKey string
+
+		err = rows.Scan(&sagaKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		sagaKeys = append(sagaKeys, sagaKey)
+	}
+
+	return sagaKeys, rows.Err()
+}
+
+func (store *PostgresSagaStore) GetSaga(ctx context.Context, sagaName, sagaKey string) (saga Saga, err error) {
+
+	saga, err = scanSaga(store.sqlDb.GetDB().QueryRowContext(ctx, findSaga, sagaName, sagaKey))
+
+	if err == sql.ErrNoRows {
+		return saga, SagaNotFound
+	}
+
+	return saga, err
+}
+
+func (store *PostgresSagaStore) ListSagas(ctx context.Context, sagaName string, query SagaQuery) (sagas []Saga, err error) {
+
+	statement := `SELECT ` + sagaColumns + `
+                    FROM saga_manager
+                    WHERE saga_name = $1`
+
+	args := []interface{}{sagaName}
+
+	if query.State != "" {
+		statement += ` AND ` + sagaStateConditions[query.State]
+	}
+
+	now := time.Now().UTC()
+
+	if query.MinAge > 0 {
+		args = append(args, now.Add(-query.MinAge).UnixNano())
+		statement += fmt.Sprintf(` AND started_at <= $%d`, len(args))
+	}
+
+	if query.MaxAge > 0 {
+		args = append(args, now.Add(-query.MaxAge).UnixNano())
+		statement += fmt.Sprintf(` AND started_at >= $%d`, len(args))
+	}
+
+	args = append(args, query.Limit, query.Offset)
+	statement += fmt.Sprintf(` ORDER BY started_at, saga_key LIMIT $%d OFFSET $%d`, len(args)-1, len(args))
+
+	rows, err := store.sqlDb.GetDB().QueryContext(ctx, statement, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	sagas = []Saga{}
+
+	for rows.Next() {
+
+		saga, err := scanSaga(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		sagas = append(sagas, saga)
+	}
+
+	return sagas, rows.Err()
+}
+
+func (store *PostgresSagaStore) DeleteSaga(ctx context.Context, sagaName, sagaKey string) (err error) {
+
+	result, err := store.sqlDb.GetDB().ExecContext(ctx, deleteSaga, sagaName, sagaKey)
+
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return SagaNotFound
+	}
+
+	return nil
+}
+
+func (store *PostgresSagaStore) PurgeSagas(ctx context.Context, sagaName string, states []SagaState, before int64, archive bool, limit int) (purged int, err error) {
+
+	var conditions []string
+
+	for _, state := range states {
+		conditions = append(conditions, `(`+sagaStateConditions[state]+`)`)
+	}
+
+	args := []interface{}{sagaName, before, limit}
+	statement := purgeSagas
+
+	if archive {
+		args = append(args, time.Now().UTC().UnixNano())
+		statement = archiveSagas
+	}
+
+	result, err := store.sqlDb.GetDB().ExecContext(ctx, fmt.Sprintf(statement, strings.Join(conditions, ` OR `)), args...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	deleted, err := result.RowsAffected()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int(deleted), nil
+}
+
+// Upgrade
+// Upgrades the saga_manager table, run it before deploying the new version, also on new deployments.
+// It applies the pending migrations, then builds the indexes concurrently, without blocking the sagas
+// being updated, and converts the events and history from json to jsonb. The conversion rewrites the
+// table locking it, so it fails instead of waiting if the table is busy. It holds the lock of the saga
+// migrations, replicas starting meanwhile wait for it. Each step is skipped if already done, so a failed
+// upgrade can be run again. Initialize doesn't convert the columns, the sagas work with both types.
+func (store *PostgresSagaStore) Upgrade(ctx context.Context) (err error) {
+
+	// the indexes need the columns added by the migrations
+	err = store.Initialize(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	return db.WithMigrationsLock(ctx, store.sqlDb, sagaMigrationsTable, func(conn *sql.Conn) error {
+
+		_, err := conn.ExecContext(ctx, sagaStorageLockTimeout)
+
+		if err != nil {
+			return err
+		}
+
+		// the connection goes back to the pool
+		defer conn.ExecContext(context.Background(), `RESET lock_timeout`)
+
+		for _, index := range sagaStorageIndexes {
+
+			err = store.createIndexConcurrently(ctx, conn, index.Name, index.Definition)
+
+			if err != nil {
+				return fmt.Errorf("error creating saga index %s, %s", index.Name, err)
+			}
+		}
+
+		columns, err := store.findJSONColumns(ctx, conn)
+
+		if err != nil {
+			return err
+		}
+
+		for _, column := range columns {
+
+			log.Printf(ctx, "sagaManager", "Converting saga_manager column %s to jsonb", column)
+
+			defaultValue := `'{}'`
+
+			if column == "history" {
+				defaultValue = `'[]'`
+			}
+
+			_, err = conn.ExecContext(ctx, fmt.Sprintf(alterSagaColumnToJSONB, column, defaultValue))
+
+			if err != nil {
+				return fmt.Errorf("error converting saga_manager column %s to jsonb, %s", column, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// createIndexConcurrently
+// Builds the index if missing. An invalid index left by a failed build is dropped and built again,
+// IF NOT EXISTS would skip it
+func (store *PostgresSagaStore) createIndexConcurrently(ctx context.Context, conn *sql.Conn, name, definition string) (err error) {
+
+	var invalid int
+
+	err = conn.QueryRowContext(ctx, findInvalidSagaIndex, name).Scan(&invalid)
+
+	if err != nil {
+		return err
+	}
+
+	if invalid > 0 {
+
+		_, err = conn.ExecContext(ctx, `DROP INDEX CONCURRENTLY IF EXISTS `+name)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf(ctx, "sagaManager", "Creating saga index %s", name)
+
+	_, err = conn.ExecContext(ctx, `CREATE INDEX CONCURRENTLY IF NOT EXISTS `+name+` `+definition)
+
+	if err != nil {
+		return err
+	}
+
+	err = conn.QueryRowContext(ctx, findInvalidSagaIndex, name).Scan(&invalid)
+
+	if err != nil {
+		return err
+	}
+
+	if invalid > 0 {
+		return fmt.Errorf("index %s is invalid after building it, run the upgrade again", name)
+	}
+
+	return nil
+}
+
+// findJSONColumns
+// Returns the saga_manager columns still stored as json
+func (store *PostgresSagaStore) findJSONColumns(ctx context.Context, conn *sql.Conn) (columns []string, err error) {
+
+	rows, err := conn.QueryContext(ctx, findJSONSagaColumns)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var column string
+
+		err = rows.Scan(&column)
+
+		if err != nil {
+			return nil, err
+		}
+
+		columns = append(columns, column)
+	}
+
+	return columns, rows.Err()
+}
+
+// lockAndUpdate
+// Locks the saga selected by the locking query and updates it
+func (store *PostgresSagaStore) lockAndUpdate(ctx context.Context, update SagaTxUpdate, lockQuery string, args ...interface{}) (saga Saga, err error) {
+
+	tx, err := store.sqlDb.GetDB().BeginTx(ctx, nil)
+
+	if err != nil {
+		return saga, err
+	}
+
+	saga, err = scanSaga(tx.QueryRow(lockQuery, args...))
+
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		return saga, SagaNotFound
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return saga, err
+	}
+
+	return saga, store.updateAndCommit(tx, &saga, update)
+}
+
+// updateAndCommit
+// Applies the update to the saga read in the transaction and stores it, or rolls back if the update fails
+func (store *PostgresSagaStore) updateAndCommit(tx *sql.Tx, saga *Saga, update SagaTxUpdate) (err error) {
+
+	isNew := saga.SagaName == ""
+
+	err = update(&sagaTx{tx}, saga)
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = store.storeSaga(tx, saga, isNew)
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// storeSaga
+// Inserts the new saga, or updates the saga if its version didn't change since it was read
+func (store *PostgresSagaStore) storeSaga(tx *sql.Tx, saga *Saga, isNew bool) (err error) {
+
+	eventsMapJSON, err := json.Marshal(saga.Events)
+
+	if err != nil {
+		return err
+	}
+
+	if saga.History == nil {
+		saga.History = []appevent.AppEvent{}
+	}
+
+	historyJSON, err := json.Marshal(saga.History)
+
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{saga.SagaName, saga.SagaKey, saga.Timestamp, eventsMapJSON, pq.Array(saga.EventTypes), saga.Completed, saga.StartedAt, saga.ExpiresAt, saga.Expired,
+		historyJSON, saga.CompletionPending, saga.CompletionAttempts, saga.CompletionError, saga.NextAttemptAt, saga.Failed}
+
+	var result sql.Result
+
+	if isNew {
+		result, err = tx.Exec(insertNewSaga, args...)
+	} else {
+		result, err = tx.Exec(updateSagaVersion, append(args, saga.Version)...)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	stored, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if stored == 0 {
+		return SagaConflict
+	}
+
+	saga.Version++
+
+	return nil
+}
+
+func (store *PostgresSagaStore) findSagaByKey(tx *sql.Tx, sagaName, sagaKey string) (userSaga Saga, err error) {
+
+	userSaga, err = scanSaga(tx.QueryRow(findSaga, sagaName, sagaKey))
+
+	if err == sql.ErrNoRows {
+		return Saga{Events: make(map[string]appevent.AppEvent)}, nil
+	}
+
+	return userSaga, err
+}
+
+func (txDb *sagaTx) GetTx() *sql.Tx {
+	return txDb.tx
+}
+
+// withoutTx
+// Returns the update as a SagaTxUpdate ignoring the transaction
+func withoutTx(update SagaUpdate) SagaTxUpdate {
+
+	return func(tx db.AppSqlTx, saga *Saga) error {
+		return update(saga)
+	}
+}
+
+// scanSaga
+// Reads a saga row selected with the saga columns. Sagas stored before the history
+// was kept get it from their events.
+func scanSaga(row rowScanner) (saga Saga, err error) {
+
+	var eventsMapJSON, historyJSON []byte
+
+	err = row.Scan(&saga.SagaName, &saga.SagaKey, &saga.Timestamp, &eventsMapJSON, pq.Array(&saga.EventTypes), &saga.Completed, &saga.StartedAt, &saga.ExpiresAt, &saga.Expired,
+		&historyJSON, &saga.CompletionPending, &saga.CompletionAttempts, &saga.CompletionError, &saga.NextAttemptAt, &saga.Failed, &saga.Version)
+
+	if err != nil {
+		return saga, err
+	}
+
+	saga.Events = make(map[string]appevent.AppEvent)
+
+	err = json.Unmarshal(eventsMapJSON, &saga.Events)
+
+	if err != nil {
+		return saga, err
+	}
+
+	err = json.Unmarshal(historyJSON, &saga.History)
+
+	if err != nil {
+		return saga, err
+	}
+
+	if len(saga.History) == 0 && len(saga.Events) > 0 {
+
+		for _, event := range saga.Events {
+			saga.History = append(saga.History, event)
+		}
+
+		sort.SliceStable(saga.History, func(i, j int) bool {
+			return saga.History[i].Timestamp < saga.History[j].Timestamp
+		})
+	}
+
+	return saga, nil
+}
@@ -0,0 +1,88 @@
+package appsaga
+
+import (
+	"testing"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/db"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestPostgresSagaStore_Initialize(t *testing.T) {
+
+	migrations, err := db.LoadMigrations(sagaMigrations, "migrations")
+
+	assert.NoError(t, err)
+	assert.True(t, len(migrations) >= 3)
+
+	type testDef struct {
+		Applied []int64
+		Pending []string
+		HasErr  bool
+	}
+
+	latest := migrations[len(migrations)-1].Version
+
+	Tests := []testDef{
+		{nil, []string{"CREATE TABLE IF NOT EXISTS saga_manager ", "saga_manager_archive", "CREATE TABLE IF NOT EXISTS saga_workflow"}, false},
+		{[]int64{1}, []string{"saga_manager_archive", "CREATE TABLE IF NOT EXISTS saga_workflow"}, false},
+		{[]int64{1, 2}, []string{"CREATE TABLE IF NOT EXISTS saga_workflow"}, false},
+		{[]int64{1, 2, 3}, nil, false},
+		{[]int64{1, 2, 3, latest + 1}, nil, true},
+	}
+
+	for idx, test := range Tests {
+
+		mockDb, mock, err := db.NewMockDB()
+
+		assert.NoError(t, err)
+
+		mock.ExpectQuery("pg_try_advisory_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+		mock.ExpectQuery("to_regclass").WithArgs(sagaMigrationsTable).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(test.Applied != nil))
+
+		if test.Applied != nil {
+
+			rows := sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"})
+
+			for _, version := range test.Applied {
+
+				checksum := "unknown"
+
+				for _, migration := range migrations {
+
+					if migration.Version == version {
+						checksum = migration.Checksum()
+					}
+				}
+
+				rows.AddRow(version, "migration", checksum, time.Now())
+			}
+
+			mock.ExpectQuery(`FROM "saga_manager_migrations"`).WillReturnRows(rows)
+		}
+
+		if len(test.Pending) > 0 {
+			mock.ExpectExec(`CREATE TABLE IF NOT EXISTS "saga_manager_migrations"`).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+
+		for _, statement := range test.Pending {
+			mock.ExpectBegin()
+			mock.ExpectExec(statement).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(`INSERT INTO "saga_manager_migrations"`).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+		}
+
+		mock.ExpectExec("pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		err = NewPostgresSagaStore(mockDb).Initialize(context.Background())
+
+		assert.Equalf(t, test.HasErr, err != nil, "Failed test %d", idx)
+		assert.NoErrorf(t, mock.ExpectationsWereMet(), "Failed test %d", idx)
+
+		if test.HasErr {
+			assert.Containsf(t, err.Error(), "newer", "Failed test %d", idx)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package appsaga
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/log"
+	"github.com/gofrs/uuid"
+)
+
+type (
+	// SagaRetentionPolicy
+	// Purge of the finished sagas by the retention job.
+	// - MaxAge: sagas not changed for longer are purged. An event of a purged saga starts it again,
+	//   so it should be longer than the time late events may arrive
+	// - States: states of the sagas purged, any of completed, failed and expired. Default completed
+	// - Archive: moves the sagas to the saga_manager_archive table instead of deleting them
+	// - BatchSize: sagas purged per transaction. Default DefaultSagaRetentionBatchSize
+	SagaRetentionPolicy struct {
+		MaxAge    time.Duration
+		States    []SagaState
+		Archive   bool
+		BatchSize int
+	}
+)
+
+const (
+	DefaultSagaRetentionBatchSize = 500
+)
+
+// StartRetention
+// Periodically purges the sagas older than the policy max age, in batches until there are none left.
+// Sagas being updated are skipped and purged on the next run, so retention jobs on several replicas
+// don't conflict.
+func (sagaManager *SagaManager) StartRetention(interval time.Duration, policy SagaRetentionPolicy) (err error) {
+
+	if sagaManager.retentionChan != nil {
+		return fmt.Errorf("retention already started for saga %s", sagaManager.SagaName)
+	}
+
+	if policy.MaxAge <= 0 {
+		return fmt.Errorf("invalid retention max age %s for saga %s", policy.MaxAge, sagaManager.SagaName)
+	}
+
+	if len(policy.States) == 0 {
+		policy.States = []SagaState{SagaStateCompleted}
+	}
+
+	for _, state := range policy.States {
+
+		if state != SagaStateCompleted && state != SagaStateFailed && state != SagaStateExpired {
+			return fmt.Errorf("invalid retention state %s for saga %s", state, sagaManager.SagaName)
+		}
+	}
+
+	if policy.BatchSize <= 0 {
+		policy.BatchSize = DefaultSagaRetentionBatchSize
+	}
+
+	retentionChan := make(chan bool)
+	sagaManager.retentionChan = retentionChan
+
+	go func() {
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				sagaManager.purgeSagas(policy)
+			case <-retentionChan:
+				return
+			}
+		}
+	}()
+
+	log.PrintfNoContext(sagaManager.AppID, "sagaManager", "Saga %s retention started. Interval %s, max age %s, states %s, archive %t",
+		sagaManager.SagaName, interval, policy.MaxAge, policy.States, policy.Archive)
+
+	return nil
+}
+
+// StopRetention
+// Stops the retention job, if started
+func (sagaManager *SagaManager) StopRetention() {
+
+	if sagaManager.retentionChan != nil {
+		close(sagaManager.retentionChan)
+		sagaManager.retentionChan = nil
+	}
+}
+
+// purgeSagas
+// Purges the sagas older than the max age in batches, until a batch is not full or fails
+func (sagaManager *SagaManager) purgeSagas(policy SagaRetentionPolicy) (total int, err error) {
+
+	correlationID, _ := uuid.NewV4()
+
+	ctx := appctx.NewContextFromValues(sagaManager.AppID, correlationID.String())
+
+	before := time.Now().UTC().Add(-policy.MaxAge).UnixNano()
+
+	for {
+
+		purged, err := sagaManager.sagaStore.PurgeSagas(ctx, sagaManager.SagaName, policy.States, before, policy.Archive, policy.BatchSize)
+
+		total += purged
+
+		if err != nil {
+			log.Errorf(ctx, "sagaManager", "Error purging sagas %s, %d purged, %s", sagaManager.SagaName, total, err)
+			return total, err
+		}
+
+		if purged < policy.BatchSize {
+			break
+		}
+	}
+
+	if total > 0 {
+		log.Printf(ctx, "sagaManager", "Saga %s retention purged %d sagas", sagaManager.SagaName, total)
+	}
+
+	return total, nil
+}
+
+// anyStateMatches
+// Returns true if the saga is in any of the states
+func anyStateMatches(states []SagaState, saga Saga) bool {
+
+	for _, state := range states {
+
+		if state.matches(saga) {
+			return true
+		}
+	}
+
+	return false
+}
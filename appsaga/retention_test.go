@@ -0,0 +1,199 @@
+package appsaga
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/HelloSundayMorning/apputils/db"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestSagaManager_PurgeSagas(t *testing.T) {
+
+	type testDef struct {
+		Policy   SagaRetentionPolicy
+		Purged   int
+		Archived int
+	}
+
+	Tests := []testDef{
+		{SagaRetentionPolicy{MaxAge: time.Hour, BatchSize: 2}, 0, 0},
+		{SagaRetentionPolicy{MaxAge: time.Millisecond, States: []SagaState{SagaStateCompleted}, BatchSize: 2}, 3, 0},
+		{SagaRetentionPolicy{MaxAge: time.Millisecond, States: []SagaState{SagaStateCompleted}, Archive: true, BatchSize: 1}, 3, 3},
+		{SagaRetentionPolicy{MaxAge: time.Millisecond, States: []SagaState{SagaStateCompleted, SagaStateExpired}, BatchSize: 10}, 4, 0},
+	}
+
+	for idx, test := range Tests {
+
+		store := NewMemorySagaStore()
+
+		manager, err := NewSagaManagerWithStore("testApp", store, SagaDefinition{SagaName: "testSaga", EventTypes: []string{"a", "b"}}, func(ctx context.Context, saga Saga) error {
+			return nil
+		})
+
+		assert.NoError(t, err)
+
+		ctx := appctx.NewContextFromValues("testApp", "correlationID")
+
+		for _, sagaKey := range []string{"key1", "key2", "key3", "open"} {
+
+			for _, eventType := range []string{"a", "b"} {
+
+				if sagaKey == "open" && eventType == "b" {
+					continue
+				}
+
+				_, err = manager.AddEvent(ctx, sagaKey, appevent.NewAppEvent(eventType, nil))
+
+				assert.NoError(t, err)
+			}
+		}
+
+		_, err = store.UpdateSaga(ctx, "testSaga", "open", func(saga *Saga) error {
+			saga.Expired = true
+			return nil
+		})
+
+		assert.NoError(t, err)
+
+		time.Sleep(5 * time.Millisecond)
+
+		purged, err := manager.purgeSagas(test.Policy)
+
+		assert.NoErrorf(t, err, "Failed test %d", idx)
+		assert.Equalf(t, test.Purged, purged, "Failed test %d", idx)
+		assert.Lenf(t, store.ArchivedSagas("testSaga"), test.Archived, "Failed test %d", idx)
+
+		sagas, err := manager.ListSagas(ctx, SagaQuery{})
+
+		assert.NoErrorf(t, err, "Failed test %d", idx)
+		assert.Lenf(t, sagas, 4-test.Purged, "Failed test %d", idx)
+	}
+}
+
+func TestSagaManager_StartRetention(t *testing.T) {
+
+	type testDef struct {
+		Policy SagaRetentionPolicy
+		HasErr bool
+	}
+
+	Tests := []testDef{
+		{SagaRetentionPolicy{}, true},
+		{SagaRetentionPolicy{MaxAge: time.Hour, States: []SagaState{SagaStateCompletionPending}}, true},
+		{SagaRetentionPolicy{MaxAge: time.Hour, States: []SagaState{SagaStateFailed}}, false},
+	}
+
+	for idx, test := range Tests {
+
+		manager := &SagaManager{AppID: "testApp", sagaStore: NewMemorySagaStore(), SagaName: "testSaga"}
+
+		err := manager.StartRetention(time.Hour, test.Policy)
+
+		assert.Equalf(t, test.HasErr, err != nil, "Failed test %d", idx)
+
+		manager.StopRetention()
+	}
+}
+
+func TestPostgresSagaStore_PurgeSagas(t *testing.T) {
+
+	type testDef struct {
+		States    []SagaState
+		Archive   bool
+		Statement string
+		Args      int
+	}
+
+	Tests := []testDef{
+		{[]SagaState{SagaStateCompleted}, false, `DELETE FROM saga_manager WHERE \(saga_name, saga_key\) IN .*completed = true AND completion_pending = false`, 3},
+		{[]SagaState{SagaStateCompleted, SagaStateExpired}, false, `\(completed = true .*\) OR \(expired = true\)`, 3},
+		{[]SagaState{SagaStateExpired}, true, `WITH purged AS \(DELETE FROM saga_manager .*expired = true.* INSERT INTO saga_manager_archive`, 4},
+	}
+
+	for idx, test := range Tests {
+
+		mockDb, mock, err := db.NewMockDB()
+
+		assert.NoError(t, err)
+
+		args := []driver.Value{"testSaga", int64(10), 100}
+
+		if test.Args == 4 {
+			args = append(args, sqlmock.AnyArg())
+		}
+
+		mock.ExpectExec(test.Statement).WithArgs(args...).WillReturnResult(sqlmock.NewResult(0, 7))
+
+		purged, err := NewPostgresSagaStore(mockDb).PurgeSagas(context.Background(), "testSaga", test.States, 10, test.Archive, 100)
+
+		assert.NoErrorf(t, err, "Failed test %d", idx)
+		assert.Equalf(t, 7, purged, "Failed test %d", idx)
+		assert.NoErrorf(t, mock.ExpectationsWereMet(), "Failed test %d", idx)
+	}
+}
+
+func TestPostgresSagaStore_Upgrade(t *testing.T) {
+
+	migrations, err := db.LoadMigrations(sagaMigrations, "migrations")
+
+	assert.NoError(t, err)
+
+	mockDb, mock, err := db.NewMockDB()
+
+	assert.NoError(t, err)
+
+	// the upgrade holds one connection at a time
+	mockDb.GetDB().SetMaxOpenConns(1)
+
+	// the migrations are applied, Initialize has nothing to do
+	rows := sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"})
+
+	for _, migration := range migrations {
+		rows.AddRow(migration.Version, migration.Name, migration.Checksum(), time.Now())
+	}
+
+	mock.ExpectQuery("pg_try_advisory_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery("to_regclass").WithArgs(sagaMigrationsTable).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(`FROM "saga_manager_migrations"`).WillReturnRows(rows)
+	mock.ExpectExec("pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// the indexes and jsonb conversion run under the migrations lock, on another connection
+	mock.ExpectQuery("pg_try_advisory_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectExec("SET lock_timeout").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	for _, index := range sagaStorageIndexes {
+
+		// an invalid index left by a failed build is dropped and built again
+		invalid := 0
+
+		if index.Name == "saga_manager_state_timestamp_idx" {
+			invalid = 1
+		}
+
+		mock.ExpectQuery("pg_index").WithArgs(index.Name).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(invalid))
+
+		if invalid > 0 {
+			mock.ExpectExec("DROP INDEX CONCURRENTLY IF EXISTS " + index.Name).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+
+		mock.ExpectExec("CREATE INDEX CONCURRENTLY IF NOT EXISTS " + index.Name).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("pg_index").WithArgs(index.Name).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	}
+
+	mock.ExpectQuery("information_schema.columns").WillReturnRows(sqlmock.NewRows([]string{"column_name"}).AddRow("events"))
+	mock.ExpectExec("ALTER COLUMN events TYPE jsonb").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	mock.ExpectExec("RESET lock_timeout").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err = NewPostgresSagaStore(mockDb).Upgrade(context.Background())
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,73 @@
+package appsaga
+
+import (
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/HelloSundayMorning/apputils/db"
+	"golang.org/x/net/context"
+)
+
+type (
+	// SagaUpdate
+	// Changes the saga. Returning an error discards the changes.
+	SagaUpdate func(saga *Saga) (err error)
+
+	// SagaTxUpdate
+	// Changes the saga in the transaction that stores it. The tx is nil if the store has no transactions.
+	SagaTxUpdate func(tx db.AppSqlTx, saga *Saga) (err error)
+
+	// SagaStore
+	// Storage of the sagas of a SagaManager. Concurrent updates of the same saga run one after
+	// the other, or fail with SagaConflict or a serialization error and are retried by the manager.
+	// The updates return the saga as seen by the update, also when it failed.
+	SagaStore interface {
+		// Initialize creates the storage of the sagas, or upgrades it to the version of the store
+		Initialize(ctx context.Context) (err error)
+
+		// UpdateSaga stores the saga after the update, SagaConflict if it was changed concurrently.
+		// A saga not stored yet is passed to the update with an empty SagaName
+		UpdateSaga(ctx context.Context, sagaName, sagaKey string, update SagaUpdate) (saga Saga, err error)
+
+		// UpdatePendingSaga locks the saga pending completion and stores it after the update, in the
+		// transaction passed to the update. SagaNotFound if it's not pending, or is locked by other update
+		UpdatePendingSaga(ctx context.Context, sagaName, sagaKey string, update SagaTxUpdate) (saga Saga, err error)
+
+		// UpdateNextExpiredSaga locks the saga with the earliest deadline before now that is not
+		// completed nor expired, skipping the locked ones and the skipped keys, and stores it after the update.
+		// SagaNotFound if there is none
+		UpdateNextExpiredSaga(ctx context.Context, sagaName string, now int64, skipKeys []string, update SagaUpdate) (saga Saga, err error)
+
+		// FindDuePendingSagaKeys returns the keys of the sagas pending completion with the next
+		// attempt due before now, the earliest first
+		FindDuePendingSagaKeys(ctx context.Context, sagaName string, now int64) (sagaKeys []string, err error)
+
+		// GetSaga returns the saga, SagaNotFound if it's not stored
+		GetSaga(ctx context.Context, sagaName, sagaKey string) (saga Saga, err error)
+
+		// ListSagas returns the sagas matching the query, ordered by start
+		ListSagas(ctx context.Context, sagaName string, query SagaQuery) (sagas []Saga, err error)
+
+		// DeleteSaga deletes the saga, SagaNotFound if it's not stored
+		DeleteSaga(ctx context.Context, sagaName, sagaKey string) (err error)
+
+		// PurgeSagas deletes up to limit sagas in any of the states last changed before the timestamp,
+		// the oldest first, skipping the locked ones. If archive is set they are copied to the archive
+		PurgeSagas(ctx context.Context, sagaName string, states []SagaState, before int64, archive bool, limit int) (purged int, err error)
+	}
+)
+
+// copySaga
+// Returns a copy of the saga not sharing its events
+func copySaga(saga Saga) Saga {
+
+	events := make(map[string]appevent.AppEvent, len(saga.Events))
+
+	for eventType, event := range saga.Events {
+		events[eventType] = event
+	}
+
+	saga.Events = events
+	saga.History = append([]appevent.AppEvent{}, saga.History...)
+	saga.EventTypes = append([]string{}, saga.EventTypes...)
+
+	return saga
+}
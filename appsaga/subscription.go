@@ -0,0 +1,193 @@
+package appsaga
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/HelloSundayMorning/apputils/eventpubsub"
+	"github.com/HelloSundayMorning/apputils/log"
+	"golang.org/x/net/context"
+)
+
+type (
+	// SagaKeyExtractor
+	// Returns the key of the saga the event belongs to
+	SagaKeyExtractor func(ctx context.Context, appEvent appevent.AppEvent) (sagaKey string, err error)
+
+	// SagaEventBinding
+	// Adds the events of the type published to the topic to the saga with the extracted key
+	SagaEventBinding struct {
+		Topic     string
+		EventType string
+		SagaKey   SagaKeyExtractor
+	}
+)
+
+// KeyFromField
+// Extracts the saga key from a top level field of the event data, ie. KeyFromField("UserID")
+func KeyFromField(field string) SagaKeyExtractor {
+
+	return func(ctx context.Context, appEvent appevent.AppEvent) (sagaKey string, err error) {
+
+		var data map[string]json.RawMessage
+
+		err = json.Unmarshal(appEvent.Data, &data)
+
+		if err != nil {
+			return "", fmt.Errorf("error reading saga key field %s of event type %s, %s", field, appEvent.EventType, err)
+		}
+
+		value, ok := data[field]
+
+		if !ok {
+			return "", fmt.Errorf("saga key field %s missing in event type %s", field, appEvent.EventType)
+		}
+
+		// strings are unquoted, numbers are used as written
+		err = json.Unmarshal(value, &sagaKey)
+
+		if err != nil {
+			sagaKey = string(value)
+		}
+
+		if sagaKey == "" || sagaKey == "null" {
+			return "", fmt.Errorf("saga key field %s empty in event type %s", field, appEvent.EventType)
+		}
+
+		return sagaKey, nil
+	}
+}
+
+// Subscribe
+// Binds the queue to the topics of the bindings and adds their events to the sagas.
+// Events of types not bound are acknowledged and ignored. Events that can't be decoded, have no
+// saga key, or fail to be added are nacked, so they are redelivered and then dead-lettered.
+// A failing completed handler doesn't nack the event, the saga stays pending completion and
+// the handler is retried by the completion retrier, see StartCompletionRetrier. If not started
+// the retrier is started with DefaultCompletionRetrierInterval.
+// The pubSub must implement eventpubsub.QueueSubscriber.
+func (sagaManager *SagaManager) Subscribe(pubSub eventpubsub.EventPubSub, queue string, maxMessages int, bindings ...SagaEventBinding) (err error) {
+
+	if len(bindings) == 0 {
+		return fmt.Errorf("no event bindings to subscribe saga %s", sagaManager.SagaName)
+	}
+
+	queueSubscriber, ok := pubSub.(eventpubsub.QueueSubscriber)
+
+	if !ok {
+		return fmt.Errorf("event pubsub %T can't subscribe saga %s to a multi topic queue", pubSub, sagaManager.SagaName)
+	}
+
+	var topics []string
+
+	for _, binding := range bindings {
+
+		if !sagaManager.isValidEvent(appevent.AppEvent{EventType: binding.EventType}) {
+			return fmt.Errorf("invalid event type %s bound to saga %s", binding.EventType, sagaManager.SagaName)
+		}
+
+		if binding.SagaKey == nil {
+			return fmt.Errorf("no saga key extractor for event type %s bound to saga %s", binding.EventType, sagaManager.SagaName)
+		}
+
+		if !containsString(topics, binding.Topic) {
+			topics = append(topics, binding.Topic)
+		}
+	}
+
+	err = queueSubscriber.InitializeMultiTopicQueue(queue, topics...)
+
+	if err != nil {
+		return fmt.Errorf("error initializing queue %s of saga %s, %s", queue, sagaManager.SagaName, err)
+	}
+
+	if sagaManager.retrierChan == nil {
+
+		err = sagaManager.StartCompletionRetrier(DefaultCompletionRetrierInterval)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = queueSubscriber.SubscribeToQueue(queue, sagaManager.processEventFunc(bindings), maxMessages)
+
+	if err != nil {
+		return fmt.Errorf("error subscribing saga %s to queue %s, %s", sagaManager.SagaName, queue, err)
+	}
+
+	log.PrintfNoContext(sagaManager.AppID, "sagaManager", "Saga %s subscribed to queue %s for topics %s", sagaManager.SagaName, queue, topics)
+
+	return nil
+}
+
+func (sagaManager *SagaManager) processEventFunc(bindings []SagaEventBinding) eventpubsub.ProcessEvent {
+
+	return func(ctx context.Context, event []byte, contentType string) error {
+
+		appEvent, err := appevent.NewAppEventFromJSON(event)
+
+		if err != nil {
+			return err
+		}
+
+		binding, ok := findBinding(bindings, appctx.GetSourceTopic(ctx), appEvent.EventType)
+
+		if !ok {
+			log.Printf(ctx, "sagaManager", "Saga %s has no binding for event type %s. Ignoring event.", sagaManager.SagaName, appEvent.EventType)
+			return nil
+		}
+
+		sagaKey, err := binding.SagaKey(ctx, appEvent)
+
+		if err != nil {
+			return err
+		}
+
+		saga, err := sagaManager.recordEvent(ctx, sagaKey, appEvent)
+
+		if err != nil {
+			return err
+		}
+
+		if !saga.CompletionPending {
+			return nil
+		}
+
+		_, err = sagaManager.runCompletion(ctx, sagaKey, false)
+
+		if err != nil {
+			log.Errorf(ctx, "sagaManager", "Saga %s key %s completed handler failed. Completion is pending, %s", sagaManager.SagaName, sagaKey, err)
+		}
+
+		return nil
+	}
+}
+
+// findBinding
+// Returns the binding of the event type on the topic. Without source topic any binding of the event type
+func findBinding(bindings []SagaEventBinding, topic, eventType string) (binding SagaEventBinding, ok bool) {
+
+	for _, binding := range bindings {
+
+		if binding.EventType == eventType && (topic == "" || binding.Topic == topic) {
+			return binding, true
+		}
+	}
+
+	return binding, false
+}
+
+func containsString(values []string, value string) bool {
+
+	for _, v := range values {
+
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,100 @@
+package appsaga
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/HelloSundayMorning/apputils/eventpubsub/testkit"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestKeyFromField(t *testing.T) {
+
+	type testDef struct {
+		Data   string
+		Key    string
+		HasErr bool
+	}
+
+	Tests := []testDef{
+		{`{"UserID":"user1"}`, "user1", false},
+		{`{"UserID":42}`, "42", false},
+		{`{"UserID":""}`, "", true},
+		{`{"UserID":null}`, "", true},
+		{`{"Other":"user1"}`, "", true},
+		{`[]`, "", true},
+	}
+
+	for idx, test := range Tests {
+
+		key, err := KeyFromField("UserID")(context.Background(), appevent.NewAppEvent("a", []byte(test.Data)))
+
+		assert.Equalf(t, test.Key, key, "Failed test %d", idx)
+		assert.Equalf(t, test.HasErr, err != nil, "Failed test %d", idx)
+	}
+}
+
+func TestSagaManager_Subscribe(t *testing.T) {
+
+	handlerErr := errors.New("failed")
+
+	var handled []Saga
+
+	manager, err := NewSagaManagerWithStore("testApp", NewMemorySagaStore(), SagaDefinition{SagaName: "testSaga", EventTypes: []string{"a", "b"}}, func(ctx context.Context, saga Saga) error {
+		handled = append(handled, saga)
+		return handlerErr
+	})
+
+	assert.NoError(t, err)
+
+	recorder := testkit.NewRecorder("testApp")
+
+	err = manager.Subscribe(recorder, "testApp.testSaga", 1,
+		SagaEventBinding{Topic: "topicA", EventType: "a", SagaKey: KeyFromField("UserID")},
+		SagaEventBinding{Topic: "topicB", EventType: "b", SagaKey: KeyFromField("Owner")},
+	)
+
+	assert.NoError(t, err)
+	assert.NotNil(t, manager.retrierChan)
+
+	defer manager.StopCompletionRetrier()
+
+	err = manager.Subscribe(recorder, "testApp.testSaga", 1, SagaEventBinding{Topic: "topicC", EventType: "c", SagaKey: KeyFromField("UserID")})
+
+	assert.Error(t, err)
+
+	type testDef struct {
+		Topic   string
+		Event   string
+		HasErr  bool
+		Handled int
+	}
+
+	Tests := []testDef{
+		{"topicA", `not json`, true, 0},
+		{"topicA", `{"EventType":"a","Data":{"Owner":"user1"}}`, true, 0},
+		{"topicA", `{"EventType":"b","Data":{"UserID":"user1"}}`, false, 0},
+		{"topicA", `{"EventType":"a","Data":{"UserID":"user1"}}`, false, 0},
+		{"topicB", `{"EventType":"b","Data":{"Owner":"user1"}}`, false, 1},
+		{"topicB", `{"EventType":"b","Data":{"Owner":"user1"}}`, false, 2},
+	}
+
+	for idx, test := range Tests {
+
+		ctx := appctx.NewContextFromValues("testApp", "correlationID")
+
+		err = recorder.Deliver(ctx, test.Topic, []byte(test.Event), "application/json")
+
+		assert.Equalf(t, test.HasErr, err != nil, "Failed test %d", idx)
+		assert.Lenf(t, handled, test.Handled, "Failed test %d", idx)
+	}
+
+	saga, err := manager.GetSaga(context.Background(), "user1")
+
+	assert.NoError(t, err)
+	assert.True(t, saga.CompletionPending)
+	assert.Len(t, saga.History, 2)
+}
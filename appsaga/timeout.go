@@ -0,0 +1,156 @@
+package appsaga
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/HelloSundayMorning/apputils/log"
+	"github.com/gofrs/uuid"
+	"golang.org/x/net/context"
+)
+
+// SetTimeout
+// Sets the deadline of new sagas, measured from their first event, and the handler called
+// by the timeout sweeper with the partial saga when it doesn't complete in time.
+// Sagas started before the timeout was set have no deadline.
+func (sagaManager *SagaManager) SetTimeout(timeout time.Duration, timeoutHandler SagaTimeoutHandler) {
+
+	sagaManager.timeout = timeout
+	sagaManager.timeoutHandler = timeoutHandler
+
+	log.PrintfNoContext(sagaManager.AppID, "sagaManager", "Saga %s timeout set to %s", sagaManager.SagaName, timeout)
+}
+
+// SetExpiredEventHandler
+// Routes the events added to an expired saga to the handler. Without handler the events are ignored.
+func (sagaManager *SagaManager) SetExpiredEventHandler(expiredHandler SagaExpiredEventHandler) {
+
+	sagaManager.expiredHandler = expiredHandler
+}
+
+// StartTimeoutSweeper
+// Periodically marks the sagas past their deadline as expired and calls the timeout handler.
+// Each expired saga is locked while handled, so sweepers on several replicas don't handle it twice.
+// If the handler fails the saga is not marked and is handled again on the next sweep, the sweep
+// goes on with the other expired sagas.
+func (sagaManager *SagaManager) StartTimeoutSweeper(interval time.Duration) (err error) {
+
+	if sagaManager.sweeperChan != nil {
+		return fmt.Errorf("timeout sweeper already started for saga %s", sagaManager.SagaName)
+	}
+
+	sweeperChan := make(chan bool)
+	sagaManager.sweeperChan = sweeperChan
+
+	go func() {
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				sagaManager.sweepExpired()
+			case <-sweeperChan:
+				return
+			}
+		}
+	}()
+
+	log.PrintfNoContext(sagaManager.AppID, "sagaManager", "Saga %s timeout sweeper started. Interval %s", sagaManager.SagaName, interval)
+
+	return nil
+}
+
+// StopTimeoutSweeper
+// Stops the timeout sweeper, if started
+func (sagaManager *SagaManager) StopTimeoutSweeper() {
+
+	if sagaManager.sweeperChan != nil {
+		close(sagaManager.sweeperChan)
+		sagaManager.sweeperChan = nil
+	}
+}
+
+// sweepExpired
+// Handles the expired sagas until there are none left. The sagas failing are skipped until the next sweep
+func (sagaManager *SagaManager) sweepExpired() {
+
+	var failedKeys []string
+
+	for {
+
+		expired, sagaKey, err := sagaManager.expireNext(failedKeys)
+
+		if err != nil && sagaKey == "" {
+			log.ErrorfNoContext(sagaManager.AppID, "sagaManager", "Error sweeping expired sagas %s, %s", sagaManager.SagaName, err)
+			return
+		}
+
+		if err != nil {
+			log.ErrorfNoContext(sagaManager.AppID, "sagaManager", "Error sweeping expired saga %s key %s. Retrying on the next sweep, %s", sagaManager.SagaName, sagaKey, err)
+			failedKeys = append(failedKeys, sagaKey)
+			continue
+		}
+
+		if !expired {
+			return
+		}
+	}
+}
+
+// expireNext
+// Locks the next expired saga not skipped, calls the timeout handler and marks it expired in the same transaction.
+// Returns the key of the saga handled, empty if the error happened before
+func (sagaManager *SagaManager) expireNext(skipKeys []string) (expired bool, sagaKey string, err error) {
+
+	correlationID, _ := uuid.NewV4()
+
+	ctx := appctx.NewContextFromValues(sagaManager.AppID, correlationID.String())
+
+	_, err = sagaManager.sagaStore.UpdateNextExpiredSaga(ctx, sagaManager.SagaName, time.Now().UTC().UnixNano(), skipKeys, func(saga *Saga) error {
+
+		sagaKey = saga.SagaKey
+		saga.Expired = true
+
+		log.Printf(ctx, "sagaManager", "Saga %s key %s expired. Handling timeout...", saga.SagaName, saga.SagaKey)
+
+		if sagaManager.timeoutHandler == nil {
+			return nil
+		}
+
+		err := sagaManager.timeoutHandler(ctx, *saga)
+
+		if err != nil {
+			return fmt.Errorf("error handling timeout of saga %s key %s, %s", saga.SagaName, saga.SagaKey, err)
+		}
+
+		return nil
+	})
+
+	if err == SagaNotFound {
+		return false, "", nil
+	}
+
+	if err != nil {
+		return false, sagaKey, err
+	}
+
+	return true, sagaKey, nil
+}
+
+// handleExpiredEvent
+// Routes an event added to an expired saga to the expired event handler, or ignores it
+func (sagaManager *SagaManager) handleExpiredEvent(ctx context.Context, saga Saga, appEvent appevent.AppEvent) (err error) {
+
+	if sagaManager.expiredHandler == nil {
+		log.Printf(ctx, "sagaManager", "Saga %s key %s expired previously. Ignoring event type %s.", saga.SagaName, saga.SagaKey, appEvent.EventType)
+		return nil
+	}
+
+	log.Printf(ctx, "sagaManager", "Saga %s key %s expired previously. Routing event type %s to expired event handler.", saga.SagaName, saga.SagaKey, appEvent.EventType)
+
+	return sagaManager.expiredHandler(ctx, saga, appEvent)
+}
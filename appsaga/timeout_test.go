@@ -0,0 +1,129 @@
+package appsaga
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/HelloSundayMorning/apputils/db"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+var sagaRowColumns = []string{"saga_name", "saga_key", "timestamp", "events", "event_types", "completed", "started_at", "expires_at", "expired",
+	"history", "completion_pending", "completion_attempts", "completion_error", "next_attempt_at", "failed", "version"}
+
+func TestSagaManager_ExpireNext(t *testing.T) {
+
+	type testDef struct {
+		Found      bool
+		HandlerErr error
+		Expired    bool
+		HasErr     bool
+	}
+
+	Tests := []testDef{
+		{false, nil, false, false},
+		{true, nil, true, false},
+		{true, errors.New("failed"), false, true},
+	}
+
+	for idx, test := range Tests {
+
+		mockDb, mock, err := db.NewMockDB()
+
+		assert.NoError(t, err)
+
+		var handled []Saga
+
+		manager := &SagaManager{AppID: "testApp", sagaStore: NewPostgresSagaStore(mockDb), SagaName: "testSaga", EventTypes: []string{"a", "b"}}
+
+		manager.SetTimeout(time.Minute, func(ctx context.Context, saga Saga) error {
+			handled = append(handled, saga)
+			return test.HandlerErr
+		})
+
+		rows := sqlmock.NewRows(sagaRowColumns)
+
+		if test.Found {
+			rows.AddRow("testSaga", "key1", 1, []byte(`{"a":{"EventType":"a"}}`), "{a,b}", false, 1, 2, false,
+				[]byte("[]"), false, 0, "", 0, false, 1)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("FOR UPDATE SKIP LOCKED").WithArgs("testSaga", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnRows(rows)
+
+		if test.Found && test.HandlerErr == nil {
+			mock.ExpectExec("UPDATE saga_manager SET").WithArgs("testSaga", "key1", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), false, sqlmock.AnyArg(), sqlmock.AnyArg(), true,
+				sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), int64(1)).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+		} else {
+			mock.ExpectRollback()
+		}
+
+		expired, sagaKey, err := manager.expireNext(nil)
+
+		assert.Equalf(t, test.Expired, expired, "Failed test %d", idx)
+		assert.Equalf(t, test.HasErr, err != nil, "Failed test %d", idx)
+		assert.Equalf(t, test.Found, sagaKey == "key1", "Failed test %d", idx)
+		assert.NoErrorf(t, mock.ExpectationsWereMet(), "Failed test %d", idx)
+
+		if test.Found {
+			assert.Lenf(t, handled, 1, "Failed test %d", idx)
+			assert.Truef(t, handled[0].Expired, "Failed test %d", idx)
+			assert.Containsf(t, handled[0].Events, "a", "Failed test %d", idx)
+		}
+	}
+}
+
+func TestSagaManager_SweepExpiredSkipsFailed(t *testing.T) {
+
+	manager, err := NewSagaManagerWithStore("testApp", NewMemorySagaStore(), SagaDefinition{SagaName: "testSaga", EventTypes: []string{"a", "b"}}, func(ctx context.Context, saga Saga) error {
+		return nil
+	})
+
+	assert.NoError(t, err)
+
+	var handled []string
+
+	// the earliest saga keeps failing, it doesn't block the other
+	manager.SetTimeout(10*time.Millisecond, func(ctx context.Context, saga Saga) error {
+
+		handled = append(handled, saga.SagaKey)
+
+		if saga.SagaKey == "failing" {
+			return errors.New("failed")
+		}
+
+		return nil
+	})
+
+	ctx := appctx.NewContextFromValues("testApp", "correlationID")
+
+	for _, sagaKey := range []string{"failing", "other"} {
+
+		_, err = manager.AddEvent(ctx, sagaKey, appevent.NewAppEvent("a", nil))
+
+		assert.NoError(t, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	manager.sweepExpired()
+
+	assert.Equal(t, []string{"failing", "other"}, handled)
+
+	expired, err := manager.ListSagas(ctx, SagaQuery{State: SagaStateExpired})
+
+	assert.NoError(t, err)
+	assert.Len(t, expired, 1)
+	assert.Equal(t, "other", expired[0].SagaKey)
+
+	// retried on the next sweep
+	manager.sweepExpired()
+
+	assert.Equal(t, []string{"failing", "other", "failing"}, handled)
+}
@@ -0,0 +1,270 @@
+// dbmigrate
+// Command line tool to apply the versioned SQL migrations of an app, see db.Migrator.
+//
+// Usage:
+//
+//	dbmigrate <command> [flags]
+//
+// Commands:
+//
+//	up      apply the pending migrations
+//	down    roll back the migrations after a version
+//	status  show the applied and pending migrations
+//
+// The migrations are read from the -dir directory, named <version>_<name>.up.sql and .down.sql.
+// up and down print the migrations without running them with -dry-run.
+// The Postgres connection is set by the -db-host, -db-port, -db-user, -db-password, -db-name, -db-sslmode
+// and -db-sslrootcert flags, defaulting to the POSTGRES_HOST, POSTGRES_PORT, POSTGRES_USER, POSTGRES_PASSWORD,
+// POSTGRES_DB, POSTGRES_SSLMODE and POSTGRES_SSLROOTCERT env variables.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/app"
+	"github.com/HelloSundayMorning/apputils/db"
+	"golang.org/x/net/context"
+)
+
+type (
+	command struct {
+		description string
+		run         func(args []string) (err error)
+	}
+
+	migratorFlags struct {
+		dir         *string
+		table       *string
+		host        *string
+		port        *string
+		user        *string
+		pw          *string
+		name        *string
+		sslMode     *string
+		sslRootCert *string
+	}
+)
+
+const (
+	cliAppID = app.ApplicationID("dbmigrate")
+)
+
+var (
+	commands = map[string]command{
+		"up":     {"apply the pending migrations", up},
+		"down":   {"roll back the migrations after a version", down},
+		"status": {"show the applied and pending migrations", status},
+	}
+
+	commandOrder = []string{"up", "down", "status"}
+)
+
+func main() {
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	err := cmd.run(os.Args[2:])
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+
+	fmt.Fprintf(os.Stderr, "Usage: dbmigrate <command> [flags]\n\nCommands:\n")
+
+	for _, name := range commandOrder {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].description)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nRun dbmigrate <command> -h for the command flags\n")
+}
+
+func newFlagSet(name string) (flags *flag.FlagSet, migrator migratorFlags) {
+
+	flags = flag.NewFlagSet(name, flag.ExitOnError)
+
+	migrator = migratorFlags{
+		dir:         flags.String("dir", "migrations", "directory of the migration files"),
+		table:       flags.String("table", db.DefaultMigrationsTable, "table recording the applied migrations"),
+		host:        flags.String("db-host", envOrDefault(db.PostgresHostEnv, "localhost"), "Postgres host"),
+		port:        flags.String("db-port", envOrDefault(db.PostgresPortEnv, "5432"), "Postgres port"),
+		user:        flags.String("db-user", os.Getenv(db.PostgresUserEnv), "Postgres user"),
+		pw:          flags.String("db-password", os.Getenv(db.PostgresPasswordEnv), "Postgres password"),
+		name:        flags.String("db-name", os.Getenv(db.PostgresDBEnv), "Postgres database"),
+		sslMode:     flags.String("db-sslmode", envOrDefault(db.PostgresSSLModeEnv, db.SSLModeDisable), "Postgres SSL mode, disable | require | verify-ca | verify-full"),
+		sslRootCert: flags.String("db-sslrootcert", os.Getenv(db.PostgresSSLRootCertEnv), "file of the CA verifying the Postgres server"),
+	}
+
+	return flags, migrator
+}
+
+func (flags migratorFlags) connect() (migrator *db.Migrator, pgDb *db.PostgresDB, err error) {
+
+	pgDb, err = db.NewPostgresDBWithOptions(context.Background(), cliAppID, db.PostgresOptions{
+		Host:         *flags.host,
+		Port:         *flags.port,
+		User:         *flags.user,
+		Password:     *flags.pw,
+		DBName:       *flags.name,
+		SSLMode:      *flags.sslMode,
+		SSLRootCert:  *flags.sslRootCert,
+		PingAttempts: 1,
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	migrator, err = db.NewMigratorFromFS(pgDb, os.DirFS(*flags.dir), ".")
+
+	if err != nil {
+		_ = pgDb.Close()
+		return nil, nil, err
+	}
+
+	migrator.SetTable(*flags.table)
+
+	return migrator, pgDb, nil
+}
+
+func up(args []string) (err error) {
+
+	flags, migratorFlags := newFlagSet("up")
+	dryRun := flags.Bool("dry-run", false, "print the pending migrations without applying them")
+
+	_ = flags.Parse(args)
+
+	migrator, pgDb, err := migratorFlags.connect()
+
+	if err != nil {
+		return err
+	}
+
+	defer pgDb.Close()
+
+	migrations, err := migrator.Up(context.Background(), db.MigrateOptions{DryRun: *dryRun})
+
+	printMigrations(migrations, *dryRun, "apply", "Applied")
+
+	return err
+}
+
+func down(args []string) (err error) {
+
+	flags, migratorFlags := newFlagSet("down")
+	version := flags.Int64("version", -1, "version to roll back to, 0 rolls back all the migrations (required)")
+	dryRun := flags.Bool("dry-run", false, "print the migrations to roll back without running them")
+
+	_ = flags.Parse(args)
+
+	if *version < 0 {
+		return fmt.Errorf("-version is required")
+	}
+
+	migrator, pgDb, err := migratorFlags.connect()
+
+	if err != nil {
+		return err
+	}
+
+	defer pgDb.Close()
+
+	migrations, err := migrator.Down(context.Background(), *version, db.MigrateOptions{DryRun: *dryRun})
+
+	printMigrations(migrations, *dryRun, "roll back", "Rolled back")
+
+	return err
+}
+
+func status(args []string) (err error) {
+
+	flags, migratorFlags := newFlagSet("status")
+
+	_ = flags.Parse(args)
+
+	migrator, pgDb, err := migratorFlags.connect()
+
+	if err != nil {
+		return err
+	}
+
+	defer pgDb.Close()
+
+	statuses, err := migrator.Status(context.Background())
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-10s %-40s %-10s %s\n", "VERSION", "NAME", "STATE", "APPLIED AT")
+
+	for _, status := range statuses {
+
+		state := "pending"
+		appliedAt := ""
+
+		if status.Applied {
+			state = "applied"
+			appliedAt = status.AppliedAt.Format(time.RFC3339)
+		}
+
+		if status.Modified {
+			state = "modified"
+		}
+
+		if status.Unknown {
+			state = "unknown"
+		}
+
+		fmt.Printf("%-10d %-40s %-10s %s\n", status.Version, status.Name, state, appliedAt)
+	}
+
+	return nil
+}
+
+// printMigrations
+// Prints the migrations run, or that would run on a dry run
+func printMigrations(migrations []db.Migration, dryRun bool, action, done string) {
+
+	if len(migrations) == 0 {
+		fmt.Printf("No migrations to %s\n", action)
+		return
+	}
+
+	for _, migration := range migrations {
+
+		if dryRun {
+			fmt.Printf("Would %s %d %s\n", action, migration.Version, migration.Name)
+			continue
+		}
+
+		fmt.Printf("%s %d %s\n", done, migration.Version, migration.Name)
+	}
+}
+
+func envOrDefault(name, defaultValue string) string {
+
+	value := os.Getenv(name)
+
+	if value == "" {
+		return defaultValue
+	}
+
+	return value
+}
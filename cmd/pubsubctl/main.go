@@ -0,0 +1,435 @@
+// pubsubctl
+// Command line tool to manage the topics, queues and events of apps using the eventpubsub package.
+//
+// Usage:
+//
+// 		pubsubctl <command> [flags]
+//
+// Commands:
+//
+// 		register-topic  declare the topic exchange
+// 		init-queue      declare the app queue and dead letter queue for a topic
+// 		publish         publish an AppEvent to a topic
+// 		tail            print the events published to a topic
+// 		queues          show the depth and consumers of the app queues for a topic
+//
+// The RabbitMQ connection is set by the -mq-user, -mq-password and -mq-host flags,
+// defaulting to the RABBITMQ_USER, RABBITMQ_PASSWORD and RABBITMQ_HOST env variables.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/app"
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/HelloSundayMorning/apputils/eventpubsub"
+	"github.com/gofrs/uuid"
+	"github.com/streadway/amqp"
+)
+
+type (
+	command struct {
+		description string
+		run         func(args []string) (err error)
+	}
+
+	connectionFlags struct {
+		user *string
+		pw   *string
+		host *string
+	}
+)
+
+const (
+	cliAppID = app.ApplicationID("pubsubctl")
+)
+
+var (
+	commands = map[string]command{
+		"register-topic": {"declare the topic exchange", registerTopic},
+		"init-queue":     {"declare the app queue and dead letter queue for a topic", initQueue},
+		"publish":        {"publish an AppEvent to a topic", publish},
+		"tail":           {"print the events published to a topic", tail},
+		"queues":         {"show the depth and consumers of the app queues for a topic", queues},
+	}
+
+	commandOrder = []string{"register-topic", "init-queue", "publish", "tail", "queues"}
+)
+
+func main() {
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	err := cmd.run(os.Args[2:])
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+
+	fmt.Fprintf(os.Stderr, "Usage: pubsubctl <command> [flags]\n\nCommands:\n")
+
+	for _, name := range commandOrder {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, commands[name].description)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nRun pubsubctl <command> -h for the command flags\n")
+}
+
+func newFlagSet(name string) (flags *flag.FlagSet, conn connectionFlags) {
+
+	flags = flag.NewFlagSet(name, flag.ExitOnError)
+
+	conn = connectionFlags{
+		user: flags.String("mq-user", os.Getenv("RABBITMQ_USER"), "RabbitMQ user"),
+		pw:   flags.String("mq-password", os.Getenv("RABBITMQ_PASSWORD"), "RabbitMQ password"),
+		host: flags.String("mq-host", envOrDefault("RABBITMQ_HOST", "localhost"), "RabbitMQ host"),
+	}
+
+	return flags, conn
+}
+
+func (conn connectionFlags) connect(appID app.ApplicationID) (rabbit *eventpubsub.RabbitMq, err error) {
+
+	return eventpubsub.NewRabbitMq(appID, *conn.user, *conn.pw, *conn.host)
+}
+
+func registerTopic(args []string) (err error) {
+
+	flags, conn := newFlagSet("register-topic")
+	topic := flags.String("topic", "", "topic name (required)")
+
+	_ = flags.Parse(args)
+
+	if *topic == "" {
+		return fmt.Errorf("-topic is required")
+	}
+
+	rabbit, err := conn.connect(cliAppID)
+
+	if err != nil {
+		return err
+	}
+
+	defer closeConnection(rabbit)
+
+	return rabbit.RegisterTopic(*topic)
+}
+
+func initQueue(args []string) (err error) {
+
+	flags, conn := newFlagSet("init-queue")
+	appID := flags.String("app", "", "app ID owning the queue (required)")
+	topic := flags.String("topic", "", "topic name (required)")
+
+	_ = flags.Parse(args)
+
+	if *appID == "" || *topic == "" {
+		return fmt.Errorf("-app and -topic are required")
+	}
+
+	rabbit, err := conn.connect(app.ApplicationID(*appID))
+
+	if err != nil {
+		return err
+	}
+
+	defer closeConnection(rabbit)
+
+	err = rabbit.InitializeQueue(*topic)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Initialized queues %s and %s\n", eventpubsub.QueueName(app.ApplicationID(*appID), *topic), eventpubsub.DeadLetterQueueName(app.ApplicationID(*appID), *topic))
+
+	return nil
+}
+
+func publish(args []string) (err error) {
+
+	flags, conn := newFlagSet("publish")
+	appID := flags.String("app", string(cliAppID), "app ID publishing the event")
+	topic := flags.String("topic", "", "topic name (required)")
+	file := flags.String("file", "", "file with the AppEvent JSON. Use - for stdin")
+	eventType := flags.String("type", "", "event type, when not publishing from a file")
+	version := flags.Int("version", 0, "event version, when not publishing from a file")
+	data := flags.String("data", "{}", "event data JSON, when not publishing from a file")
+	correlationID := flags.String("correlation-id", "", "correlation ID. A new one is generated if empty")
+	userID := flags.String("user-id", "", "authorized user ID")
+	userRoles := flags.String("user-roles", "", "authorized user roles, i.e. Role1,Role2")
+
+	_ = flags.Parse(args)
+
+	if *topic == "" {
+		return fmt.Errorf("-topic is required")
+	}
+
+	var event appevent.AppEvent
+
+	switch {
+	case *file != "":
+
+		var eventJSON []byte
+
+		if *file == "-" {
+			eventJSON, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			eventJSON, err = ioutil.ReadFile(*file)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		event, err = appevent.NewAppEventFromJSON(eventJSON)
+
+		if err != nil {
+			return err
+		}
+
+		if event.Timestamp == 0 {
+			event.Timestamp = time.Now().UTC().UnixNano()
+		}
+
+	case *eventType != "":
+
+		if !json.Valid([]byte(*data)) {
+			return fmt.Errorf("-data is not valid JSON")
+		}
+
+		event = appevent.NewVersionedAppEvent(*eventType, *version, json.RawMessage(*data))
+
+	default:
+		return fmt.Errorf("-file or -type is required")
+	}
+
+	if *correlationID == "" {
+		id, _ := uuid.NewV4()
+		*correlationID = id.String()
+	}
+
+	eventJSON, err := event.ToJSON()
+
+	if err != nil {
+		return err
+	}
+
+	rabbit, err := conn.connect(app.ApplicationID(*appID))
+
+	if err != nil {
+		return err
+	}
+
+	defer closeConnection(rabbit)
+
+	err = rabbit.RegisterTopic(*topic)
+
+	if err != nil {
+		return err
+	}
+
+	ctx := appctx.NewContextFromValuesWithUserRoles(app.ApplicationID(*appID), *correlationID, *userID, *userRoles)
+
+	err = rabbit.PublishToTopic(ctx, *topic, eventJSON, "application/json")
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Published %s to topic %s with correlation ID %s\n", event.EventType, *topic, *correlationID)
+
+	return nil
+}
+
+// tail
+// Binds a temporary exclusive queue to the topic exchange and prints every delivery until interrupted
+func tail(args []string) (err error) {
+
+	flags, conn := newFlagSet("tail")
+	topic := flags.String("topic", "", "topic name (required)")
+	raw := flags.Bool("raw", false, "print bodies as they are")
+
+	_ = flags.Parse(args)
+
+	if *topic == "" {
+		return fmt.Errorf("-topic is required")
+	}
+
+	rabbit, err := conn.connect(cliAppID)
+
+	if err != nil {
+		return err
+	}
+
+	defer closeConnection(rabbit)
+
+	channel, err := rabbit.MqConnection.Channel()
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = channel.Close()
+	}()
+
+	queue, err := channel.QueueDeclare("", false, true, true, false, nil)
+
+	if err != nil {
+		return err
+	}
+
+	err = channel.QueueBind(queue.Name, "", *topic, false, nil)
+
+	if err != nil {
+		return fmt.Errorf("could not bind to topic %s, %s", *topic, err)
+	}
+
+	deliveries, err := channel.Consume(queue.Name, "", true, true, false, false, nil)
+
+	if err != nil {
+		return err
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	fmt.Fprintf(os.Stderr, "Tailing topic %s. Ctrl+C to stop\n", *topic)
+
+	for {
+		select {
+		case delivery, ok := <-deliveries:
+
+			if !ok {
+				return nil
+			}
+
+			printDelivery(delivery, *raw)
+
+		case <-sigChan:
+			return nil
+		}
+	}
+}
+
+func printDelivery(delivery amqp.Delivery, raw bool) {
+
+	fmt.Printf("--- %s from %s, correlation ID %s, message ID %s\n", delivery.Timestamp.Format(time.RFC3339), delivery.AppId, delivery.CorrelationId, delivery.MessageId)
+
+	for key, value := range delivery.Headers {
+		fmt.Printf("    %s: %v\n", key, value)
+	}
+
+	if delivery.ContentEncoding != "" {
+		fmt.Printf("    content encoding %s, %d bytes\n", delivery.ContentEncoding, len(delivery.Body))
+		return
+	}
+
+	if raw {
+		fmt.Println(string(delivery.Body))
+		return
+	}
+
+	event, err := appevent.NewAppEventFromJSON(delivery.Body)
+
+	if err != nil || event.EventType == "" {
+		fmt.Println(string(delivery.Body))
+		return
+	}
+
+	var data bytes.Buffer
+
+	err = json.Indent(&data, event.Data, "    ", "  ")
+
+	if err != nil {
+		data.Reset()
+		data.Write(event.Data)
+	}
+
+	fmt.Printf("    %s v%d at %s\n    %s\n", event.EventType, event.Version, time.Unix(0, event.Timestamp).UTC().Format(time.RFC3339Nano), data.String())
+}
+
+func queues(args []string) (err error) {
+
+	flags, conn := newFlagSet("queues")
+	appID := flags.String("app", "", "app ID owning the queues (required)")
+	topic := flags.String("topic", "", "topic name (required)")
+
+	_ = flags.Parse(args)
+
+	if *appID == "" || *topic == "" {
+		return fmt.Errorf("-app and -topic are required")
+	}
+
+	rabbit, err := conn.connect(app.ApplicationID(*appID))
+
+	if err != nil {
+		return err
+	}
+
+	defer closeConnection(rabbit)
+
+	queueNames := []string{eventpubsub.QueueName(app.ApplicationID(*appID), *topic), eventpubsub.DeadLetterQueueName(app.ApplicationID(*appID), *topic)}
+
+	for idx, deadLetter := range []bool{false, true} {
+
+		queueStats, err := rabbit.InspectQueue(*topic, deadLetter)
+
+		var amqpErr *amqp.Error
+
+		if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+			fmt.Printf("%-50s not found\n", queueNames[idx])
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%-50s messages %-8d consumers %d\n", queueStats.Queue, queueStats.Messages, queueStats.Consumers)
+	}
+
+	return nil
+}
+
+func closeConnection(rabbit *eventpubsub.RabbitMq) {
+
+	_ = rabbit.CleanUp()
+	_ = rabbit.MqConnection.Close()
+}
+
+func envOrDefault(name, defaultValue string) string {
+
+	value := os.Getenv(name)
+
+	if value == "" {
+		return defaultValue
+	}
+
+	return value
+}
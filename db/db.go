@@ -2,12 +2,15 @@ package db
 
 import (
 	"database/sql"
+
+	"golang.org/x/net/context"
 )
 
 type (
 	AppSqlDb interface {
 		GetDB() *sql.DB
 		WithTx(txFunc func(tx AppSqlTx) error) (err error)
+		WithTxContext(ctx context.Context, options TxOptions, txFunc TxFunc) (err error)
 	}
 
 	AppSqlTx interface {
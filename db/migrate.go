@@ -4,12 +4,21 @@ import (
 	"database/sql"
 	"errors"
 	"github.com/HelloSundayMorning/apputils/log"
+	"github.com/lib/pq"
 	"golang.org/x/net/context"
-	"strings"
+)
+
+var (
+	// SQLSTATE of creating a column, table, index or constraint that already exists
+	duplicateObjectCodes = map[pq.ErrorCode]bool{"42701": true, "42P07": true, "42710": true}
 )
 
 var ErrMigratingColumnAlreadyExists = errors.New("migrating: column already exists")
 
+// Migrate
+// Runs the add column statements, skipping the columns that already exist.
+//
+// Deprecated: use a Migrator, which versions the migrations.
 func (pDb *PostgresDB) Migrate(ctx context.Context, addColumnStatements []string) (err error) {
 
 	component := "migrate"
@@ -54,16 +63,19 @@ func (pDb *PostgresDB) migrateAddColumn(ctx context.Context, conn *sql.DB, addCo
 		return err
 	}
 
+	defer stmt.Close()
+
 	_, err = stmt.Exec()
 
 	if err != nil {
-		if strings.HasSuffix(err.Error(), "already exists") {
+		_ = tx.Rollback()
+
+		if pqErr, ok := err.(*pq.Error); ok && duplicateObjectCodes[pqErr.Code] {
 			log.Printf(ctx, "MigrateAddColumn", "Migrating column: %s", err)
 			return ErrMigratingColumnAlreadyExists
 		}
 
 		log.Errorf(ctx, "MigrateAddColumn", "Error migrating column: %s, %s", addColumnStatement, err)
-		_ = tx.Rollback()
 		return err
 	}
 
@@ -0,0 +1,780 @@
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/log"
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+)
+
+type (
+	// Migration
+	// Versioned schema change. Up applies it and Down rolls it back, Down is empty if it can't be
+	// rolled back. A NoTransaction migration runs outside a transaction, ie. CREATE INDEX CONCURRENTLY,
+	// its statements run one by one, split at the semicolons ending a line
+	Migration struct {
+		Version       int64
+		Name          string
+		Up            string
+		Down          string
+		NoTransaction bool
+	}
+
+	// MigrationStatus
+	// State of a migration in the database.
+	// - Modified: the migration changed after it was applied
+	// - Unknown: the migration is applied in the database but the migrator doesn't have it
+	MigrationStatus struct {
+		Version   int64
+		Name      string
+		Applied   bool
+		AppliedAt time.Time
+		Modified  bool
+		Unknown   bool
+	}
+
+	// MigrateOptions
+	// - DryRun: returns the migrations that would run, without running them
+	MigrateOptions struct {
+		DryRun bool
+	}
+
+	// Migrator
+	// Applies the versioned migrations, recording them in the migrations table, by default
+	// schema_migrations. Replicas migrating at the same time wait for each other on an advisory lock,
+	// polling it so a waiting replica doesn't hold a snapshot blocking a CREATE INDEX CONCURRENTLY.
+	Migrator struct {
+		sqlDb      AppSqlDb
+		migrations []Migration
+		table      string
+		lockKey    int64
+	}
+
+	// appliedMigration
+	// Row of the migrations table
+	appliedMigration struct {
+		version   int64
+		name      string
+		checksum  string
+		appliedAt time.Time
+	}
+
+	// sqlRunner
+	// sql.DB or sql.Conn
+	sqlRunner interface {
+		ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+		QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+		QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	}
+)
+
+const (
+	DefaultMigrationsTable = "schema_migrations"
+
+	// first line of a migration file running outside a transaction
+	NoTransactionDirective = "-- migrate:no-transaction"
+
+	createMigrationsTable = `CREATE TABLE IF NOT EXISTS %s (
+                                     version                    bigint                    not null,
+                                     name                       text                      not null,
+                                     checksum                   text                      not null,
+                                     applied_at                 timestamptz default now() not null,
+                                     PRIMARY KEY (version))`
+
+	findMigrationsTable = `SELECT to_regclass($1) IS NOT NULL`
+
+	findAppliedMigrations = `SELECT version, name, checksum, applied_at FROM %s ORDER BY version`
+
+	insertAppliedMigration = `INSERT INTO %s (version, name, checksum) VALUES ($1, $2, $3)`
+
+	deleteAppliedMigration = `DELETE FROM %s WHERE version = $1`
+
+	lockMigrations = `SELECT pg_try_advisory_lock($1)`
+
+	unlockMigrations = `SELECT pg_advisory_unlock($1)`
+
+	migrationsLockPollInterval = 500 * time.Millisecond
+
+	// no row if the index doesn't exist
+	findIndexValid = `SELECT indisvalid FROM pg_index WHERE indexrelid = to_regclass($1)`
+
+	dropIndexConcurrently = `DROP INDEX CONCURRENTLY IF EXISTS %s`
+)
+
+var (
+	// name of the index built by a CREATE INDEX CONCURRENTLY statement
+	concurrentIndexName = regexp.MustCompile(`(?i)CREATE\s+(?:UNIQUE\s+)?INDEX\s+CONCURRENTLY\s+(?:IF\s+NOT\s+EXISTS\s+)?([\w."]+)`)
+)
+
+// LoadMigrations
+// Reads the migrations in the directory of the file system, ie. an embed.FS or os.DirFS.
+// The files are named <version>_<name>.up.sql and <version>_<name>.down.sql, ie. 0001_create_users.up.sql,
+// other files are ignored. A migration starting with NoTransactionDirective runs outside a transaction.
+func LoadMigrations(fsys fs.FS, dir string) (migrations []Migration, err error) {
+
+	entries, err := fs.ReadDir(fsys, dir)
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading migrations directory %s, %s", dir, err)
+	}
+
+	byVersion := make(map[int64]*Migration)
+
+	for _, entry := range entries {
+
+		fileName := entry.Name()
+
+		if entry.IsDir() || !strings.HasSuffix(fileName, ".sql") {
+			continue
+		}
+
+		version, name, direction, err := parseMigrationFileName(fileName)
+
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := fs.ReadFile(fsys, path.Join(dir, fileName))
+
+		if err != nil {
+			return nil, fmt.Errorf("error reading migration %s, %s", fileName, err)
+		}
+
+		migration, ok := byVersion[version]
+
+		if !ok {
+			migration = &Migration{Version: version, Name: name}
+			byVersion[version] = migration
+		}
+
+		if migration.Name != name {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, migration.Name, name)
+		}
+
+		if direction == "up" {
+			migration.Up = string(content)
+			migration.NoTransaction = strings.HasPrefix(strings.TrimSpace(migration.Up), NoTransactionDirective)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	for _, migration := range byVersion {
+
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %d %s has no up file", migration.Version, migration.Name)
+		}
+
+		migrations = append(migrations, *migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// NewMigrator
+// Creates the migrator of the migrations, recorded in the schema_migrations table
+func NewMigrator(sqlDb AppSqlDb, migrations []Migration) (migrator *Migrator, err error) {
+
+	sorted := append([]Migration{}, migrations...)
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+
+	for i, migration := range sorted {
+
+		if migration.Version <= 0 {
+			return nil, fmt.Errorf("invalid version %d of migration %s", migration.Version, migration.Name)
+		}
+
+		if i > 0 && sorted[i-1].Version == migration.Version {
+			return nil, fmt.Errorf("duplicated migration version %d", migration.Version)
+		}
+	}
+
+	migrator = &Migrator{
+		sqlDb:      sqlDb,
+		migrations: sorted,
+	}
+
+	migrator.SetTable(DefaultMigrationsTable)
+
+	return migrator, nil
+}
+
+// NewMigratorFromFS
+// Creates the migrator of the migrations in the directory of the file system, see LoadMigrations
+func NewMigratorFromFS(sqlDb AppSqlDb, fsys fs.FS, dir string) (migrator *Migrator, err error) {
+
+	migrations, err := LoadMigrations(fsys, dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMigrator(sqlDb, migrations)
+}
+
+// MigrateSchema
+// Applies the pending migrations of a component owning its tables, ie. on startup, recording them in
+// the table of the component. It fails if the database schema was migrated by a newer version of the
+// component, or its applied migrations don't match the component ones.
+// Migrations run on startup shouldn't index or rewrite existing tables, they block the writes of the
+// running replicas. Do it before deploying, ie. with WithMigrationsLock.
+func MigrateSchema(ctx context.Context, sqlDb AppSqlDb, fsys fs.FS, dir, table string) (err error) {
+
+	migrator, err := NewMigratorFromFS(sqlDb, fsys, dir)
+
+	if err != nil {
+		return err
+	}
+
+	migrator.SetTable(table)
+
+	_, err = migrator.Up(ctx, MigrateOptions{})
+
+	if err != nil {
+		return fmt.Errorf("error migrating schema %s, %s", table, err)
+	}
+
+	return nil
+}
+
+// WithMigrationsLock
+// Runs the function holding the advisory lock of the migrations table, on the connection holding it, so it
+// doesn't race the migrations of the table, ie. to build indexes concurrently out of the startup migrations
+func WithMigrationsLock(ctx context.Context, sqlDb AppSqlDb, table string, lockedFunc func(conn *sql.Conn) error) (err error) {
+
+	migrator := &Migrator{sqlDb: sqlDb}
+
+	migrator.SetTable(table)
+
+	return migrator.withLock(ctx, lockedFunc)
+}
+
+// SetTable
+// Sets the table recording the applied migrations. Migrators of different tables don't lock each other.
+func (migrator *Migrator) SetTable(table string) {
+
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(table))
+
+	migrator.table = table
+	migrator.lockKey = int64(hash.Sum64())
+}
+
+// Migrations
+// Returns the migrations of the migrator, ordered by version
+func (migrator *Migrator) Migrations() []Migration {
+
+	return append([]Migration{}, migrator.migrations...)
+}
+
+// Up
+// Applies the pending migrations in version order and returns the ones applied. Each migration runs in its
+// own transaction, on failure the previous ones stay applied. On a dry run returns the pending migrations. It fails before applying any migration if
+// an applied migration was modified or the database has migrations the migrator doesn't know.
+func (migrator *Migrator) Up(ctx context.Context, options MigrateOptions) (migrations []Migration, err error) {
+
+	err = migrator.withLock(ctx, func(conn *sql.Conn) error {
+
+		applied, err := migrator.findApplied(ctx, conn)
+
+		if err != nil {
+			return err
+		}
+
+		err = migrator.validate(applied)
+
+		if err != nil {
+			return err
+		}
+
+		var pending []Migration
+
+		for _, migration := range migrator.migrations {
+
+			if _, ok := applied[migration.Version]; !ok {
+				pending = append(pending, migration)
+			}
+		}
+
+		if options.DryRun || len(pending) == 0 {
+			migrations = pending
+			return nil
+		}
+
+		_, err = conn.ExecContext(ctx, fmt.Sprintf(createMigrationsTable, pq.QuoteIdentifier(migrator.table)))
+
+		if err != nil {
+			return fmt.Errorf("error creating migrations table %s, %s", migrator.table, err)
+		}
+
+		for _, migration := range pending {
+
+			log.Printf(ctx, "migrate", "Applying migration %d %s", migration.Version, migration.Name)
+
+			err = migrator.run(ctx, conn, migration, migration.Up, fmt.Sprintf(insertAppliedMigration, pq.QuoteIdentifier(migrator.table)),
+				migration.Version, migration.Name, migration.Checksum())
+
+			if err != nil {
+				return fmt.Errorf("error applying migration %d %s, %s", migration.Version, migration.Name, err)
+			}
+
+			migrations = append(migrations, migration)
+		}
+
+		log.Printf(ctx, "migrate", "Applied %d migrations to %s", len(migrations), migrator.table)
+
+		return nil
+	})
+
+	return migrations, err
+}
+
+// Down
+// Rolls back the applied migrations after the version, the latest first, and returns the ones rolled back.
+// Version 0 rolls back all the migrations. It fails before rolling back any migration if one of
+// them can't be rolled back.
+func (migrator *Migrator) Down(ctx context.Context, version int64, options MigrateOptions) (migrations []Migration, err error) {
+
+	err = migrator.withLock(ctx, func(conn *sql.Conn) error {
+
+		applied, err := migrator.findApplied(ctx, conn)
+
+		if err != nil {
+			return err
+		}
+
+		byVersion := make(map[int64]Migration)
+
+		for _, migration := range migrator.migrations {
+			byVersion[migration.Version] = migration
+		}
+
+		var versions []int64
+		var rollback []Migration
+
+		for appliedVersion := range applied {
+
+			if appliedVersion > version {
+				versions = append(versions, appliedVersion)
+			}
+		}
+
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i] > versions[j]
+		})
+
+		for _, appliedVersion := range versions {
+
+			migration, ok := byVersion[appliedVersion]
+
+			if !ok {
+				return fmt.Errorf("migration %d %s applied to %s is unknown, it can't be rolled back", appliedVersion, applied[appliedVersion].name, migrator.table)
+			}
+
+			if migration.Down == "" {
+				return fmt.Errorf("migration %d %s has no down migration", migration.Version, migration.Name)
+			}
+
+			rollback = append(rollback, migration)
+		}
+
+		if options.DryRun {
+			migrations = rollback
+			return nil
+		}
+
+		for _, migration := range rollback {
+
+			log.Printf(ctx, "migrate", "Rolling back migration %d %s", migration.Version, migration.Name)
+
+			err = migrator.run(ctx, conn, migration, migration.Down, fmt.Sprintf(deleteAppliedMigration, pq.QuoteIdentifier(migrator.table)), migration.Version)
+
+			if err != nil {
+				return fmt.Errorf("error rolling back migration %d %s, %s", migration.Version, migration.Name, err)
+			}
+
+			migrations = append(migrations, migration)
+		}
+
+		return nil
+	})
+
+	return migrations, err
+}
+
+// Status
+// Returns the state of the migrations and of the applied migrations the migrator doesn't know, ordered by version
+func (migrator *Migrator) Status(ctx context.Context) (statuses []MigrationStatus, err error) {
+
+	applied, err := migrator.findApplied(ctx, migrator.sqlDb.GetDB())
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, migration := range migrator.migrations {
+
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+
+		if row, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = row.appliedAt
+			status.Modified = row.checksum != migration.Checksum()
+			delete(applied, migration.Version)
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	for _, row := range applied {
+		statuses = append(statuses, MigrationStatus{Version: row.version, Name: row.name, Applied: true, AppliedAt: row.appliedAt, Unknown: true})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+
+	return statuses, nil
+}
+
+// withLock
+// Runs the function holding the advisory lock of the migrations table, on the connection holding it
+func (migrator *Migrator) withLock(ctx context.Context, lockedFunc func(conn *sql.Conn) error) (err error) {
+
+	conn, err := migrator.sqlDb.GetDB().Conn(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	for {
+
+		var locked bool
+
+		err = conn.QueryRowContext(ctx, lockMigrations, migrator.lockKey).Scan(&locked)
+
+		if err != nil {
+			return fmt.Errorf("error locking migrations table %s, %s", migrator.table, err)
+		}
+
+		if locked {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("error locking migrations table %s, %s", migrator.table, ctx.Err())
+		case <-time.After(migrationsLockPollInterval):
+		}
+	}
+
+	defer func() {
+
+		// the lock is released with the session anyway, the connection is closed if the unlock fails
+		_, unlockErr := conn.ExecContext(context.Background(), unlockMigrations, migrator.lockKey)
+
+		if unlockErr != nil {
+			log.Errorf(ctx, "migrate", "Error unlocking migrations table %s, %s", migrator.table, unlockErr)
+			_ = conn.Raw(func(driverConn interface{}) error { return driver.ErrBadConn })
+		}
+	}()
+
+	return lockedFunc(conn)
+}
+
+// findApplied
+// Returns the applied migrations by version, none if the migrations table doesn't exist yet
+func (migrator *Migrator) findApplied(ctx context.Context, runner sqlRunner) (applied map[int64]appliedMigration, err error) {
+
+	applied = make(map[int64]appliedMigration)
+
+	var exists bool
+
+	err = runner.QueryRowContext(ctx, findMigrationsTable, migrator.table).Scan(&exists)
+
+	if err != nil {
+		return nil, fmt.Errorf("error finding migrations table %s, %s", migrator.table, err)
+	}
+
+	if !exists {
+		return applied, nil
+	}
+
+	rows, err := runner.QueryContext(ctx, fmt.Sprintf(findAppliedMigrations, pq.QuoteIdentifier(migrator.table)))
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading migrations table %s, %s", migrator.table, err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var row appliedMigration
+
+		err = rows.Scan(&row.version, &row.name, &row.checksum, &row.appliedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		applied[row.version] = row
+	}
+
+	return applied, rows.Err()
+}
+
+// validate
+// Fails if an applied migration was modified, or is unknown
+func (migrator *Migrator) validate(applied map[int64]appliedMigration) (err error) {
+
+	latest := int64(0)
+
+	if len(migrator.migrations) > 0 {
+		latest = migrator.migrations[len(migrator.migrations)-1].Version
+	}
+
+	known := make(map[int64]Migration)
+
+	for _, migration := range migrator.migrations {
+		known[migration.Version] = migration
+	}
+
+	var versions []int64
+
+	for version := range applied {
+		versions = append(versions, version)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i] < versions[j]
+	})
+
+	for _, version := range versions {
+
+		row := applied[version]
+		migration, ok := known[version]
+
+		if !ok && version > latest {
+			return fmt.Errorf("schema version %d of %s is newer than the latest migration %d, the database was migrated by a newer version", version, migrator.table, latest)
+		}
+
+		if !ok {
+			return fmt.Errorf("migration %d %s applied to %s is unknown", version, row.name, migrator.table)
+		}
+
+		if row.checksum != migration.Checksum() {
+			return fmt.Errorf("migration %d %s was modified after it was applied to %s", version, migration.Name, migrator.table)
+		}
+	}
+
+	return nil
+}
+
+// run
+// Runs the migration statements and records the change in the migrations table, in a transaction
+// unless the migration is NoTransaction
+func (migrator *Migrator) run(ctx context.Context, conn *sql.Conn, migration Migration, statements, record string, args ...interface{}) (err error) {
+
+	if migration.NoTransaction {
+
+		// several statements in a query run in a transaction, they run one by one
+		for _, statement := range splitStatements(statements) {
+
+			err = runStatement(ctx, conn, statement)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = conn.ExecContext(ctx, record, args...)
+
+		return err
+	}
+
+	// several statements can't be prepared, they run as a simple query
+
+	tx, err := conn.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, statements)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, record, args...)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// runStatement
+// Runs the statement outside a transaction. An index built concurrently is checked to be valid: a failed
+// build leaves an invalid index, dropped before building it again, that IF NOT EXISTS would skip
+func runStatement(ctx context.Context, conn *sql.Conn, statement string) (err error) {
+
+	match := concurrentIndexName.FindStringSubmatch(statement)
+
+	if match == nil || strings.EqualFold(match[1], "ON") {
+		_, err = conn.ExecContext(ctx, statement)
+		return err
+	}
+
+	index := match[1]
+
+	valid, exists, err := findIndex(ctx, conn, index)
+
+	if err != nil {
+		return err
+	}
+
+	if exists && !valid {
+
+		log.Printf(ctx, "migrate", "Dropping invalid index %s to build it again", index)
+
+		_, err = conn.ExecContext(ctx, fmt.Sprintf(dropIndexConcurrently, index))
+
+		if err != nil {
+			return fmt.Errorf("error dropping invalid index %s, %s", index, err)
+		}
+	}
+
+	_, err = conn.ExecContext(ctx, statement)
+
+	if err != nil {
+		return err
+	}
+
+	valid, exists, err = findIndex(ctx, conn, index)
+
+	if err != nil {
+		return err
+	}
+
+	if !exists || !valid {
+		return fmt.Errorf("index %s is invalid after building it concurrently", index)
+	}
+
+	return nil
+}
+
+// findIndex
+// Returns if the index exists and is valid
+func findIndex(ctx context.Context, conn *sql.Conn, index string) (valid, exists bool, err error) {
+
+	err = conn.QueryRowContext(ctx, findIndexValid, index).Scan(&valid)
+
+	if err == sql.ErrNoRows {
+		return false, false, nil
+	}
+
+	if err != nil {
+		return false, false, fmt.Errorf("error finding index %s, %s", index, err)
+	}
+
+	return valid, true, nil
+}
+
+// splitStatements
+// Splits the statements at the semicolons ending a line
+func splitStatements(statements string) (split []string) {
+
+	var statement []string
+
+	for _, line := range strings.Split(statements, "\n") {
+
+		statement = append(statement, line)
+
+		if strings.HasSuffix(strings.TrimSpace(line), ";") {
+			split = appendStatement(split, statement)
+			statement = nil
+		}
+	}
+
+	return appendStatement(split, statement)
+}
+
+// appendStatement
+// Appends the statement lines unless they are only comments
+func appendStatement(split []string, lines []string) []string {
+
+	for _, line := range lines {
+
+		line = strings.TrimSpace(line)
+
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return append(split, strings.Join(lines, "\n"))
+		}
+	}
+
+	return split
+}
+
+// Checksum
+// SHA-256 of the up migration
+func (migration Migration) Checksum() string {
+
+	sum := sha256.Sum256([]byte(migration.Up))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// parseMigrationFileName
+// Splits <version>_<name>.<up|down>.sql
+func parseMigrationFileName(fileName string) (version int64, name, direction string, err error) {
+
+	base := strings.TrimSuffix(fileName, ".sql")
+
+	switch {
+	case strings.HasSuffix(base, ".up"):
+		direction = "up"
+	case strings.HasSuffix(base, ".down"):
+		direction = "down"
+	default:
+		return 0, "", "", fmt.Errorf("invalid migration file name %s, expected <version>_<name>.up.sql or .down.sql", fileName)
+	}
+
+	base = strings.TrimSuffix(base, "."+direction)
+
+	parts := strings.SplitN(base, "_", 2)
+
+	version, err = strconv.ParseInt(parts[0], 10, 64)
+
+	if err != nil || version <= 0 || len(parts) < 2 || parts[1] == "" {
+		return 0, "", "", fmt.Errorf("invalid migration file name %s, expected <version>_<name>.up.sql or .down.sql", fileName)
+	}
+
+	return version, parts[1], direction, nil
+}
@@ -0,0 +1,354 @@
+package db
+
+import (
+	"regexp"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func newTestMigrations() []Migration {
+
+	return []Migration{
+		{Version: 1, Name: "create_users", Up: "CREATE TABLE users (id text)", Down: "DROP TABLE users"},
+		{Version: 2, Name: "add_email", Up: "ALTER TABLE users ADD COLUMN email text", Down: "ALTER TABLE users DROP COLUMN email"},
+		{Version: 3, Name: "index_email", Up: NoTransactionDirective + "\nCREATE INDEX CONCURRENTLY users_email_idx ON users (email)", NoTransaction: true},
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+
+	type testDef struct {
+		Files    fstest.MapFS
+		Versions []int64
+		HasErr   bool
+	}
+
+	Tests := []testDef{
+		{fstest.MapFS{
+			"migrations/0002_add_email.up.sql":      {Data: []byte("ALTER TABLE users ADD COLUMN email text")},
+			"migrations/0001_create_users.up.sql":   {Data: []byte("CREATE TABLE users (id text)")},
+			"migrations/0001_create_users.down.sql": {Data: []byte("DROP TABLE users")},
+			"migrations/README.md":                  {Data: []byte("migrations")},
+		}, []int64{1, 2}, false},
+		{fstest.MapFS{"migrations/0001_create_users.down.sql": {Data: []byte("DROP TABLE users")}}, nil, true},
+		{fstest.MapFS{"migrations/create_users.up.sql": {Data: []byte("CREATE TABLE users (id text)")}}, nil, true},
+		{fstest.MapFS{"migrations/0001_create_users.sql": {Data: []byte("CREATE TABLE users (id text)")}}, nil, true},
+		{fstest.MapFS{
+			"migrations/0001_create_users.up.sql": {Data: []byte("CREATE TABLE users (id text)")},
+			"migrations/0001_users.down.sql":      {Data: []byte("DROP TABLE users")},
+		}, nil, true},
+		{fstest.MapFS{}, nil, true},
+	}
+
+	for idx, test := range Tests {
+
+		migrations, err := LoadMigrations(test.Files, "migrations")
+
+		assert.Equalf(t, test.HasErr, err != nil, "Failed test %d", idx)
+
+		var versions []int64
+
+		for _, migration := range migrations {
+			versions = append(versions, migration.Version)
+		}
+
+		assert.Equalf(t, test.Versions, versions, "Failed test %d", idx)
+	}
+
+	migrations, err := LoadMigrations(fstest.MapFS{
+		"sql/0001_index.up.sql": {Data: []byte(NoTransactionDirective + "\nCREATE INDEX CONCURRENTLY users_idx ON users (id)")},
+	}, "sql")
+
+	assert.NoError(t, err)
+	assert.True(t, migrations[0].NoTransaction)
+	assert.Equal(t, "index", migrations[0].Name)
+}
+
+func TestMigrator_Up(t *testing.T) {
+
+	migrations := newTestMigrations()
+
+	type testDef struct {
+		Applied []Migration
+		DryRun  bool
+		Pending []int64
+		HasErr  bool
+	}
+
+	modified := migrations[0]
+	modified.Up = "CREATE TABLE users (id text, name text)"
+
+	Tests := []testDef{
+		{nil, false, []int64{1, 2, 3}, false},
+		{migrations[:1], false, []int64{2, 3}, false},
+		{migrations[:2], true, []int64{3}, false},
+		{migrations, false, nil, false},
+		{[]Migration{modified}, false, nil, true},
+		{append(migrations, Migration{Version: 4, Name: "newer"}), false, nil, true},
+	}
+
+	for idx, test := range Tests {
+
+		mockDb, mock, err := NewMockDB()
+
+		assert.NoError(t, err)
+
+		migrator, err := NewMigrator(mockDb, migrations)
+
+		assert.NoError(t, err)
+
+		mock.ExpectQuery("pg_try_advisory_lock").WithArgs(migrator.lockKey).WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+		mock.ExpectQuery("to_regclass").WithArgs("schema_migrations").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(test.Applied != nil))
+
+		if test.Applied != nil {
+
+			rows := sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"})
+
+			for _, applied := range test.Applied {
+				rows.AddRow(applied.Version, applied.Name, applied.Checksum(), time.Now())
+			}
+
+			mock.ExpectQuery(`SELECT version, name, checksum, applied_at FROM "schema_migrations"`).WillReturnRows(rows)
+		}
+
+		if !test.HasErr && !test.DryRun && len(test.Pending) > 0 {
+
+			mock.ExpectExec(`CREATE TABLE IF NOT EXISTS "schema_migrations"`).WillReturnResult(sqlmock.NewResult(0, 0))
+
+			for _, version := range test.Pending {
+
+				migration := migrations[version-1]
+
+				if !migration.NoTransaction {
+					mock.ExpectBegin()
+				}
+
+				if migration.NoTransaction {
+					mock.ExpectQuery("indisvalid").WithArgs("users_email_idx").WillReturnRows(sqlmock.NewRows([]string{"indisvalid"}))
+				}
+
+				mock.ExpectExec(regexp.QuoteMeta(migration.Up)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+				if migration.NoTransaction {
+					mock.ExpectQuery("indisvalid").WithArgs("users_email_idx").WillReturnRows(sqlmock.NewRows([]string{"indisvalid"}).AddRow(true))
+				}
+
+				mock.ExpectExec(`INSERT INTO "schema_migrations"`).WithArgs(version, migration.Name, migration.Checksum()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+				if !migration.NoTransaction {
+					mock.ExpectCommit()
+				}
+			}
+		}
+
+		mock.ExpectExec("pg_advisory_unlock").WithArgs(migrator.lockKey).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		pending, err := migrator.Up(context.Background(), MigrateOptions{DryRun: test.DryRun})
+
+		assert.Equalf(t, test.HasErr, err != nil, "Failed test %d", idx)
+		assert.NoErrorf(t, mock.ExpectationsWereMet(), "Failed test %d", idx)
+
+		var versions []int64
+
+		for _, migration := range pending {
+			versions = append(versions, migration.Version)
+		}
+
+		assert.Equalf(t, test.Pending, versions, "Failed test %d", idx)
+	}
+}
+
+func TestMigrator_UpConcurrentIndex(t *testing.T) {
+
+	migrations := newTestMigrations()
+
+	type testDef struct {
+		Before []bool // indisvalid before building it, no row if empty
+		After  []bool
+		HasErr bool
+	}
+
+	Tests := []testDef{
+		{nil, []bool{true}, false},
+		{[]bool{false}, []bool{true}, false},
+		{nil, []bool{false}, true},
+		{nil, nil, true},
+	}
+
+	indexRows := func(valid []bool) *sqlmock.Rows {
+
+		rows := sqlmock.NewRows([]string{"indisvalid"})
+
+		for _, v := range valid {
+			rows.AddRow(v)
+		}
+
+		return rows
+	}
+
+	for idx, test := range Tests {
+
+		mockDb, mock, err := NewMockDB()
+
+		assert.NoError(t, err)
+
+		migrator, err := NewMigrator(mockDb, migrations)
+
+		assert.NoError(t, err)
+
+		rows := sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"})
+
+		for _, applied := range migrations[:2] {
+			rows.AddRow(applied.Version, applied.Name, applied.Checksum(), time.Now())
+		}
+
+		// the lock is polled until the other replica releases it
+		mock.ExpectQuery("pg_try_advisory_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(false))
+		mock.ExpectQuery("pg_try_advisory_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+		mock.ExpectQuery("to_regclass").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+		mock.ExpectQuery(`FROM "schema_migrations"`).WillReturnRows(rows)
+		mock.ExpectExec(`CREATE TABLE IF NOT EXISTS "schema_migrations"`).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("indisvalid").WithArgs("users_email_idx").WillReturnRows(indexRows(test.Before))
+
+		if len(test.Before) > 0 && !test.Before[0] {
+			mock.ExpectExec("DROP INDEX CONCURRENTLY IF EXISTS users_email_idx").WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+
+		mock.ExpectExec("CREATE INDEX CONCURRENTLY users_email_idx").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("indisvalid").WithArgs("users_email_idx").WillReturnRows(indexRows(test.After))
+
+		if !test.HasErr {
+			mock.ExpectExec(`INSERT INTO "schema_migrations"`).WithArgs(int64(3), "index_email", migrations[2].Checksum()).WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+
+		mock.ExpectExec("pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		_, err = migrator.Up(context.Background(), MigrateOptions{})
+
+		assert.Equalf(t, test.HasErr, err != nil, "Failed test %d", idx)
+		assert.NoErrorf(t, mock.ExpectationsWereMet(), "Failed test %d", idx)
+	}
+}
+
+func TestMigrator_Down(t *testing.T) {
+
+	migrations := newTestMigrations()
+
+	type testDef struct {
+		Applied    int
+		Version    int64
+		RolledBack []int64
+		HasErr     bool
+	}
+
+	Tests := []testDef{
+		{2, 0, []int64{2, 1}, false},
+		{2, 1, []int64{2}, false},
+		{2, 2, nil, false},
+		{3, 1, nil, true},
+	}
+
+	for idx, test := range Tests {
+
+		mockDb, mock, err := NewMockDB()
+
+		assert.NoError(t, err)
+
+		migrator, err := NewMigrator(mockDb, migrations)
+
+		assert.NoError(t, err)
+
+		rows := sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"})
+
+		for _, applied := range migrations[:test.Applied] {
+			rows.AddRow(applied.Version, applied.Name, applied.Checksum(), time.Now())
+		}
+
+		mock.ExpectQuery("pg_try_advisory_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+		mock.ExpectQuery("to_regclass").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+		mock.ExpectQuery(`FROM "schema_migrations"`).WillReturnRows(rows)
+
+		if !test.HasErr {
+
+			for _, version := range test.RolledBack {
+				mock.ExpectBegin()
+				mock.ExpectExec(regexp.QuoteMeta(migrations[version-1].Down)).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(`DELETE FROM "schema_migrations"`).WithArgs(version).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			}
+		}
+
+		mock.ExpectExec("pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		rolledBack, err := migrator.Down(context.Background(), test.Version, MigrateOptions{})
+
+		assert.Equalf(t, test.HasErr, err != nil, "Failed test %d", idx)
+		assert.NoErrorf(t, mock.ExpectationsWereMet(), "Failed test %d", idx)
+
+		var versions []int64
+
+		for _, migration := range rolledBack {
+			versions = append(versions, migration.Version)
+		}
+
+		if test.HasErr {
+			continue
+		}
+
+		assert.Equalf(t, test.RolledBack, versions, "Failed test %d", idx)
+	}
+}
+
+func TestMigrator_Status(t *testing.T) {
+
+	mockDb, mock, err := NewMockDB()
+
+	assert.NoError(t, err)
+
+	migrations := newTestMigrations()
+
+	migrator, err := NewMigrator(mockDb, migrations[:2])
+
+	assert.NoError(t, err)
+
+	migrator.SetTable("app_migrations")
+
+	mock.ExpectQuery("to_regclass").WithArgs("app_migrations").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(`FROM "app_migrations"`).WillReturnRows(sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"}).
+		AddRow(1, "create_users", "edited", time.Now()).
+		AddRow(3, "index_email", migrations[2].Checksum(), time.Now()))
+
+	statuses, err := migrator.Status(context.Background())
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	assert.Len(t, statuses, 3)
+	assert.True(t, statuses[0].Applied && statuses[0].Modified)
+	assert.False(t, statuses[1].Applied)
+	assert.True(t, statuses[2].Applied && statuses[2].Unknown)
+}
+
+func TestSplitStatements(t *testing.T) {
+
+	type testDef struct {
+		Statements string
+		Split      []string
+	}
+
+	Tests := []testDef{
+		{"CREATE INDEX a ON t (a);\n\nCREATE INDEX b ON t (b);\n", []string{"CREATE INDEX a ON t (a);", "\nCREATE INDEX b ON t (b);"}},
+		{NoTransactionDirective + "\nCREATE INDEX a\n    ON t (a);", []string{NoTransactionDirective + "\nCREATE INDEX a\n    ON t (a);"}},
+		{"CREATE INDEX a ON t (a)", []string{"CREATE INDEX a ON t (a)"}},
+		{"CREATE INDEX a ON t (a);\n-- trailing comment\n", []string{"CREATE INDEX a ON t (a);"}},
+	}
+
+	for idx, test := range Tests {
+		assert.Equalf(t, test.Split, splitStatements(test.Statements), "Failed test %d", idx)
+	}
+}
@@ -0,0 +1,233 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/app"
+	"github.com/HelloSundayMorning/apputils/log"
+	"golang.org/x/net/context"
+)
+
+type (
+	// PostgresOptions
+	// Connection and pool settings of NewPostgresDBWithOptions. Zero values keep the driver and pool defaults.
+	// - SSLMode: disable, require, verify-ca or verify-full. Default disable
+	// - SSLRootCert: file of the CA verifying the server, ie. the managed Postgres CA bundle
+	// - SSLCert and SSLKey: files of the client certificate, if the server requires one
+	// - ApplicationName: shown in pg_stat_activity. Default the app ID
+	// - ConnectTimeout: wait for a connection, rounded up to seconds
+	// - StatementTimeout: statements running longer are cancelled by the server
+	// - PingAttempts and PingBackoff: pings on startup until the database answers, the backoff
+	//   doubles after each failed ping. Default DefaultPingAttempts and DefaultPingBackoff
+	PostgresOptions struct {
+		Host             string
+		Port             string
+		User             string
+		Password         string
+		DBName           string
+		SSLMode          string
+		SSLRootCert      string
+		SSLCert          string
+		SSLKey           string
+		ApplicationName  string
+		ConnectTimeout   time.Duration
+		StatementTimeout time.Duration
+		MaxOpenConns     int
+		MaxIdleConns     int
+		ConnMaxLifetime  time.Duration
+		ConnMaxIdleTime  time.Duration
+		PingAttempts     int
+		PingBackoff      time.Duration
+	}
+)
+
+const (
+	SSLModeDisable    = "disable"
+	SSLModeRequire    = "require"
+	SSLModeVerifyCA   = "verify-ca"
+	SSLModeVerifyFull = "verify-full"
+
+	DefaultPingAttempts = 5
+	DefaultPingBackoff  = 500 * time.Millisecond
+
+	PostgresHostEnv        = "POSTGRES_HOST"
+	PostgresPortEnv        = "POSTGRES_PORT"
+	PostgresUserEnv        = "POSTGRES_USER"
+	PostgresPasswordEnv    = "POSTGRES_PASSWORD"
+	PostgresDBEnv          = "POSTGRES_DB"
+	PostgresSSLModeEnv     = "POSTGRES_SSLMODE"
+	PostgresSSLRootCertEnv = "POSTGRES_SSLROOTCERT"
+)
+
+// NewPostgresOptionsFromEnv
+// Reads the connection options from the POSTGRES_* environment variables
+func NewPostgresOptionsFromEnv() (options PostgresOptions) {
+
+	return PostgresOptions{
+		Host:        os.Getenv(PostgresHostEnv),
+		Port:        os.Getenv(PostgresPortEnv),
+		User:        os.Getenv(PostgresUserEnv),
+		Password:    os.Getenv(PostgresPasswordEnv),
+		DBName:      os.Getenv(PostgresDBEnv),
+		SSLMode:     os.Getenv(PostgresSSLModeEnv),
+		SSLRootCert: os.Getenv(PostgresSSLRootCertEnv),
+	}
+}
+
+// NewPostgresDBWithOptions
+// Opens the database with the options, and pings it until it answers or the ping attempts run out,
+// so a database still starting doesn't fail the first request.
+func NewPostgresDBWithOptions(ctx context.Context, appID app.ApplicationID, options PostgresOptions) (pgDb *PostgresDB, err error) {
+
+	if options.ApplicationName == "" {
+		options.ApplicationName = string(appID)
+	}
+
+	dataSource, err := options.dataSourceName()
+
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("postgres", dataSource)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if options.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(options.MaxOpenConns)
+	}
+
+	if options.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(options.MaxIdleConns)
+	}
+
+	if options.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(options.ConnMaxLifetime)
+	}
+
+	if options.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(options.ConnMaxIdleTime)
+	}
+
+	err = pingWithRetry(ctx, appID, db, options.PingAttempts, options.PingBackoff)
+
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("error connecting to database %s on %s, %s", options.DBName, options.Host, err)
+	}
+
+	log.PrintfNoContext(appID, "postgresDB", "Connected to database %s on %s. SSL mode %s", options.DBName, options.Host, options.sslMode())
+
+	return &PostgresDB{DB: db}, nil
+}
+
+// dataSourceName
+// Returns the connection string of the options, with the values quoted
+func (options PostgresOptions) dataSourceName() (dataSource string, err error) {
+
+	switch options.sslMode() {
+	case SSLModeDisable, SSLModeRequire, SSLModeVerifyCA, SSLModeVerifyFull:
+	default:
+		return "", fmt.Errorf("invalid postgres SSL mode %s", options.SSLMode)
+	}
+
+	params := map[string]string{
+		"host":             options.Host,
+		"port":             options.Port,
+		"user":             options.User,
+		"password":         options.Password,
+		"dbname":           options.DBName,
+		"sslmode":          options.sslMode(),
+		"sslrootcert":      options.SSLRootCert,
+		"sslcert":          options.SSLCert,
+		"sslkey":           options.SSLKey,
+		"application_name": options.ApplicationName,
+	}
+
+	if options.ConnectTimeout > 0 {
+		params["connect_timeout"] = strconv.FormatInt(int64((options.ConnectTimeout+time.Second-1)/time.Second), 10)
+	}
+
+	// sent to the server as a session setting, in milliseconds
+	if options.StatementTimeout > 0 {
+		params["statement_timeout"] = strconv.FormatInt(int64(options.StatementTimeout/time.Millisecond), 10)
+	}
+
+	var pairs []string
+
+	for key, value := range params {
+
+		if value == "" {
+			continue
+		}
+
+		pairs = append(pairs, key+"="+quoteParam(value))
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, " "), nil
+}
+
+func (options PostgresOptions) sslMode() string {
+
+	if options.SSLMode == "" {
+		return SSLModeDisable
+	}
+
+	return options.SSLMode
+}
+
+// quoteParam
+// Quotes a connection string value, escaping backslashes and single quotes
+func quoteParam(value string) string {
+
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+
+	return `'` + value + `'`
+}
+
+// pingWithRetry
+// Pings the database until it answers, waiting the backoff after a failed ping, doubled each time
+func pingWithRetry(ctx context.Context, appID app.ApplicationID, db *sql.DB, attempts int, backoff time.Duration) (err error) {
+
+	if attempts <= 0 {
+		attempts = DefaultPingAttempts
+	}
+
+	if backoff <= 0 {
+		backoff = DefaultPingBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+
+		err = db.PingContext(ctx)
+
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= attempts {
+			return fmt.Errorf("ping failed after %d attempts, %s", attempt, err)
+		}
+
+		log.PrintfNoContext(appID, "postgresDB", "Ping attempt %d failed, retrying in %s, %s", attempt, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		backoff *= 2
+	}
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestPostgresOptions_DataSourceName(t *testing.T) {
+
+	type testDef struct {
+		Options    PostgresOptions
+		DataSource string
+		HasErr     bool
+	}
+
+	Tests := []testDef{
+		{PostgresOptions{Host: "localhost", User: "app", Password: "pw", DBName: "appdb"},
+			`dbname='appdb' host='localhost' password='pw' sslmode='disable' user='app'`, false},
+		{PostgresOptions{Host: "db.example.com", Port: "5432", User: "app", Password: `p'w\`, DBName: "appdb", SSLMode: SSLModeVerifyFull, SSLRootCert: "/certs/ca.pem", ApplicationName: "my-app"},
+			`application_name='my-app' dbname='appdb' host='db.example.com' password='p\'w\\' port='5432' sslmode='verify-full' sslrootcert='/certs/ca.pem' user='app'`, false},
+		{PostgresOptions{Host: "localhost", ConnectTimeout: 1500 * time.Millisecond, StatementTimeout: 30 * time.Second},
+			`connect_timeout='2' host='localhost' sslmode='disable' statement_timeout='30000'`, false},
+		{PostgresOptions{Host: "localhost", SSLMode: "prefer"}, "", true},
+	}
+
+	for idx, test := range Tests {
+
+		dataSource, err := test.Options.dataSourceName()
+
+		assert.Equalf(t, test.HasErr, err != nil, "Failed test %d", idx)
+		assert.Equalf(t, test.DataSource, dataSource, "Failed test %d", idx)
+	}
+}
+
+func TestNewPostgresDBWithOptions_PingRetry(t *testing.T) {
+
+	start := time.Now()
+
+	_, err := NewPostgresDBWithOptions(context.Background(), "testApp", PostgresOptions{
+		Host:           "127.0.0.1",
+		Port:           "1",
+		ConnectTimeout: time.Second,
+		PingAttempts:   3,
+		PingBackoff:    10 * time.Millisecond,
+	})
+
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "after 3 attempts"), err.Error())
+	assert.True(t, time.Since(start) >= 30*time.Millisecond)
+}
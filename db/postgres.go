@@ -20,6 +20,8 @@ func (txDb *TxPostgresDb) GetTx() *sql.Tx {
 	return txDb.tx
 }
 
+// NewPostgresDB
+// Opens the database without TLS nor pool settings, see NewPostgresDBWithOptions
 func NewPostgresDB(host, user, pw, dbName string) (pgDb *PostgresDB, err error) {
 
 	dataSource := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable", host, user, pw, dbName)
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+)
+
+const (
+	// SQLSTATE of the errors solved by retrying the transaction
+	SerializationFailureCode = "40001"
+	DeadlockDetectedCode     = "40P01"
+)
+
+var (
+	// ErrConflict is wrapped by the errors of writes that lost against a concurrent write,
+	// ie. an optimistic locking version mismatch. They are retryable
+	ErrConflict = errors.New("conflicted with a concurrent update")
+)
+
+// IsRetryableError
+// Returns true if the error, or an error it wraps, is a Postgres serialization failure or deadlock,
+// or ErrConflict, the transaction can succeed if retried
+func IsRetryableError(err error) bool {
+
+	if errors.Is(err, ErrConflict) {
+		return true
+	}
+
+	var pqErr *pq.Error
+
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+
+	return pqErr.Code == SerializationFailureCode || pqErr.Code == DeadlockDetectedCode
+}
+
+// WithRetry
+// Runs the function, and runs it again while it fails with a retryable error and the attempts of the
+// options last, waiting the options backoff between attempts. WithTxContext retries its transactions with it.
+func WithRetry(ctx context.Context, options TxOptions, retryFunc func() (err error)) (err error) {
+
+	maxAttempts := options.MaxAttempts
+
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultTxMaxAttempts
+	}
+
+	initialBackoff := options.InitialBackoff
+
+	if initialBackoff <= 0 {
+		initialBackoff = DefaultTxInitialBackoff
+	}
+
+	maxBackoff := options.MaxBackoff
+
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultTxMaxBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+
+		err = retryFunc()
+
+		if err == nil || !IsRetryableError(err) {
+			return err
+		}
+
+		if attempt >= maxAttempts {
+			return fmt.Errorf("failed after %d attempts, %w", attempt, err)
+		}
+
+		select {
+		case <-time.After(Backoff(attempt, initialBackoff, maxBackoff)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Backoff
+// Returns the wait before the retry after the attempt, the initial backoff doubled on each attempt up to
+// the max backoff, no max if 0. The wait is jittered between half and all of it, so the callers that failed
+// together don't retry at the same time.
+func Backoff(attempt int, initialBackoff, maxBackoff time.Duration) time.Duration {
+
+	backoff := initialBackoff
+
+	for i := 1; i < attempt && (maxBackoff <= 0 || backoff < maxBackoff); i++ {
+		backoff *= 2
+	}
+
+	if maxBackoff > 0 && backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+
+	if backoff <= 0 {
+		return 0
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
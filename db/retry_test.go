@@ -0,0 +1,60 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRetryableError(t *testing.T) {
+
+	type testDef struct {
+		Err       error
+		Retryable bool
+	}
+
+	Tests := []testDef{
+		{&pq.Error{Code: SerializationFailureCode}, true},
+		{fmt.Errorf("updating user, %w", &pq.Error{Code: DeadlockDetectedCode}), true},
+		{fmt.Errorf("user updated concurrently, %w", ErrConflict), true},
+		{&pq.Error{Code: "23505"}, false},
+		{errors.New("connection refused"), false},
+		{nil, false},
+	}
+
+	for idx, test := range Tests {
+
+		assert.Equalf(t, test.Retryable, IsRetryableError(test.Err), "Failed test %d", idx)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+
+	type testDef struct {
+		Attempt    int
+		MaxBackoff time.Duration
+		Min        time.Duration
+		Max        time.Duration
+	}
+
+	Tests := []testDef{
+		{1, 40 * time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond},
+		{2, 40 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond},
+		{10, 40 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond},
+		{10, 0, 2560 * time.Millisecond, 5120 * time.Millisecond},
+	}
+
+	for idx, test := range Tests {
+
+		for i := 0; i < 20; i++ {
+
+			backoff := Backoff(test.Attempt, 10*time.Millisecond, test.MaxBackoff)
+
+			assert.Truef(t, backoff >= test.Min && backoff <= test.Max, "Failed test %d, backoff %s", idx, backoff)
+		}
+	}
+}
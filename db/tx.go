@@ -0,0 +1,84 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type (
+	// TxFunc
+	// Runs in the transaction. Returning an error rolls it back
+	TxFunc func(tx AppSqlTx) (err error)
+
+	// TxOptions
+	// Transaction of WithTxContext.
+	// - Isolation: isolation level, ie. sql.LevelSerializable. Default the database one, read committed
+	// - ReadOnly: the transaction can't write
+	// - MaxAttempts: runs of the function when it fails with a serialization failure or deadlock,
+	//   see IsRetryableError. Default DefaultTxMaxAttempts, 1 doesn't retry
+	// - InitialBackoff: wait before the first retry, doubled on each retry up to MaxBackoff, with jitter
+	TxOptions struct {
+		Isolation      sql.IsolationLevel
+		ReadOnly       bool
+		MaxAttempts    int
+		InitialBackoff time.Duration
+		MaxBackoff     time.Duration
+	}
+)
+
+const (
+	DefaultTxMaxAttempts    = 3
+	DefaultTxInitialBackoff = 10 * time.Millisecond
+	DefaultTxMaxBackoff     = 500 * time.Millisecond
+)
+
+// WithTxContext
+// Runs the function in a transaction with the options, retrying it on serialization failures and deadlocks.
+// The transaction is rolled back if the context is done before it commits.
+func (pDb *PostgresDB) WithTxContext(ctx context.Context, options TxOptions, txFunc TxFunc) (err error) {
+
+	return withTxContext(ctx, pDb.DB, options, txFunc, func(tx *sql.Tx) AppSqlTx {
+		return &TxPostgresDb{tx}
+	})
+}
+
+// WithTxContext
+// Runs the function in a mock transaction, as PostgresDB does
+func (pDb *MockDB) WithTxContext(ctx context.Context, options TxOptions, txFunc TxFunc) (err error) {
+
+	return withTxContext(ctx, pDb.DB, options, txFunc, func(tx *sql.Tx) AppSqlTx {
+		return &TxMockDb{tx}
+	})
+}
+
+// withTxContext
+// Runs the function in a transaction, and runs it again in a new transaction while it fails with a retryable
+// error and the attempts last. The transaction is rolled back if the context is done before it commits.
+func withTxContext(ctx context.Context, sqlDb *sql.DB, options TxOptions, txFunc TxFunc, newTx func(tx *sql.Tx) AppSqlTx) (err error) {
+
+	return WithRetry(ctx, options, func() error {
+		return runTx(ctx, sqlDb, options, txFunc, newTx)
+	})
+}
+
+// runTx
+// Runs the function in a transaction, committing it if the function succeeds
+func runTx(ctx context.Context, sqlDb *sql.DB, options TxOptions, txFunc TxFunc, newTx func(tx *sql.Tx) AppSqlTx) (err error) {
+
+	tx, err := sqlDb.BeginTx(ctx, &sql.TxOptions{Isolation: options.Isolation, ReadOnly: options.ReadOnly})
+
+	if err != nil {
+		return err
+	}
+
+	err = txFunc(newTx(tx))
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
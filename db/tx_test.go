@@ -0,0 +1,95 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestMockDB_WithTxContext(t *testing.T) {
+
+	serializationErr := &pq.Error{Code: SerializationFailureCode}
+
+	type testDef struct {
+		Errs      []error
+		CommitErr error
+		Attempts  int
+		HasErr    bool
+	}
+
+	Tests := []testDef{
+		{nil, nil, 1, false},
+		{[]error{serializationErr}, nil, 2, false},
+		{[]error{fmt.Errorf("updating user, %w", &pq.Error{Code: DeadlockDetectedCode})}, nil, 2, false},
+		{[]error{serializationErr, serializationErr, serializationErr}, nil, 3, true},
+		{[]error{errors.New("invalid user")}, nil, 1, true},
+		{nil, serializationErr, 3, true},
+	}
+
+	for idx, test := range Tests {
+
+		mockDb, mock, err := NewMockDB()
+
+		assert.NoError(t, err)
+
+		for attempt := 0; attempt < test.Attempts; attempt++ {
+
+			mock.ExpectBegin()
+
+			if attempt < len(test.Errs) {
+				mock.ExpectRollback()
+				continue
+			}
+
+			if test.CommitErr != nil {
+				mock.ExpectCommit().WillReturnError(test.CommitErr)
+				continue
+			}
+
+			mock.ExpectCommit()
+		}
+
+		attempts := 0
+
+		err = mockDb.WithTxContext(context.Background(), TxOptions{Isolation: sql.LevelSerializable, InitialBackoff: time.Millisecond}, func(tx AppSqlTx) error {
+
+			attempts++
+
+			if attempts <= len(test.Errs) {
+				return test.Errs[attempts-1]
+			}
+
+			return nil
+		})
+
+		assert.Equalf(t, test.HasErr, err != nil, "Failed test %d", idx)
+		assert.Equalf(t, test.Attempts, attempts, "Failed test %d", idx)
+		assert.NoErrorf(t, mock.ExpectationsWereMet(), "Failed test %d", idx)
+	}
+}
+
+func TestMockDB_WithTxContextDeadline(t *testing.T) {
+
+	mockDb, mock, err := NewMockDB()
+
+	assert.NoError(t, err)
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err = mockDb.WithTxContext(ctx, TxOptions{InitialBackoff: time.Second}, func(tx AppSqlTx) error {
+		return &pq.Error{Code: SerializationFailureCode}
+	})
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
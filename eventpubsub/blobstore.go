@@ -0,0 +1,226 @@
+package eventpubsub
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/app"
+	"github.com/HelloSundayMorning/apputils/db"
+	"github.com/HelloSundayMorning/apputils/log"
+	"golang.org/x/net/context"
+)
+
+type (
+	// PostgresBlobStore
+	// BlobStore implementation on the event_blob table
+	PostgresBlobStore struct {
+		AppID app.ApplicationID
+		sqlDb db.AppSqlDb
+	}
+
+	// FileBlobStore
+	// BlobStore implementation on a local directory. Meant for local development and tests,
+	// since publisher and consumers must share the same file system.
+	FileBlobStore struct {
+		AppID app.ApplicationID
+		dir   string
+	}
+)
+
+const (
+	// table recording the applied event_blob migrations
+	blobMigrationsTable = "event_blob_migrations"
+
+	insertBlob = `INSERT INTO event_blob (blob_key, blob, created_at)
+                                VALUES ($1, $2, $3)
+                                ON CONFLICT (blob_key) DO UPDATE SET
+                                blob = $2,
+                                created_at = $3`
+
+	findBlob = `SELECT blob FROM event_blob WHERE blob_key = $1`
+
+	deleteBlob = `DELETE FROM event_blob WHERE blob_key = $1`
+
+	deleteBlobsOlderThan = `DELETE FROM event_blob WHERE created_at < $1`
+)
+
+var (
+	//go:embed migrations/blob/*.sql
+	blobMigrations embed.FS
+)
+
+// NewPostgresBlobStore
+// Migrates the event_blob table to the latest version, see db.MigrateSchema
+func NewPostgresBlobStore(appID app.ApplicationID, sqlDb db.AppSqlDb) (store *PostgresBlobStore, err error) {
+
+	store = &PostgresBlobStore{
+		AppID: appID,
+		sqlDb: sqlDb,
+	}
+
+	err = db.MigrateSchema(context.Background(), sqlDb, blobMigrations, "migrations/blob", blobMigrationsTable)
+
+	if err != nil {
+		return nil, fmt.Errorf("error migrating event_blob table, %s", err)
+	}
+
+	log.PrintfNoContext(appID, component, "Postgres blob store initialized")
+
+	return store, nil
+}
+
+func (store *PostgresBlobStore) Put(ctx context.Context, key string, blob []byte) (err error) {
+
+	_, err = store.sqlDb.GetDB().ExecContext(ctx, insertBlob, key, blob, time.Now().UTC().UnixNano())
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (store *PostgresBlobStore) Get(ctx context.Context, key string) (blob []byte, err error) {
+
+	err = store.sqlDb.GetDB().QueryRowContext(ctx, findBlob, key).Scan(&blob)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrBlobNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return blob, nil
+}
+
+func (store *PostgresBlobStore) Delete(ctx context.Context, key string) (err error) {
+
+	_, err = store.sqlDb.GetDB().ExecContext(ctx, deleteBlob, key)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (store *PostgresBlobStore) DeleteOlderThan(ctx context.Context, before time.Time) (deleted int64, err error) {
+
+	result, err := store.sqlDb.GetDB().ExecContext(ctx, deleteBlobsOlderThan, before.UTC().UnixNano())
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func NewFileBlobStore(appID app.ApplicationID, dir string) (store *FileBlobStore, err error) {
+
+	err = os.MkdirAll(dir, 0700)
+
+	if err != nil {
+		return nil, fmt.Errorf("error creating blob store directory %s, %s", dir, err)
+	}
+
+	store = &FileBlobStore{
+		AppID: appID,
+		dir:   dir,
+	}
+
+	log.PrintfNoContext(appID, component, "File blob store initialized on %s", dir)
+
+	return store, nil
+}
+
+func (store *FileBlobStore) Put(ctx context.Context, key string, blob []byte) (err error) {
+
+	blobPath, err := store.blobPath(key)
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(blobPath, blob, 0600)
+}
+
+func (store *FileBlobStore) Get(ctx context.Context, key string) (blob []byte, err error) {
+
+	blobPath, err := store.blobPath(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err = ioutil.ReadFile(blobPath)
+
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return blob, nil
+}
+
+func (store *FileBlobStore) Delete(ctx context.Context, key string) (err error) {
+
+	blobPath, err := store.blobPath(key)
+
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(blobPath)
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (store *FileBlobStore) DeleteOlderThan(ctx context.Context, before time.Time) (deleted int64, err error) {
+
+	files, err := ioutil.ReadDir(store.dir)
+
+	if err != nil {
+		return 0, err
+	}
+
+	for _, file := range files {
+
+		if file.IsDir() || !file.ModTime().Before(before) {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(store.dir, file.Name()))
+
+		if err != nil && !os.IsNotExist(err) {
+			return deleted, err
+		}
+
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+func (store *FileBlobStore) blobPath(key string) (blobPath string, err error) {
+
+	if key == "" || strings.ContainsAny(key, `/\`) || key == "." || key == ".." {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+
+	return filepath.Join(store.dir, key), nil
+}
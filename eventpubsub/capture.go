@@ -0,0 +1,305 @@
+package eventpubsub
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/app"
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/HelloSundayMorning/apputils/log"
+	"github.com/streadway/amqp"
+	"golang.org/x/net/context"
+)
+
+type (
+	// DeliveryRecord
+	// A delivery captured by the DeliveryRecorder, one JSON line per delivery.
+	// JSON bodies are kept as they are to make the file readable, any other body is base64 encoded.
+	DeliveryRecord struct {
+		Timestamp     time.Time
+		EventType     string            `json:",omitempty"`
+		ContentType   string
+		CorrelationID string
+		FromAppID     string
+		SourceTopic   string `json:",omitempty"`
+		Headers       amqp.Table
+		Body          json.RawMessage `json:",omitempty"`
+		BodyBase64    []byte          `json:",omitempty"`
+		Error         string          `json:",omitempty"`
+	}
+
+	// DeliveryRecorder
+	// Captures the deliveries processed by a ProcessEvent to a JSONL file.
+	// Bodies are recorded decoded, so only enable it where the data can be stored in plain text.
+	DeliveryRecorder struct {
+		AppID  app.ApplicationID
+		mu     sync.Mutex
+		file   *os.File
+		writer *bufio.Writer
+	}
+
+	// ReplayOptions
+	// - EventTypes: replay only AppEvents of these types. All deliveries are replayed if empty
+	// - Speed: replay with the recorded interval between deliveries divided by Speed. 0 replays without waiting
+	// - Step: called before each delivery. Returning false stops the replay
+	// - StopOnError: stop the replay on the first handler error instead of logging it
+	ReplayOptions struct {
+		EventTypes  []string
+		Speed       float64
+		Step        func(record DeliveryRecord) (proceed bool)
+		StopOnError bool
+	}
+
+	deliveryHeadersKey struct{}
+)
+
+// NewDeliveryRecorder
+// Creates a recorder appending to the JSONL file in path
+func NewDeliveryRecorder(appID app.ApplicationID, path string) (recorder *DeliveryRecorder, err error) {
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return nil, fmt.Errorf("error opening delivery record file %s, %s", path, err)
+	}
+
+	recorder = &DeliveryRecorder{
+		AppID:  appID,
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}
+
+	log.PrintfNoContext(appID, component, "Recording deliveries to %s", path)
+
+	return recorder, nil
+}
+
+// Wrap
+// Returns a ProcessEvent that records each delivery with the processFunc result
+func (recorder *DeliveryRecorder) Wrap(processFunc ProcessEvent) ProcessEvent {
+
+	return func(ctx context.Context, event []byte, contentType string) error {
+
+		record := NewDeliveryRecord(ctx, event, contentType)
+
+		err := processFunc(ctx, event, contentType)
+
+		if err != nil {
+			record.Error = err.Error()
+		}
+
+		recordErr := recorder.write(record)
+
+		if recordErr != nil {
+			log.Errorf(ctx, component, "Error recording delivery, %s", recordErr)
+		}
+
+		return err
+	}
+}
+
+// Close
+// Flushes and closes the record file
+func (recorder *DeliveryRecorder) Close() (err error) {
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	err = recorder.writer.Flush()
+
+	if err != nil {
+		_ = recorder.file.Close()
+		return err
+	}
+
+	return recorder.file.Close()
+}
+
+func (recorder *DeliveryRecorder) write(record DeliveryRecord) (err error) {
+
+	line, err := json.Marshal(record)
+
+	if err != nil {
+		return err
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	_, err = recorder.writer.Write(append(line, '\n'))
+
+	if err != nil {
+		return err
+	}
+
+	return recorder.writer.Flush()
+}
+
+// NewDeliveryRecord
+// Creates the record of a delivery from the handler context and event, with all the delivery
+// headers when the context was created by a subscription
+func NewDeliveryRecord(ctx context.Context, event []byte, contentType string) (record DeliveryRecord) {
+
+	record = DeliveryRecord{
+		Timestamp:     time.Now().UTC(),
+		ContentType:   contentType,
+		CorrelationID: contextString(ctx, appctx.CorrelationIdHeader),
+		FromAppID:     contextString(ctx, appctx.FromAppIdHeader),
+		SourceTopic:   appctx.GetSourceTopic(ctx),
+		Headers:       amqp.Table{},
+	}
+
+	for key, value := range DeliveryHeaders(ctx) {
+		record.Headers[key] = value
+	}
+
+	if _, ok := record.Headers[appctx.AuthorizedUserIDHeader]; !ok {
+		record.Headers[appctx.AuthorizedUserIDHeader] = appctx.GetAuthorizedUserID(ctx)
+	}
+
+	if _, ok := record.Headers[appctx.AuthorizedUserRolesHeader]; !ok {
+		record.Headers[appctx.AuthorizedUserRolesHeader] = appctx.GetAuthorizedUserRoles(ctx)
+	}
+
+	if json.Valid(event) {
+		record.Body = event
+
+		appEvent, err := appevent.NewAppEventFromJSON(event)
+
+		if err == nil {
+			record.EventType = appEvent.EventType
+		}
+
+	} else {
+		record.BodyBase64 = event
+	}
+
+	return record
+}
+
+// Delivery
+// Returns the AMQP delivery the record was captured from
+func (record DeliveryRecord) Delivery() amqp.Delivery {
+
+	headers := amqp.Table{}
+
+	for key, value := range record.Headers {
+		headers[key] = value
+	}
+
+	body := []byte(record.Body)
+
+	if len(record.BodyBase64) > 0 {
+		body = record.BodyBase64
+	}
+
+	return amqp.Delivery{
+		Exchange:      record.SourceTopic,
+		AppId:         record.FromAppID,
+		CorrelationId: record.CorrelationID,
+		ContentType:   record.ContentType,
+		Headers:       headers,
+		Body:          body,
+	}
+}
+
+// ReplayDeliveries
+// Replays the deliveries recorded in the JSONL reader through the processFunc, with the
+// same context a subscription would create for them, including the source topic and headers. Returns the number of deliveries replayed.
+func ReplayDeliveries(appID app.ApplicationID, reader io.Reader, processFunc ProcessEvent, options ReplayOptions) (replayed int, err error) {
+
+	eventTypes := make(map[string]bool)
+
+	for _, eventType := range options.EventTypes {
+		eventTypes[eventType] = true
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	var previous time.Time
+	line := 0
+
+	for scanner.Scan() {
+
+		line++
+
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var record DeliveryRecord
+
+		err = json.Unmarshal(scanner.Bytes(), &record)
+
+		if err != nil {
+			return replayed, fmt.Errorf("invalid delivery record on line %d, %s", line, err)
+		}
+
+		if len(eventTypes) > 0 && !eventTypes[record.EventType] {
+			continue
+		}
+
+		if options.Speed > 0 && !previous.IsZero() && record.Timestamp.After(previous) {
+			time.Sleep(time.Duration(float64(record.Timestamp.Sub(previous)) / options.Speed))
+		}
+
+		previous = record.Timestamp
+
+		if options.Step != nil && !options.Step(record) {
+			return replayed, nil
+		}
+
+		delivery := record.Delivery()
+
+		ctx := withDeliveryHeaders(appctx.NewContextFromDelivery(appID, delivery), delivery.Headers)
+
+		err = processFunc(ctx, delivery.Body, delivery.ContentType)
+
+		replayed++
+
+		if err != nil {
+
+			if options.StopOnError {
+				return replayed, fmt.Errorf("error replaying delivery on line %d, %s", line, err)
+			}
+
+			log.Errorf(ctx, component, "Error replaying delivery on line %d, %s", line, err)
+		}
+	}
+
+	err = scanner.Err()
+
+	if err != nil {
+		return replayed, err
+	}
+
+	return replayed, nil
+}
+
+// DeliveryHeaders
+// Returns the headers of the delivery the subscription handler context was created for, nil otherwise
+func DeliveryHeaders(ctx context.Context) amqp.Table {
+
+	headers, _ := ctx.Value(deliveryHeadersKey{}).(amqp.Table)
+
+	return headers
+}
+
+func withDeliveryHeaders(ctx context.Context, headers amqp.Table) context.Context {
+
+	return context.WithValue(ctx, deliveryHeadersKey{}, headers)
+}
+
+func contextString(ctx context.Context, key string) string {
+
+	value, _ := ctx.Value(key).(string)
+
+	return value
+}
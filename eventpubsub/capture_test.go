@@ -0,0 +1,138 @@
+package eventpubsub
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestNewDeliveryRecord(t *testing.T) {
+
+	// a context not created by a subscription records the user headers of the context
+	ctx := appctx.NewContextFromValuesWithUser("testApp", "corrID", "userID")
+
+	record := NewDeliveryRecord(ctx, []byte(`{"EventType":"user_created"}`), "application/json")
+
+	assert.Equal(t, "user_created", record.EventType)
+	assert.Equal(t, "", record.SourceTopic)
+	assert.Equal(t, amqp.Table{appctx.AuthorizedUserIDHeader: "userID", appctx.AuthorizedUserRolesHeader: ""}, record.Headers)
+}
+
+func TestDeliveryRecorder_RecordAndReplay(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "capture")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "deliveries.jsonl")
+
+	recorder, err := NewDeliveryRecorder("testApp", path)
+
+	assert.Nil(t, err)
+
+	processFunc := recorder.Wrap(func(ctx context.Context, event []byte, contentType string) error {
+
+		if contentType == "text/plain" {
+			return errors.New("plain text not supported")
+		}
+
+		return nil
+	})
+
+	created := appevent.NewAppEvent("user_created", []byte(`{"userID":"1"}`))
+	createdJSON, _ := created.ToJSON()
+
+	deleted := appevent.NewAppEvent("user_deleted", []byte(`{"userID":"1"}`))
+	deletedJSON, _ := deleted.ToJSON()
+
+	ctx, cancel := newDeliveryContext(context.Background(), "testApp", amqp.Delivery{
+		Exchange:      "user",
+		AppId:         "fromApp",
+		CorrelationId: "corrID",
+		Headers: amqp.Table{
+			appctx.AuthorizedUserIDHeader:    "userID",
+			appctx.AuthorizedUserRolesHeader: "Admin",
+			DeliveryDeadlineHeader:           "2030-01-01T00:00:00Z",
+		},
+	}, 0)
+
+	defer cancel()
+
+	assert.Nil(t, processFunc(ctx, createdJSON, "application/json"))
+	assert.Nil(t, processFunc(ctx, deletedJSON, "application/json"))
+	assert.NotNil(t, processFunc(ctx, []byte("plain"), "text/plain"))
+
+	assert.Nil(t, recorder.Close())
+
+	type replayed struct {
+		event         string
+		correlationID string
+		fromAppID     string
+		userID        string
+		roles         string
+		sourceTopic   string
+		deadline      interface{}
+	}
+
+	var received []replayed
+
+	replayFunc := func(ctx context.Context, event []byte, contentType string) error {
+
+		received = append(received, replayed{
+			event:         string(event),
+			correlationID: ctx.Value(appctx.CorrelationIdHeader).(string),
+			fromAppID:     ctx.Value(appctx.FromAppIdHeader).(string),
+			userID:        appctx.GetAuthorizedUserID(ctx),
+			roles:         appctx.GetAuthorizedUserRoles(ctx),
+			sourceTopic:   appctx.GetSourceTopic(ctx),
+			deadline:      DeliveryHeaders(ctx)[DeliveryDeadlineHeader],
+		})
+
+		return nil
+	}
+
+	file, _ := os.Open(path)
+
+	count, err := ReplayDeliveries("testApp", file, replayFunc, ReplayOptions{})
+
+	_ = file.Close()
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, replayed{string(createdJSON), "corrID", "fromApp", "userID", "Admin", "user", "2030-01-01T00:00:00Z"}, received[0])
+	assert.Equal(t, "plain", received[2].event)
+
+	received = nil
+
+	file, _ = os.Open(path)
+
+	count, err = ReplayDeliveries("testApp", file, replayFunc, ReplayOptions{
+		EventTypes: []string{"user_deleted"},
+	})
+
+	_ = file.Close()
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, string(deletedJSON), received[0].event)
+
+	file, _ = os.Open(path)
+
+	count, err = ReplayDeliveries("testApp", file, replayFunc, ReplayOptions{
+		Step: func(record DeliveryRecord) (proceed bool) {
+			return record.EventType != "user_deleted"
+		},
+	})
+
+	_ = file.Close()
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+}
@@ -0,0 +1,164 @@
+package eventpubsub
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/log"
+	"github.com/streadway/amqp"
+	"golang.org/x/net/context"
+)
+
+type (
+	// BlobStore
+	// Storage for event payloads offloaded by the claim-check pattern.
+	// Blobs are stored by the message ID of the event that references them.
+	BlobStore interface {
+		Put(ctx context.Context, key string, blob []byte) (err error)
+		Get(ctx context.Context, key string) (blob []byte, err error)
+		Delete(ctx context.Context, key string) (err error)
+		DeleteOlderThan(ctx context.Context, before time.Time) (deleted int64, err error)
+	}
+
+	claimCheck struct {
+		store           BlobStore
+		thresholdBytes  int
+		deleteOnConsume bool
+		collectorChan   chan bool
+	}
+)
+
+const (
+	// ClaimCheckHeader holds the blob store key of a payload offloaded by the publisher
+	ClaimCheckHeader = "x-claim-check"
+)
+
+var (
+	ErrBlobNotFound = errors.New("blob not found")
+)
+
+// EnableClaimCheck
+// Offloads event payloads bigger than thresholdBytes to the blob store and publishes a reference
+// in the x-claim-check header instead. Deliveries with the header get the payload back from the
+// store before processing.
+//
+// deleteOnConsume removes the payload once the delivery is acknowledged. It's only safe when a
+// single app consumes the topic, otherwise leave it false and run StartClaimCheckCollector.
+func (rabbit *RabbitMq) EnableClaimCheck(store BlobStore, thresholdBytes int, deleteOnConsume bool) {
+
+	rabbit.claimCheck = &claimCheck{
+		store:           store,
+		thresholdBytes:  thresholdBytes,
+		deleteOnConsume: deleteOnConsume,
+	}
+
+	log.PrintfNoContext(rabbit.AppID, component, "Claim check enabled for payloads bigger than %d bytes", thresholdBytes)
+}
+
+// StartClaimCheckCollector
+// Periodically deletes payloads older than maxAge from the blob store.
+// The collector stops on CleanUp.
+func (rabbit *RabbitMq) StartClaimCheckCollector(maxAge, interval time.Duration) (err error) {
+
+	if rabbit.claimCheck == nil {
+		return fmt.Errorf("claim check is not enabled for app %s", rabbit.AppID)
+	}
+
+	if rabbit.claimCheck.collectorChan != nil {
+		return fmt.Errorf("claim check collector already started for app %s", rabbit.AppID)
+	}
+
+	collectorChan := make(chan bool)
+	rabbit.claimCheck.collectorChan = collectorChan
+
+	store := rabbit.claimCheck.store
+
+	go func() {
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+
+				deleted, err := store.DeleteOlderThan(context.Background(), time.Now().Add(-maxAge))
+
+				if err != nil {
+					log.ErrorfNoContext(rabbit.AppID, component, "Error collecting claim check payloads, %s", err)
+					continue
+				}
+
+				if deleted > 0 {
+					log.PrintfNoContext(rabbit.AppID, component, "Collected %d claim check payloads older than %s", deleted, maxAge)
+				}
+
+			case <-collectorChan:
+				return
+			}
+		}
+	}()
+
+	log.PrintfNoContext(rabbit.AppID, component, "Claim check collector started. Max age %s, interval %s", maxAge, interval)
+
+	return nil
+}
+
+// checkIn
+// Moves the publishing body to the blob store if it's over the threshold
+func (check *claimCheck) checkIn(ctx context.Context, publishing *amqp.Publishing) (err error) {
+
+	if len(publishing.Body) <= check.thresholdBytes {
+		return nil
+	}
+
+	err = check.store.Put(ctx, publishing.MessageId, publishing.Body)
+
+	if err != nil {
+		return fmt.Errorf("error storing claim check payload for message %s, %s", publishing.MessageId, err)
+	}
+
+	log.Printf(ctx, component, "Payload of %d bytes offloaded to claim check %s", len(publishing.Body), publishing.MessageId)
+
+	publishing.Headers[ClaimCheckHeader] = publishing.MessageId
+	publishing.Body = []byte{}
+
+	return nil
+}
+
+// checkOut
+// Returns the delivery payload, fetching it from the blob store when the delivery has a claim check
+func (check *claimCheck) checkOut(ctx context.Context, delivery amqp.Delivery) (body []byte, err error) {
+
+	key, ok := delivery.Headers[ClaimCheckHeader].(string)
+
+	if !ok || key == "" {
+		return delivery.Body, nil
+	}
+
+	body, err = check.store.Get(ctx, key)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting claim check payload %s, %s", key, err)
+	}
+
+	return body, nil
+}
+
+// release
+// Deletes the delivery payload from the blob store if configured to
+func (check *claimCheck) release(ctx context.Context, delivery amqp.Delivery) {
+
+	key, ok := delivery.Headers[ClaimCheckHeader].(string)
+
+	if !ok || key == "" || !check.deleteOnConsume {
+		return
+	}
+
+	err := check.store.Delete(ctx, key)
+
+	if err != nil {
+		log.Errorf(ctx, component, "Error deleting claim check payload %s, %s", key, err)
+	}
+}
@@ -0,0 +1,127 @@
+package eventpubsub
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/db"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestFileBlobStore(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "blobstore")
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileBlobStore("testApp", dir)
+
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+
+	err = store.Put(ctx, "key1", []byte("payload"))
+
+	assert.Nil(t, err)
+
+	blob, err := store.Get(ctx, "key1")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "payload", string(blob))
+
+	_, err = store.Get(ctx, "missing")
+
+	assert.Equal(t, ErrBlobNotFound, err)
+
+	err = store.Put(ctx, "../escape", []byte("payload"))
+
+	assert.NotNil(t, err)
+
+	deleted, err := store.DeleteOlderThan(ctx, time.Now().Add(-time.Hour))
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), deleted)
+
+	deleted, err = store.DeleteOlderThan(ctx, time.Now().Add(time.Hour))
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	err = store.Delete(ctx, "key1")
+
+	assert.Nil(t, err)
+}
+
+func TestPostgresBlobStore(t *testing.T) {
+
+	mockDb, mock, err := db.NewMockDB()
+
+	assert.NoError(t, err)
+
+	expectMigrations(mock, blobMigrationsTable, "CREATE TABLE IF NOT EXISTS event_blob")
+
+	store, err := NewPostgresBlobStore("testApp", mockDb)
+
+	assert.NoError(t, err)
+
+	mock.ExpectQuery("SELECT blob FROM event_blob").WithArgs("key1").WillReturnRows(sqlmock.NewRows([]string{"blob"}))
+
+	_, err = store.Get(context.Background(), "key1")
+
+	assert.Equal(t, ErrBlobNotFound, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClaimCheck_CheckInCheckOut(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "claimcheck")
+	defer os.RemoveAll(dir)
+
+	store, _ := NewFileBlobStore("testApp", dir)
+
+	check := &claimCheck{
+		store:           store,
+		thresholdBytes:  10,
+		deleteOnConsume: true,
+	}
+
+	ctx := context.Background()
+
+	small := amqp.Publishing{MessageId: "small", Body: []byte("tiny"), Headers: amqp.Table{}}
+
+	err := check.checkIn(ctx, &small)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "tiny", string(small.Body))
+	assert.Nil(t, small.Headers[ClaimCheckHeader])
+
+	large := amqp.Publishing{MessageId: "large", Body: []byte("a payload over the threshold"), Headers: amqp.Table{}}
+
+	err = check.checkIn(ctx, &large)
+
+	assert.Nil(t, err)
+	assert.Empty(t, large.Body)
+	assert.Equal(t, "large", large.Headers[ClaimCheckHeader])
+
+	delivery := amqp.Delivery{MessageId: large.MessageId, Body: large.Body, Headers: large.Headers}
+
+	body, err := check.checkOut(ctx, delivery)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "a payload over the threshold", string(body))
+
+	check.release(ctx, delivery)
+
+	_, err = check.checkOut(ctx, delivery)
+
+	assert.NotNil(t, err)
+
+	body, err = check.checkOut(ctx, amqp.Delivery{Body: []byte("tiny")})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "tiny", string(body))
+}
@@ -0,0 +1,135 @@
+package eventpubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/HelloSundayMorning/apputils/log"
+	"github.com/klauspost/compress/zstd"
+	"github.com/streadway/amqp"
+)
+
+type (
+	// Compression
+	// Body compression algorithm, set as the AMQP ContentEncoding of the message
+	Compression string
+
+	compressor struct {
+		compression    Compression
+		thresholdBytes int
+	}
+)
+
+const (
+	GzipCompression = Compression("gzip")
+	ZstdCompression = Compression("zstd")
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// EnableCompression
+// Compresses published bodies bigger than thresholdBytes and sets the AMQP ContentEncoding.
+// Deliveries are always decompressed according to their ContentEncoding, so consumers
+// handle compressed and uncompressed messages whether compression is enabled or not.
+func (rabbit *RabbitMq) EnableCompression(compression Compression, thresholdBytes int) (err error) {
+
+	if compression != GzipCompression && compression != ZstdCompression {
+		return fmt.Errorf("invalid compression %s. Expected %s | %s", compression, GzipCompression, ZstdCompression)
+	}
+
+	rabbit.compressor = &compressor{
+		compression:    compression,
+		thresholdBytes: thresholdBytes,
+	}
+
+	log.PrintfNoContext(rabbit.AppID, component, "Compression %s enabled for payloads bigger than %d bytes", compression, thresholdBytes)
+
+	return nil
+}
+
+// compress
+// Compresses the publishing body if it's over the threshold
+func (c *compressor) compress(publishing *amqp.Publishing) (err error) {
+
+	if len(publishing.Body) <= c.thresholdBytes {
+		return nil
+	}
+
+	switch c.compression {
+	case GzipCompression:
+
+		var buf bytes.Buffer
+
+		writer := gzip.NewWriter(&buf)
+
+		_, err = writer.Write(publishing.Body)
+
+		if err != nil {
+			return fmt.Errorf("error compressing body with gzip, %s", err)
+		}
+
+		err = writer.Close()
+
+		if err != nil {
+			return fmt.Errorf("error compressing body with gzip, %s", err)
+		}
+
+		publishing.Body = buf.Bytes()
+
+	case ZstdCompression:
+
+		publishing.Body = zstdEncoder.EncodeAll(publishing.Body, nil)
+
+	}
+
+	publishing.ContentEncoding = string(c.compression)
+
+	return nil
+}
+
+// decompress
+// Returns the delivery body decompressed according to the delivery ContentEncoding.
+// Deliveries without encoding are returned as they are.
+func decompress(delivery amqp.Delivery) (body []byte, err error) {
+
+	switch Compression(delivery.ContentEncoding) {
+	case "":
+
+		return delivery.Body, nil
+
+	case GzipCompression:
+
+		reader, err := gzip.NewReader(bytes.NewReader(delivery.Body))
+
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing gzip body, %s", err)
+		}
+
+		body, err = ioutil.ReadAll(reader)
+
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing gzip body, %s", err)
+		}
+
+		return body, nil
+
+	case ZstdCompression:
+
+		body, err = zstdDecoder.DecodeAll(delivery.Body, nil)
+
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing zstd body, %s", err)
+		}
+
+		return body, nil
+
+	default:
+
+		return nil, fmt.Errorf("unsupported content encoding %s", delivery.ContentEncoding)
+	}
+}
@@ -0,0 +1,57 @@
+package eventpubsub
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressor_Compress(t *testing.T) {
+
+	payload := []byte(strings.Repeat("compressible payload ", 100))
+
+	for _, compression := range []Compression{GzipCompression, ZstdCompression} {
+
+		c := &compressor{compression: compression, thresholdBytes: 100}
+
+		small := amqp.Publishing{Body: []byte("small")}
+
+		err := c.compress(&small)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "", small.ContentEncoding)
+		assert.Equal(t, "small", string(small.Body))
+
+		large := amqp.Publishing{Body: payload}
+
+		err = c.compress(&large)
+
+		assert.Nil(t, err)
+		assert.Equal(t, string(compression), large.ContentEncoding)
+		assert.True(t, len(large.Body) < len(payload))
+
+		body, err := decompress(amqp.Delivery{Body: large.Body, ContentEncoding: large.ContentEncoding})
+
+		assert.Nil(t, err)
+		assert.Equal(t, payload, body)
+	}
+}
+
+func TestDecompress(t *testing.T) {
+
+	body, err := decompress(amqp.Delivery{Body: []byte("plain")})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "plain", string(body))
+
+	_, err = decompress(amqp.Delivery{Body: []byte("plain"), ContentEncoding: "br"})
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "unsupported content encoding br", err.Error())
+
+	_, err = decompress(amqp.Delivery{Body: []byte("not gzip"), ContentEncoding: "gzip"})
+
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,103 @@
+package eventpubsub
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+
+	"github.com/HelloSundayMorning/apputils/app"
+	"github.com/HelloSundayMorning/apputils/db"
+)
+
+type (
+	// Backend
+	// The EventPubSub implementation created by NewEventPubSub
+	Backend string
+
+	// Config
+	// Selects and configures the EventPubSub backend, so services can switch backends
+	// without code changes.
+	// - RabbitMQ: RabbitUser, RabbitPassword and RabbitHost
+	// - Postgres: PostgresDataSource, the connection string used for the tables and LISTEN/NOTIFY
+	// Schema validation, claim check, compression, encryption and signing are only supported by
+	// RabbitMq. Apps enabling them on the *RabbitMq can't switch to the Postgres backend.
+	Config struct {
+		Backend            Backend
+		RabbitUser         string
+		RabbitPassword     string
+		RabbitHost         string
+		PostgresDataSource string
+	}
+)
+
+const (
+	RabbitMqBackend Backend = "rabbitmq"
+	PostgresBackend Backend = "postgres"
+
+	BackendEnv            = "EVENTPUBSUB_BACKEND"
+	RabbitUserEnv         = "RABBITMQ_USER"
+	RabbitPasswordEnv     = "RABBITMQ_PASSWORD"
+	RabbitHostEnv         = "RABBITMQ_HOST"
+	PostgresDataSourceEnv = "EVENTPUBSUB_POSTGRES_DSN"
+)
+
+// NewConfigFromEnv
+// Reads the backend config from the environment. The backend defaults to RabbitMQ.
+func NewConfigFromEnv() (config Config) {
+
+	config = Config{
+		Backend:            Backend(os.Getenv(BackendEnv)),
+		RabbitUser:         os.Getenv(RabbitUserEnv),
+		RabbitPassword:     os.Getenv(RabbitPasswordEnv),
+		RabbitHost:         os.Getenv(RabbitHostEnv),
+		PostgresDataSource: os.Getenv(PostgresDataSourceEnv),
+	}
+
+	if config.Backend == "" {
+		config.Backend = RabbitMqBackend
+	}
+
+	return config
+}
+
+// NewEventPubSub
+// Creates the EventPubSub for the configured backend. The Postgres connection pool it opens is closed by CleanUp.
+func NewEventPubSub(appID app.ApplicationID, config Config) (pubSub EventPubSub, err error) {
+
+	switch config.Backend {
+	case RabbitMqBackend, "":
+		rabbit, err := NewRabbitMq(appID, config.RabbitUser, config.RabbitPassword, config.RabbitHost)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return rabbit, nil
+
+	case PostgresBackend:
+
+		if config.PostgresDataSource == "" {
+			return nil, fmt.Errorf("missing postgres data source for %s backend", config.Backend)
+		}
+
+		sqlDb, err := sql.Open("postgres", config.PostgresDataSource)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pgPubSub, err := NewPostgresPubSub(appID, &db.PostgresDB{DB: sqlDb}, config.PostgresDataSource)
+
+		if err != nil {
+			_ = sqlDb.Close()
+			return nil, err
+		}
+
+		pgPubSub.ownedDb = sqlDb
+
+		return pgPubSub, nil
+
+	default:
+		return nil, fmt.Errorf("unknown event pub/sub backend %s", config.Backend)
+	}
+}
@@ -0,0 +1,101 @@
+package eventpubsub
+
+import (
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/app"
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/streadway/amqp"
+	"golang.org/x/net/context"
+)
+
+type (
+	deliveryDeadlineKey struct{}
+)
+
+const (
+	// DeliveryDeadlineHeader is the RFC 3339 time the publisher expects the event to be processed by
+	DeliveryDeadlineHeader = "x-delivery-deadline"
+)
+
+// WithDeliveryDeadline
+// Returns a context to publish events that must be processed by the deadline.
+// The deadline is sent in the x-delivery-deadline header and shortens the delivery timeout
+// of the subscriber handler context.
+func WithDeliveryDeadline(ctx context.Context, deadline time.Time) context.Context {
+
+	return context.WithValue(ctx, deliveryDeadlineKey{}, deadline)
+}
+
+// setDeliveryDeadline
+// Adds the deadline header to the publishing when the context has a delivery deadline
+func setDeliveryDeadline(ctx context.Context, publishing *amqp.Publishing) {
+
+	deadline, ok := ctx.Value(deliveryDeadlineKey{}).(time.Time)
+
+	if !ok || deadline.IsZero() {
+		return
+	}
+
+	publishing.Headers[DeliveryDeadlineHeader] = deadline.UTC().Format(time.RFC3339Nano)
+}
+
+// newDeliveryContext
+// Creates the handler context of a delivery, with its headers, derived from the subscription context
+// so it's cancelled on UnSubscribe and CleanUp. The context expires after the timeout, or by the deadline header if
+// it's earlier. No timeout and no header means no deadline.
+func newDeliveryContext(parent context.Context, appID app.ApplicationID, delivery amqp.Delivery, timeout time.Duration) (ctx context.Context, cancel context.CancelFunc) {
+
+	ctx = withDeliveryHeaders(appctx.NewContextFromDeliveryWithParent(parent, appID, delivery), delivery.Headers)
+
+	var deadline time.Time
+
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	if value, ok := delivery.Headers[DeliveryDeadlineHeader].(string); ok {
+
+		headerDeadline, err := time.Parse(time.RFC3339Nano, value)
+
+		if err == nil && (deadline.IsZero() || headerDeadline.Before(deadline)) {
+			deadline = headerDeadline
+		}
+	}
+
+	if deadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithDeadline(ctx, deadline)
+}
+
+// deliveryFailure
+// Returns the error to nack a delivery with after the handler returned, the handler error or
+// the context error when the handler exceeded the deadline
+func deliveryFailure(ctx context.Context, processErr error) error {
+
+	if processErr != nil {
+		return processErr
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return ctx.Err()
+	}
+
+	return nil
+}
+
+// subscriptionContext
+// Returns a context cancelled when the subscription channel closes
+func subscriptionContext(subChan chan bool) context.Context {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		<-subChan
+		cancel()
+	}()
+
+	return ctx
+}
@@ -0,0 +1,98 @@
+package eventpubsub
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestNewDeliveryContext(t *testing.T) {
+
+	now := time.Now()
+
+	type testDef struct {
+		Timeout        time.Duration
+		HeaderDeadline time.Time
+		HasDeadline    bool
+		Expected       time.Time
+	}
+
+	Tests := []testDef{
+		{0, time.Time{}, false, time.Time{}},
+		{time.Minute, time.Time{}, true, now.Add(time.Minute)},
+		{time.Minute, now.Add(time.Second), true, now.Add(time.Second)},
+		{time.Second, now.Add(time.Minute), true, now.Add(time.Second)},
+		{0, now.Add(time.Minute), true, now.Add(time.Minute)},
+	}
+
+	for idx, test := range Tests {
+
+		delivery := amqp.Delivery{Exchange: "user", Headers: amqp.Table{}}
+
+		if !test.HeaderDeadline.IsZero() {
+			delivery.Headers[DeliveryDeadlineHeader] = test.HeaderDeadline.Format(time.RFC3339Nano)
+		}
+
+		ctx, cancel := newDeliveryContext(context.Background(), "testApp", delivery, test.Timeout)
+
+		deadline, ok := ctx.Deadline()
+
+		assert.Equalf(t, test.HasDeadline, ok, "Failed test %d", idx)
+		assert.WithinDurationf(t, test.Expected, deadline, 100*time.Millisecond, "Failed test %d", idx)
+		assert.Equalf(t, "user", appctx.GetSourceTopic(ctx), "Failed test %d", idx)
+
+		cancel()
+	}
+}
+
+func TestNewDeliveryContext_Cancelled(t *testing.T) {
+
+	subChan := make(chan bool)
+
+	ctx, cancel := newDeliveryContext(subscriptionContext(subChan), "testApp", amqp.Delivery{}, 0)
+	defer cancel()
+
+	close(subChan)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("delivery context not cancelled when the subscription ended")
+	}
+
+	assert.Equal(t, context.Canceled, ctx.Err())
+}
+
+func TestDeliveryFailure(t *testing.T) {
+
+	processErr := errors.New("failed")
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	assert.Nil(t, deliveryFailure(context.Background(), nil))
+	assert.Equal(t, processErr, deliveryFailure(context.Background(), processErr))
+	assert.Equal(t, context.DeadlineExceeded, deliveryFailure(expired, nil))
+}
+
+func TestWithDeliveryDeadline(t *testing.T) {
+
+	deadline := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+
+	ctx := appctx.NewContextFromValues("testApp", "corrID")
+
+	publishing, err := newContextPublishing(ctx, []byte("testEvent"), "text/plain")
+
+	assert.Nil(t, err)
+	assert.Nil(t, publishing.Headers[DeliveryDeadlineHeader])
+
+	publishing, err = newContextPublishing(WithDeliveryDeadline(ctx, deadline), []byte("testEvent"), "text/plain")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "2020-01-02T03:04:05.000000006Z", publishing.Headers[DeliveryDeadlineHeader])
+}
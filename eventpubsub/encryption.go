@@ -0,0 +1,383 @@
+package eventpubsub
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/HelloSundayMorning/apputils/log"
+	"github.com/streadway/amqp"
+	"golang.org/x/net/context"
+)
+
+type (
+	// KeyProvider
+	// Provides the key encryption keys per topic. Keys must be 16, 24 or 32 bytes long (AES-128, AES-192 or AES-256).
+	// CurrentKey returns ErrNoTopicKey for topics that are not encrypted.
+	KeyProvider interface {
+		CurrentKey(ctx context.Context, topic string) (keyID string, key []byte, err error)
+		Key(ctx context.Context, topic, keyID string) (key []byte, err error)
+	}
+
+	// StaticKeyProvider
+	// KeyProvider with keys held in memory, usually loaded from env variables or secrets.
+	// Old keys are kept to decrypt events published before a rotation.
+	StaticKeyProvider struct {
+		currentKeyIDs map[string]string
+		keys          map[string]map[string][]byte
+	}
+
+	encryptor struct {
+		provider KeyProvider
+		fields   map[string][]string
+	}
+)
+
+const (
+	// EncryptionKeyIDHeader is the ID of the topic key that wraps the message data key
+	EncryptionKeyIDHeader = "x-encryption-key-id"
+	// EncryptionDataKeyHeader is the message data key, encrypted with the topic key and base64 encoded
+	EncryptionDataKeyHeader = "x-encryption-data-key"
+	// EncryptedFieldsHeader lists the encrypted Data fields. Empty when the whole Data is encrypted.
+	EncryptedFieldsHeader = "x-encrypted-fields"
+
+	dataKeySize = 32
+)
+
+var (
+	ErrNoTopicKey = errors.New("no encryption key for topic")
+)
+
+func NewStaticKeyProvider() *StaticKeyProvider {
+
+	return &StaticKeyProvider{
+		currentKeyIDs: make(map[string]string),
+		keys:          make(map[string]map[string][]byte),
+	}
+}
+
+// AddKey
+// Adds a key for the topic. The last key added to a topic is used to encrypt.
+func (provider *StaticKeyProvider) AddKey(topic, keyID string, key []byte) (err error) {
+
+	_, err = aes.NewCipher(key)
+
+	if err != nil {
+		return fmt.Errorf("invalid key %s for topic %s, %s", keyID, topic, err)
+	}
+
+	if provider.keys[topic] == nil {
+		provider.keys[topic] = make(map[string][]byte)
+	}
+
+	provider.keys[topic][keyID] = key
+	provider.currentKeyIDs[topic] = keyID
+
+	return nil
+}
+
+func (provider *StaticKeyProvider) CurrentKey(ctx context.Context, topic string) (keyID string, key []byte, err error) {
+
+	keyID, ok := provider.currentKeyIDs[topic]
+
+	if !ok {
+		return "", nil, ErrNoTopicKey
+	}
+
+	return keyID, provider.keys[topic][keyID], nil
+}
+
+func (provider *StaticKeyProvider) Key(ctx context.Context, topic, keyID string) (key []byte, err error) {
+
+	key, ok := provider.keys[topic][keyID]
+
+	if !ok {
+		return nil, fmt.Errorf("key %s not found for topic %s", keyID, topic)
+	}
+
+	return key, nil
+}
+
+// EnableEncryption
+// Encrypts the Data of AppEvents published to topics with a key in the provider.
+// Each message is encrypted with a new data key, which is sent encrypted with the topic key
+// in the message headers along with the topic key ID.
+//
+// fields maps event types to the Data fields to encrypt, in dot notation for nested fields
+// (i.e. "user.email"). The whole Data is encrypted for event types not in fields.
+// Deliveries with encryption headers are decrypted before processing.
+func (rabbit *RabbitMq) EnableEncryption(provider KeyProvider, fields map[string][]string) {
+
+	if fields == nil {
+		fields = make(map[string][]string)
+	}
+
+	rabbit.encryptor = &encryptor{
+		provider: provider,
+		fields:   fields,
+	}
+
+	log.PrintfNoContext(rabbit.AppID, component, "Encryption enabled")
+}
+
+// encrypt
+// Encrypts the AppEvent Data of the publishing with the current topic key
+func (enc *encryptor) encrypt(ctx context.Context, topic string, publishing *amqp.Publishing) (err error) {
+
+	if !strings.HasPrefix(publishing.ContentType, jsonContentType) {
+		return nil
+	}
+
+	keyID, key, err := enc.provider.CurrentKey(ctx, topic)
+
+	if err == ErrNoTopicKey {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("error getting encryption key for topic %s, %s", topic, err)
+	}
+
+	appEvent, err := appevent.NewAppEventFromJSON(publishing.Body)
+
+	if err != nil {
+		return err
+	}
+
+	dataKey := make([]byte, dataKeySize)
+
+	_, err = io.ReadFull(rand.Reader, dataKey)
+
+	if err != nil {
+		return fmt.Errorf("error generating data key, %s", err)
+	}
+
+	fields := enc.fields[appEvent.EventType]
+
+	if len(fields) == 0 {
+
+		appEvent.Data, err = sealJSON(dataKey, appEvent.Data)
+
+	} else {
+
+		appEvent.Data, err = transformFields(appEvent.Data, fields, func(value json.RawMessage) (json.RawMessage, error) {
+			return sealJSON(dataKey, value)
+		})
+	}
+
+	if err != nil {
+		return fmt.Errorf("error encrypting event %s, %s", appEvent.EventType, err)
+	}
+
+	wrappedKey, err := seal(key, dataKey)
+
+	if err != nil {
+		return fmt.Errorf("error encrypting data key, %s", err)
+	}
+
+	publishing.Body, err = appEvent.ToJSON()
+
+	if err != nil {
+		return err
+	}
+
+	publishing.Headers[EncryptionKeyIDHeader] = keyID
+	publishing.Headers[EncryptionDataKeyHeader] = base64.StdEncoding.EncodeToString(wrappedKey)
+	publishing.Headers[EncryptedFieldsHeader] = strings.Join(fields, ",")
+
+	return nil
+}
+
+// decrypt
+// Returns the delivery body with the AppEvent Data decrypted. Deliveries without
+// encryption headers are returned as they are.
+func (enc *encryptor) decrypt(ctx context.Context, topic string, delivery amqp.Delivery) (body []byte, err error) {
+
+	keyID, ok := delivery.Headers[EncryptionKeyIDHeader].(string)
+
+	if !ok || keyID == "" {
+		return delivery.Body, nil
+	}
+
+	key, err := enc.provider.Key(ctx, topic, keyID)
+
+	if err != nil {
+		return nil, fmt.Errorf("error getting encryption key %s for topic %s, %s", keyID, topic, err)
+	}
+
+	wrappedKey, _ := delivery.Headers[EncryptionDataKeyHeader].(string)
+
+	wrappedKeyBytes, err := base64.StdEncoding.DecodeString(wrappedKey)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key header, %s", err)
+	}
+
+	dataKey, err := open(key, wrappedKeyBytes)
+
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data key, %s", err)
+	}
+
+	appEvent, err := appevent.NewAppEventFromJSON(delivery.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fieldsHeader, _ := delivery.Headers[EncryptedFieldsHeader].(string)
+
+	if fieldsHeader == "" {
+
+		appEvent.Data, err = openJSON(dataKey, appEvent.Data)
+
+	} else {
+
+		appEvent.Data, err = transformFields(appEvent.Data, strings.Split(fieldsHeader, ","), func(value json.RawMessage) (json.RawMessage, error) {
+			return openJSON(dataKey, value)
+		})
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting event %s, %s", appEvent.EventType, err)
+	}
+
+	return appEvent.ToJSON()
+}
+
+// transformFields
+// Replaces the value of each field in the JSON object. Fields are in dot notation for nested objects.
+// Fields not present in the object are ignored.
+func transformFields(data json.RawMessage, fields []string, transform func(value json.RawMessage) (json.RawMessage, error)) (json.RawMessage, error) {
+
+	var object map[string]json.RawMessage
+
+	err := json.Unmarshal(data, &object)
+
+	if err != nil {
+		return nil, fmt.Errorf("data is not a JSON object, %s", err)
+	}
+
+	nested := make(map[string][]string)
+
+	for _, field := range fields {
+
+		parts := strings.SplitN(field, ".", 2)
+
+		value, ok := object[parts[0]]
+
+		if !ok {
+			continue
+		}
+
+		if len(parts) == 2 {
+			nested[parts[0]] = append(nested[parts[0]], parts[1])
+			continue
+		}
+
+		object[parts[0]], err = transform(value)
+
+		if err != nil {
+			return nil, fmt.Errorf("field %s, %s", field, err)
+		}
+	}
+
+	for field, nestedFields := range nested {
+
+		object[field], err = transformFields(object[field], nestedFields, transform)
+
+		if err != nil {
+			return nil, fmt.Errorf("field %s, %s", field, err)
+		}
+	}
+
+	return json.Marshal(object)
+}
+
+// sealJSON
+// Encrypts the JSON value into a base64 JSON string
+func sealJSON(key []byte, value json.RawMessage) (json.RawMessage, error) {
+
+	sealed, err := seal(key, value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(base64.StdEncoding.EncodeToString(sealed))
+}
+
+// openJSON
+// Decrypts the base64 JSON string created by sealJSON back to the JSON value
+func openJSON(key []byte, value json.RawMessage) (json.RawMessage, error) {
+
+	var encoded string
+
+	err := json.Unmarshal(value, &encoded)
+
+	if err != nil {
+		return nil, fmt.Errorf("encrypted value is not a string, %s", err)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return open(key, sealed)
+}
+
+// seal
+// AES-GCM encryption with the random nonce prepended to the cipher text
+func seal(key, plainText []byte) ([]byte, error) {
+
+	gcm, err := newGCM(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+
+	_, err = io.ReadFull(rand.Reader, nonce)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plainText, nil), nil
+}
+
+func open(key, sealed []byte) ([]byte, error) {
+
+	gcm, err := newGCM(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted value too short")
+	}
+
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
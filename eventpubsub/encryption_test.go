@@ -0,0 +1,104 @@
+package eventpubsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestEncryptor_EncryptDecrypt(t *testing.T) {
+
+	provider := NewStaticKeyProvider()
+
+	err := provider.AddKey("user", "key1", bytes.Repeat([]byte("k"), 32))
+
+	assert.Nil(t, err)
+
+	err = provider.AddKey("user", "bad", []byte("short"))
+
+	assert.NotNil(t, err)
+
+	enc := &encryptor{
+		provider: provider,
+		fields: map[string][]string{
+			"user_updated": {"email", "profile.phone"},
+		},
+	}
+
+	ctx := context.Background()
+
+	type testDef struct {
+		Topic     string
+		EventType string
+		Data      string
+		Encrypted bool
+	}
+
+	Tests := []testDef{
+		{"user", "user_created", `{"userID":"1","email":"a@b.c"}`, true},
+		{"user", "user_updated", `{"email":"a@b.c","profile":{"phone":"123","name":"A"},"userID":"1"}`, true},
+		{"chat", "chat_created", `{"chatID":"1"}`, false},
+	}
+
+	for idx, test := range Tests {
+
+		appEvent := appevent.NewAppEvent(test.EventType, json.RawMessage(test.Data))
+		event, _ := appEvent.ToJSON()
+
+		publishing := amqp.Publishing{ContentType: "application/json", Body: event, Headers: amqp.Table{}}
+
+		err = enc.encrypt(ctx, test.Topic, &publishing)
+
+		assert.Nilf(t, err, "Failed test %d", idx)
+
+		if !test.Encrypted {
+			assert.Equalf(t, event, publishing.Body, "Failed test %d", idx)
+			assert.Nilf(t, publishing.Headers[EncryptionKeyIDHeader], "Failed test %d", idx)
+			continue
+		}
+
+		assert.Equalf(t, "key1", publishing.Headers[EncryptionKeyIDHeader], "Failed test %d", idx)
+		assert.NotContainsf(t, string(publishing.Body), "a@b.c", "Failed test %d", idx)
+
+		body, err := enc.decrypt(ctx, test.Topic, amqp.Delivery{Body: publishing.Body, Headers: publishing.Headers})
+
+		assert.Nilf(t, err, "Failed test %d", idx)
+
+		decrypted, _ := appevent.NewAppEventFromJSON(body)
+
+		assert.JSONEqf(t, test.Data, string(decrypted.Data), "Failed test %d", idx)
+	}
+}
+
+func TestEncryptor_KeyRotation(t *testing.T) {
+
+	provider := NewStaticKeyProvider()
+	_ = provider.AddKey("user", "key1", bytes.Repeat([]byte("1"), 32))
+
+	enc := &encryptor{provider: provider, fields: map[string][]string{}}
+
+	ctx := context.Background()
+
+	appEvent := appevent.NewAppEvent("user_created", json.RawMessage(`{"userID":"1"}`))
+	event, _ := appEvent.ToJSON()
+
+	publishing := amqp.Publishing{ContentType: "application/json", Body: event, Headers: amqp.Table{}}
+
+	_ = enc.encrypt(ctx, "user", &publishing)
+
+	_ = provider.AddKey("user", "key2", bytes.Repeat([]byte("2"), 32))
+
+	body, err := enc.decrypt(ctx, "user", amqp.Delivery{Body: publishing.Body, Headers: publishing.Headers})
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), "userID")
+
+	_, err = enc.decrypt(ctx, "chat", amqp.Delivery{Body: publishing.Body, Headers: publishing.Headers})
+
+	assert.NotNil(t, err)
+}
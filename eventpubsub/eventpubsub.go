@@ -22,6 +22,14 @@ type (
 		PublishWithTx(txFunc PublishTxHandler) (err error)
 	}
 
-)
+	// QueueSubscriber
+	// Implemented by the EventPubSub that can bind one app queue to several topics
+	// and consume it with a single handler
+	QueueSubscriber interface {
+		InitializeMultiTopicQueue(queue string, topics ...string) (err error)
+		SubscribeToQueue(queue string, processFunc ProcessEvent, maxMessages int) (err error)
+	}
 
+)
 
+var _ QueueSubscriber = &RabbitMq{}
@@ -0,0 +1,6 @@
+-- adopts the event_blob table created before the schema was versioned
+CREATE TABLE IF NOT EXISTS event_blob (
+    blob_key                   varchar(100)              not null,
+    blob                       bytea                     not null,
+    created_at                 bigint                    not null,
+    PRIMARY KEY (blob_key));
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS eventpubsub_message;
+DROP TABLE IF EXISTS eventpubsub_queue;
+DROP TABLE IF EXISTS eventpubsub_topic;
@@ -0,0 +1,31 @@
+-- adopts the tables created before the schema was versioned, which may miss the lease column
+CREATE TABLE IF NOT EXISTS eventpubsub_topic (
+    topic                      varchar(255)              not null,
+    PRIMARY KEY (topic));
+
+CREATE TABLE IF NOT EXISTS eventpubsub_queue (
+    queue_name                 varchar(500)              not null,
+    topic                      varchar(255)              not null,
+    app_id                     varchar(255)              not null,
+    dead_letter                boolean                   not null,
+    PRIMARY KEY (queue_name, topic));
+
+CREATE TABLE IF NOT EXISTS eventpubsub_message (
+    id                         bigserial                 not null,
+    queue_name                 varchar(500)              not null,
+    topic                      varchar(255)              not null,
+    message_id                 varchar(100)              not null,
+    correlation_id             varchar(100)              not null,
+    app_id                     varchar(255)              not null,
+    content_type               varchar(255)              not null,
+    headers                    jsonb default '{}'        not null,
+    body                       bytea                     not null,
+    attempts                   int default 0             not null,
+    locked_until               bigint default 0          not null,
+    created_at                 bigint                    not null,
+    PRIMARY KEY (id));
+
+ALTER TABLE eventpubsub_message
+    ADD COLUMN IF NOT EXISTS locked_until bigint default 0 not null;
+
+CREATE INDEX IF NOT EXISTS eventpubsub_message_queue_idx ON eventpubsub_message (queue_name, id);
@@ -0,0 +1,292 @@
+package eventpubsub
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/log"
+	"golang.org/x/net/context"
+)
+
+type (
+	// QueueStats
+	// Message and consumer count of an app queue, or its dead letter queue, at inspection time
+	QueueStats struct {
+		Queue       string
+		Topic       string
+		DeadLetter  bool
+		Messages    int
+		Consumers   int
+		InspectedAt time.Time
+	}
+
+	// QueueThresholds
+	// Limits for the readiness check of the subscribed queues. Zero values are not checked.
+	// - MaxMessages: max messages waiting in an app queue
+	// - MaxDeadLetterMessages: max messages in a dead letter queue
+	// - MinConsumers: min consumers of an app queue, including this instance
+	// - MaxStatsAge: max age of the last inspection
+	QueueThresholds struct {
+		MaxMessages           int
+		MaxDeadLetterMessages int
+		MinConsumers          int
+		MaxStatsAge           time.Duration
+	}
+
+	queueMonitor struct {
+		mu          sync.Mutex
+		stats       map[string]QueueStats
+		monitorChan chan bool
+	}
+)
+
+// InspectTopicQueues
+// Returns the current stats of the app queue and dead letter queue for the topic
+func (rabbit *RabbitMq) InspectTopicQueues(topic string) (stats []QueueStats, err error) {
+
+	for _, deadLetter := range []bool{false, true} {
+
+		queueStats, err := rabbit.InspectQueue(topic, deadLetter)
+
+		if err != nil {
+			return stats, err
+		}
+
+		stats = append(stats, queueStats)
+	}
+
+	return stats, nil
+}
+
+// InspectQueue
+// Returns the depth and consumers of the app queue of the topic, or of its dead letter queue.
+// A missing queue returns an error wrapping the *amqp.Error with code amqp.NotFound
+func (rabbit *RabbitMq) InspectQueue(topic string, deadLetter bool) (stats QueueStats, err error) {
+
+	queueName := formQueueName(rabbit.AppID, topic)
+
+	if deadLetter {
+		queueName = formDeadLetterName(rabbit.AppID, topic)
+	}
+
+	// a failed inspect closes the channel, so each queue gets its own
+	channel, err := rabbit.MqConnection.Channel()
+
+	if err != nil {
+		return stats, err
+	}
+
+	queue, err := channel.QueueInspect(queueName)
+
+	_ = channel.Close()
+
+	if err != nil {
+		return stats, fmt.Errorf("error inspecting queue %s, %w", queueName, err)
+	}
+
+	return QueueStats{
+		Queue:       queueName,
+		Topic:       topic,
+		DeadLetter:  deadLetter,
+		Messages:    queue.Messages,
+		Consumers:   queue.Consumers,
+		InspectedAt: time.Now().UTC(),
+	}, nil
+}
+
+// StartQueueMonitor
+// Periodically inspects the queues of the subscribed topics and their dead letter queues.
+// The last stats are returned by QueueStats, QueueMetricsHandler and QueueReadinessCheck.
+// The monitor stops on CleanUp.
+func (rabbit *RabbitMq) StartQueueMonitor(interval time.Duration) (err error) {
+
+	if rabbit.queueMonitor.monitorChan != nil {
+		return fmt.Errorf("queue monitor already started for app %s", rabbit.AppID)
+	}
+
+	monitorChan := make(chan bool)
+	rabbit.queueMonitor.monitorChan = monitorChan
+
+	go func() {
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			rabbit.inspectSubscribedQueues()
+
+			select {
+			case <-ticker.C:
+			case <-monitorChan:
+				return
+			}
+		}
+	}()
+
+	log.PrintfNoContext(rabbit.AppID, component, "Queue monitor started. Interval %s", interval)
+
+	return nil
+}
+
+// QueueStats
+// Returns the stats of the last inspection of the subscribed queues, sorted by queue name
+func (rabbit *RabbitMq) QueueStats() (stats []QueueStats) {
+
+	rabbit.queueMonitor.mu.Lock()
+	defer rabbit.queueMonitor.mu.Unlock()
+
+	for _, queueStats := range rabbit.queueMonitor.stats {
+		stats = append(stats, queueStats)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Queue < stats[j].Queue
+	})
+
+	return stats
+}
+
+// QueueMetricsHandler
+// HTTP handler exposing the last queue stats as Prometheus gauges
+//
+//	eventpubsub_queue_messages{app="<app>",topic="<topic>",queue="<queue>",deadletter="false"} 0
+//	eventpubsub_queue_consumers{app="<app>",topic="<topic>",queue="<queue>",deadletter="false"} 1
+func (rabbit *RabbitMq) QueueMetricsHandler() http.HandlerFunc {
+
+	return func(writer http.ResponseWriter, request *http.Request) {
+
+		stats := rabbit.QueueStats()
+
+		var metrics strings.Builder
+
+		metrics.WriteString("# HELP eventpubsub_queue_messages Messages waiting in the queue.\n")
+		metrics.WriteString("# TYPE eventpubsub_queue_messages gauge\n")
+
+		for _, queueStats := range stats {
+			fmt.Fprintf(&metrics, "eventpubsub_queue_messages{%s} %d\n", rabbit.metricLabels(queueStats), queueStats.Messages)
+		}
+
+		metrics.WriteString("# HELP eventpubsub_queue_consumers Consumers of the queue.\n")
+		metrics.WriteString("# TYPE eventpubsub_queue_consumers gauge\n")
+
+		for _, queueStats := range stats {
+			fmt.Fprintf(&metrics, "eventpubsub_queue_consumers{%s} %d\n", rabbit.metricLabels(queueStats), queueStats.Consumers)
+		}
+
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		_, err := writer.Write([]byte(metrics.String()))
+
+		if err != nil {
+			log.ErrorfNoContext(rabbit.AppID, component, "Error writing queue metrics, %s", err)
+		}
+	}
+}
+
+// QueueReadinessCheck
+// Returns a check failing when the last queue stats exceed the thresholds.
+// It can be added to server.AppServer with AddReadinessCheck.
+func (rabbit *RabbitMq) QueueReadinessCheck(thresholds QueueThresholds) func(ctx context.Context) (err error) {
+
+	return func(ctx context.Context) (err error) {
+
+		var failures []string
+
+		for _, queueStats := range rabbit.QueueStats() {
+
+			if thresholds.MaxStatsAge > 0 && time.Since(queueStats.InspectedAt) > thresholds.MaxStatsAge {
+				failures = append(failures, fmt.Sprintf("%s stats older than %s", queueStats.Queue, thresholds.MaxStatsAge))
+			}
+
+			if queueStats.DeadLetter {
+
+				if thresholds.MaxDeadLetterMessages > 0 && queueStats.Messages > thresholds.MaxDeadLetterMessages {
+					failures = append(failures, fmt.Sprintf("%s has %d messages, max %d", queueStats.Queue, queueStats.Messages, thresholds.MaxDeadLetterMessages))
+				}
+
+				continue
+			}
+
+			if thresholds.MaxMessages > 0 && queueStats.Messages > thresholds.MaxMessages {
+				failures = append(failures, fmt.Sprintf("%s has %d messages, max %d", queueStats.Queue, queueStats.Messages, thresholds.MaxMessages))
+			}
+
+			if thresholds.MinConsumers > 0 && queueStats.Consumers < thresholds.MinConsumers {
+				failures = append(failures, fmt.Sprintf("%s has %d consumers, min %d", queueStats.Queue, queueStats.Consumers, thresholds.MinConsumers))
+			}
+		}
+
+		if len(failures) > 0 {
+			return fmt.Errorf("queue thresholds exceeded: %s", strings.Join(failures, "; "))
+		}
+
+		return nil
+	}
+}
+
+func (rabbit *RabbitMq) inspectSubscribedQueues() {
+
+	rabbit.subscriptionMutex.Lock()
+
+	var topics []string
+
+	for topic := range rabbit.subscriptionChannels {
+		topics = append(topics, topic)
+	}
+
+	rabbit.subscriptionMutex.Unlock()
+
+	stats := make(map[string]QueueStats)
+
+	for _, topic := range topics {
+
+		topicStats, err := rabbit.InspectTopicQueues(topic)
+
+		if err != nil {
+			log.ErrorfNoContext(rabbit.AppID, component, "Error inspecting queues for topic %s, %s", topic, err)
+		}
+
+		for _, queueStats := range topicStats {
+			stats[queueStats.Queue] = queueStats
+		}
+	}
+
+	rabbit.queueMonitor.mu.Lock()
+	defer rabbit.queueMonitor.mu.Unlock()
+
+	// keep the last stats of queues that failed inspection, so their age shows in the readiness check
+	for queue, queueStats := range rabbit.queueMonitor.stats {
+
+		if _, ok := stats[queue]; !ok && contains(topics, queueStats.Topic) {
+			stats[queue] = queueStats
+		}
+	}
+
+	rabbit.queueMonitor.stats = stats
+}
+
+func (rabbit *RabbitMq) metricLabels(queueStats QueueStats) string {
+
+	return fmt.Sprintf(`app="%s",topic="%s",queue="%s",deadletter="%t"`, escapeLabel(string(rabbit.AppID)), escapeLabel(queueStats.Topic), escapeLabel(queueStats.Queue), queueStats.DeadLetter)
+}
+
+func escapeLabel(value string) string {
+
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func contains(values []string, value string) bool {
+
+	for _, v := range values {
+
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,74 @@
+package eventpubsub
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func newMonitoredRabbitMq(stats ...QueueStats) *RabbitMq {
+
+	rabbit := &RabbitMq{AppID: "testApp"}
+
+	rabbit.queueMonitor.stats = make(map[string]QueueStats)
+
+	for _, queueStats := range stats {
+		rabbit.queueMonitor.stats[queueStats.Queue] = queueStats
+	}
+
+	return rabbit
+}
+
+func TestRabbitMq_QueueReadinessCheck(t *testing.T) {
+
+	now := time.Now().UTC()
+
+	rabbit := newMonitoredRabbitMq(
+		QueueStats{Queue: "testApp->user", Topic: "user", Messages: 50, Consumers: 1, InspectedAt: now},
+		QueueStats{Queue: "testApp->user.deadletter", Topic: "user", DeadLetter: true, Messages: 5, InspectedAt: now},
+	)
+
+	ctx := context.Background()
+
+	type testDef struct {
+		Thresholds QueueThresholds
+		Ready      bool
+	}
+
+	Tests := []testDef{
+		{QueueThresholds{}, true},
+		{QueueThresholds{MaxMessages: 100, MaxDeadLetterMessages: 10, MinConsumers: 1}, true},
+		{QueueThresholds{MaxMessages: 10}, false},
+		{QueueThresholds{MaxDeadLetterMessages: 1}, false},
+		{QueueThresholds{MinConsumers: 2}, false},
+		{QueueThresholds{MaxStatsAge: time.Nanosecond}, false},
+	}
+
+	for idx, test := range Tests {
+
+		err := rabbit.QueueReadinessCheck(test.Thresholds)(ctx)
+
+		assert.Equalf(t, test.Ready, err == nil, "Failed test %d", idx)
+	}
+}
+
+func TestRabbitMq_QueueMetricsHandler(t *testing.T) {
+
+	rabbit := newMonitoredRabbitMq(
+		QueueStats{Queue: "testApp->user", Topic: "user", Messages: 50, Consumers: 2},
+		QueueStats{Queue: "testApp->user.deadletter", Topic: "user", DeadLetter: true, Messages: 5},
+	)
+
+	wri := httptest.NewRecorder()
+
+	rabbit.QueueMetricsHandler()(wri, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := wri.Body.String()
+
+	assert.Contains(t, body, `eventpubsub_queue_messages{app="testApp",topic="user",queue="testApp->user",deadletter="false"} 50`)
+	assert.Contains(t, body, `eventpubsub_queue_messages{app="testApp",topic="user",queue="testApp->user.deadletter",deadletter="true"} 5`)
+	assert.Contains(t, body, `eventpubsub_queue_consumers{app="testApp",topic="user",queue="testApp->user",deadletter="false"} 2`)
+}
@@ -0,0 +1,674 @@
+package eventpubsub
+
+import (
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/app"
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/db"
+	"github.com/HelloSundayMorning/apputils/log"
+	"github.com/HelloSundayMorning/apputils/tracing"
+	"github.com/gofrs/uuid"
+	"github.com/lib/pq"
+	"github.com/streadway/amqp"
+	"golang.org/x/net/context"
+)
+
+type (
+	// PostgresPubSub
+	// EventPubSub implementation on Postgres tables, for small deployments and local development.
+	// It keeps the RabbitMq semantics: topics fan out to a queue per app, a failed delivery is
+	// retried once and then moved to the app dead letter queue.
+	// Consumers lease messages for LeaseTimeout with a short transaction, so several replicas can
+	// consume the same queue without holding a connection while the handler runs. A message whose
+	// lease expires, ie. its consumer stopped, is delivered again as a redelivery.
+	// New messages wake consumers up with LISTEN/NOTIFY when a data source is given, otherwise
+	// consumers poll the queue.
+	// Schema validation, claim check, compression, encryption and signing are only supported by
+	// RabbitMq, see its Enable methods. Apps using them can't switch to this backend.
+	PostgresPubSub struct {
+		AppID                app.ApplicationID
+		sqlDb                db.AppSqlDb
+		ownedDb              *sql.DB // opened by NewEventPubSub, closed by CleanUp
+		PollInterval         time.Duration
+		LeaseTimeout         time.Duration
+		listener             *pq.Listener
+		registeredTopic      map[string]bool
+		subscriptionChannels map[string]chan bool
+		wakeUpChannels       map[string]chan bool
+		queueTopics          map[string][]string
+		deliveryTimeout      time.Duration
+		mu                   sync.Mutex
+	}
+
+	// PostgresTx
+	// PubSubTx publishing on a sql transaction. Messages are visible to consumers when it commits.
+	PostgresTx struct {
+		pubSub   *PostgresPubSub
+		tx       *sql.Tx
+		external bool
+	}
+)
+
+const (
+	componentPostgres = "eventpubsub_postgres"
+
+	notifyChannel = "eventpubsub"
+
+	defaultPollInterval = 5 * time.Second
+	defaultLeaseTimeout = 5 * time.Minute
+
+	// table recording the applied pub/sub migrations
+	pubSubMigrationsTable = "eventpubsub_migrations"
+
+	insertTopic = `INSERT INTO eventpubsub_topic (topic) VALUES ($1) ON CONFLICT (topic) DO NOTHING`
+
+	findTopic = `SELECT topic FROM eventpubsub_topic WHERE topic = $1`
+
+	insertQueue = `INSERT INTO eventpubsub_queue (queue_name, topic, app_id, dead_letter)
+                                VALUES ($1, $2, $3, $4)
+                                ON CONFLICT (queue_name, topic) DO NOTHING`
+
+	findQueueTopics = `SELECT topic FROM eventpubsub_queue WHERE queue_name = $1 ORDER BY topic`
+
+	// fan out the message to every app queue bound to the topic
+	insertMessage = `INSERT INTO eventpubsub_message (queue_name, topic, message_id, correlation_id, app_id, content_type, headers, body, created_at)
+                                SELECT queue_name, $1, $2, $3, $4, $5, $6, $7, $8
+                                FROM eventpubsub_queue
+                                WHERE topic = $1 AND dead_letter = false`
+
+	notifyTopic = `SELECT pg_notify($1, $2)`
+
+	// leases the next message not leased by other consumers, counting the delivery attempt
+	leaseNextMessage = `UPDATE eventpubsub_message SET locked_until = $3, attempts = attempts + 1
+                                WHERE id = (SELECT id
+                                            FROM eventpubsub_message
+                                            WHERE queue_name = $1 AND locked_until < $2
+                                            ORDER BY id
+                                            FOR UPDATE SKIP LOCKED
+                                            LIMIT 1)
+                                RETURNING id, topic, message_id, correlation_id, app_id, content_type, headers, body, attempts`
+
+	// the lease checks make sure a consumer whose lease expired doesn't change a message delivered again
+	deleteMessage = `DELETE FROM eventpubsub_message WHERE id = $1 AND locked_until = $2`
+
+	retryMessage = `UPDATE eventpubsub_message SET locked_until = 0 WHERE id = $1 AND locked_until = $2`
+
+	requeueMessage = `UPDATE eventpubsub_message SET locked_until = 0, attempts = attempts - 1 WHERE id = $1 AND locked_until = $2`
+
+	deadLetterMessage = `UPDATE eventpubsub_message SET queue_name = $3, locked_until = 0 WHERE id = $1 AND locked_until = $2`
+)
+
+var (
+	ErrExternalTx = errors.New("transaction is owned by the caller, commit or rollback it instead")
+
+	//go:embed migrations/postgres/*.sql
+	pubSubMigrations embed.FS
+
+	_ EventPubSub     = &PostgresPubSub{}
+	_ QueueSubscriber = &PostgresPubSub{}
+	_ PubSubTx        = &PostgresTx{}
+)
+
+// NewPostgresPubSub
+// Migrates the pub/sub tables to the latest version, see db.MigrateSchema. The dataSource is the Postgres connection string
+// used to LISTEN for new messages. If empty, consumers poll the queues every PollInterval.
+func NewPostgresPubSub(appID app.ApplicationID, sqlDb db.AppSqlDb, dataSource string) (pubSub *PostgresPubSub, err error) {
+
+	pubSub = &PostgresPubSub{
+		AppID:                appID,
+		sqlDb:                sqlDb,
+		PollInterval:         defaultPollInterval,
+		LeaseTimeout:         defaultLeaseTimeout,
+		registeredTopic:      make(map[string]bool),
+		subscriptionChannels: make(map[string]chan bool),
+		wakeUpChannels:       make(map[string]chan bool),
+		queueTopics:          make(map[string][]string),
+	}
+
+	err = db.MigrateSchema(context.Background(), sqlDb, pubSubMigrations, "migrations/postgres", pubSubMigrationsTable)
+
+	if err != nil {
+		return nil, fmt.Errorf("error migrating pub/sub tables, %s", err)
+	}
+
+	if dataSource != "" {
+
+		err = pubSub.listen(dataSource)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.PrintfNoContext(appID, componentPostgres, "Postgres pub/sub initialized. Listening for notifications %t", dataSource != "")
+
+	return pubSub, nil
+}
+
+func (pubSub *PostgresPubSub) listen(dataSource string) (err error) {
+
+	pubSub.listener = pq.NewListener(dataSource, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+
+		if err != nil {
+			log.ErrorfNoContext(pubSub.AppID, componentPostgres, "Postgres pub/sub listener error, %s", err)
+		}
+	})
+
+	err = pubSub.listener.Listen(notifyChannel)
+
+	if err != nil {
+		_ = pubSub.listener.Close()
+		return fmt.Errorf("error listening to postgres channel %s, %s", notifyChannel, err)
+	}
+
+	go func() {
+		for notification := range pubSub.listener.Notify {
+
+			pubSub.mu.Lock()
+
+			for queue, wakeUpChan := range pubSub.wakeUpChannels {
+
+				// a nil notification follows a reconnection, when notifications may have been lost
+				if notification != nil && !contains(pubSub.queueTopics[queue], notification.Extra) {
+					continue
+				}
+
+				select {
+				case wakeUpChan <- true:
+				default:
+				}
+			}
+
+			pubSub.mu.Unlock()
+		}
+	}()
+
+	return nil
+}
+
+// SetDeliveryTimeout
+// Sets the deadline of the handler context of each message. Handlers exceeding it are
+// retried as failed, even if they return no error. The x-delivery-deadline header of a
+// message shortens it. No timeout by default. A timeout longer than LeaseTimeout extends the lease.
+func (pubSub *PostgresPubSub) SetDeliveryTimeout(timeout time.Duration) {
+
+	pubSub.deliveryTimeout = timeout
+}
+
+func (pubSub *PostgresPubSub) RegisterTopic(topic string) (err error) {
+
+	_, err = pubSub.sqlDb.GetDB().Exec(insertTopic, topic)
+
+	if err != nil {
+		return err
+	}
+
+	pubSub.mu.Lock()
+	pubSub.registeredTopic[topic] = true
+	pubSub.mu.Unlock()
+
+	log.PrintfNoContext(pubSub.AppID, componentPostgres, "Registered topic %s for app %s", topic, pubSub.AppID)
+
+	return nil
+}
+
+func (pubSub *PostgresPubSub) InitializeQueue(topic string) (err error) {
+
+	err = pubSub.declareQueue(topic, []string{topic})
+
+	if err != nil {
+		log.PrintfNoContext(pubSub.AppID, componentPostgres, "Failed to initialize queue for topic %s. %s", topic, err)
+		return err
+	}
+
+	return nil
+}
+
+// InitializeMultiTopicQueue
+// Creates one app queue, and its dead letter queue, bound to all the topics, to consume them
+// with a single handler with SubscribeToQueue
+func (pubSub *PostgresPubSub) InitializeMultiTopicQueue(queue string, topics ...string) (err error) {
+
+	if len(topics) == 0 {
+		return fmt.Errorf("no topics to bind queue %s", formQueueName(pubSub.AppID, queue))
+	}
+
+	err = pubSub.declareQueue(queue, topics)
+
+	if err != nil {
+		log.PrintfNoContext(pubSub.AppID, componentPostgres, "Failed to initialize queue %s for topics %s. %s", queue, strings.Join(topics, ","), err)
+		return err
+	}
+
+	return nil
+}
+
+func (pubSub *PostgresPubSub) declareQueue(queue string, topics []string) (err error) {
+
+	return pubSub.sqlDb.WithTx(func(tx db.AppSqlTx) error {
+
+		for _, topic := range topics {
+
+			var found string
+
+			err := tx.GetTx().QueryRow(findTopic, topic).Scan(&found)
+
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("could not find topic %s to bind queue %s", topic, formQueueName(pubSub.AppID, queue))
+			}
+
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.GetTx().Exec(insertQueue, formDeadLetterName(pubSub.AppID, queue), topic, string(pubSub.AppID), true)
+
+			if err != nil {
+				return fmt.Errorf("error creating dead letter queue: %s", err)
+			}
+
+			_, err = tx.GetTx().Exec(insertQueue, formQueueName(pubSub.AppID, queue), topic, string(pubSub.AppID), false)
+
+			if err != nil {
+				return fmt.Errorf("error creating queue: %s", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func (pubSub *PostgresPubSub) PublishToTopic(ctx context.Context, topic string, event []byte, contentType string) (err error) {
+
+	return pubSub.PublishWithTx(func(tx PubSubTx) (err error) {
+		return tx.PublishToTopic(ctx, topic, event, contentType)
+	})
+}
+
+func (pubSub *PostgresPubSub) PublishWithTx(txFunc PublishTxHandler) (err error) {
+
+	tx, err := pubSub.sqlDb.GetDB().Begin()
+
+	if err != nil {
+		return err
+	}
+
+	err = txFunc(&PostgresTx{
+		pubSub: pubSub,
+		tx:     tx,
+	})
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+
+	if err != nil && err != sql.ErrTxDone {
+		return err
+	}
+
+	return nil
+}
+
+// PublishWithSqlTx
+// Publishes on an existing database transaction, so the events commit, or roll back, with the
+// caller's writes. The caller owns the transaction: Commit and Rollback of the PubSubTx return ErrExternalTx.
+func (pubSub *PostgresPubSub) PublishWithSqlTx(sqlTx db.AppSqlTx, txFunc PublishTxHandler) (err error) {
+
+	return txFunc(&PostgresTx{
+		pubSub:   pubSub,
+		tx:       sqlTx.GetTx(),
+		external: true,
+	})
+}
+
+func (pubSub *PostgresPubSub) SubscribeToTopic(topic string, processFunc ProcessEvent) (err error) {
+
+	return pubSub.SubscribeToTopicWithMaxMsg(topic, processFunc, 0)
+}
+
+// SubscribeToTopicWithMaxMsg
+// Consumes the app queue for the topic with maxMessages concurrent consumers, 1 if 0.
+func (pubSub *PostgresPubSub) SubscribeToTopicWithMaxMsg(topic string, processFunc ProcessEvent, maxMessages int) (err error) {
+
+	err = pubSub.subscribe(topic, processFunc, maxMessages)
+
+	if err != nil {
+		return err
+	}
+
+	log.PrintfNoContext(pubSub.AppID, componentPostgres, "App %s Subscribed to topic %s", pubSub.AppID, topic)
+
+	return nil
+}
+
+// SubscribeToQueue
+// Consumes a queue created with InitializeMultiTopicQueue with maxMessages concurrent consumers, 1 if 0.
+// UnSubscribe with the queue name ends the subscription.
+func (pubSub *PostgresPubSub) SubscribeToQueue(queue string, processFunc ProcessEvent, maxMessages int) (err error) {
+
+	err = pubSub.subscribe(queue, processFunc, maxMessages)
+
+	if err != nil {
+		return err
+	}
+
+	log.PrintfNoContext(pubSub.AppID, componentPostgres, "App %s Subscribed to queue %s", pubSub.AppID, queue)
+
+	return nil
+}
+
+func (pubSub *PostgresPubSub) subscribe(queue string, processFunc ProcessEvent, maxMessages int) (err error) {
+
+	appQueueName := formQueueName(pubSub.AppID, queue)
+
+	rows, err := pubSub.sqlDb.GetDB().Query(findQueueTopics, appQueueName)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var topics []string
+
+	for rows.Next() {
+
+		var topic string
+
+		err = rows.Scan(&topic)
+
+		if err != nil {
+			return err
+		}
+
+		topics = append(topics, topic)
+	}
+
+	if len(topics) == 0 {
+		return fmt.Errorf("no queue '%s'", appQueueName)
+	}
+
+	if maxMessages < 1 {
+		maxMessages = 1
+	}
+
+	subChan := make(chan bool)
+	wakeUpChan := make(chan bool, 1)
+
+	pubSub.mu.Lock()
+	pubSub.subscriptionChannels[queue] = subChan
+	pubSub.wakeUpChannels[queue] = wakeUpChan
+	pubSub.queueTopics[queue] = topics
+	pubSub.mu.Unlock()
+
+	// cancels the handler contexts of the messages in process when the subscription ends
+	subCtx := subscriptionContext(subChan)
+
+	for i := 0; i < maxMessages; i++ {
+		go pubSub.consume(subCtx, queue, processFunc, subChan, wakeUpChan)
+	}
+
+	return nil
+}
+
+func (pubSub *PostgresPubSub) UnSubscribe(topic string) {
+
+	pubSub.mu.Lock()
+	defer pubSub.mu.Unlock()
+
+	subChan := pubSub.subscriptionChannels[topic]
+
+	if subChan != nil {
+		close(subChan)
+		delete(pubSub.subscriptionChannels, topic)
+		delete(pubSub.wakeUpChannels, topic)
+		delete(pubSub.queueTopics, topic)
+	}
+}
+
+func (pubSub *PostgresPubSub) CleanUp() (err error) {
+
+	pubSub.mu.Lock()
+
+	for _, subChan := range pubSub.subscriptionChannels {
+		close(subChan)
+	}
+
+	pubSub.subscriptionChannels = make(map[string]chan bool)
+	pubSub.wakeUpChannels = make(map[string]chan bool)
+	pubSub.queueTopics = make(map[string][]string)
+	pubSub.registeredTopic = make(map[string]bool)
+
+	pubSub.mu.Unlock()
+
+	if pubSub.listener != nil {
+
+		err = pubSub.listener.Close()
+
+		if err != nil {
+			return fmt.Errorf("error closing postgres listener while cleaning up pub/sub, %s", err)
+		}
+	}
+
+	if pubSub.ownedDb != nil {
+
+		err = pubSub.ownedDb.Close()
+
+		if err != nil {
+			return fmt.Errorf("error closing postgres db while cleaning up pub/sub, %s", err)
+		}
+	}
+
+	return nil
+}
+
+// consume
+// Processes the queue messages until the subscription ends, waiting for a notification
+// or the poll interval when the queue is empty
+func (pubSub *PostgresPubSub) consume(subCtx context.Context, queue string, processFunc ProcessEvent, subChan, wakeUpChan chan bool) {
+
+	for {
+
+		select {
+		case <-subChan:
+			return
+		default:
+		}
+
+		processed, err := pubSub.processNext(subCtx, queue, processFunc)
+
+		if err != nil {
+			log.ErrorfNoContext(pubSub.AppID, componentPostgres, "Error consuming queue %s, %s", formQueueName(pubSub.AppID, queue), err)
+		}
+
+		if processed && err == nil {
+			continue
+		}
+
+		select {
+		case <-subChan:
+			return
+		case <-wakeUpChan:
+		case <-time.After(pubSub.PollInterval):
+		}
+	}
+}
+
+// processNext
+// Leases the next message of the app queue and calls the process function outside of any transaction.
+// Same as RabbitMq, a message is retried once and then moved to the dead letter queue.
+// A message failing because the subscription ended is released unchanged for the next consumer.
+func (pubSub *PostgresPubSub) processNext(subCtx context.Context, queue string, processFunc ProcessEvent) (processed bool, err error) {
+
+	var (
+		id          int64
+		headersJSON []byte
+		attempts    int
+		delivery    amqp.Delivery
+	)
+
+	now := time.Now().UTC()
+	lockedUntil := now.Add(pubSub.leaseTimeout()).UnixNano()
+
+	err = pubSub.sqlDb.GetDB().QueryRow(leaseNextMessage, formQueueName(pubSub.AppID, queue), now.UnixNano(), lockedUntil).
+		Scan(&id, &delivery.Exchange, &delivery.MessageId, &delivery.CorrelationId, &delivery.AppId, &delivery.ContentType, &headersJSON, &delivery.Body, &attempts)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	err = json.Unmarshal(headersJSON, &delivery.Headers)
+
+	if err != nil {
+		// dead-letter it, a message with invalid headers never succeeds
+		_, _ = pubSub.sqlDb.GetDB().Exec(deadLetterMessage, id, lockedUntil, formDeadLetterName(pubSub.AppID, queue))
+		return true, fmt.Errorf("invalid headers for message %s, %s", delivery.MessageId, err)
+	}
+
+	// attempts counts this delivery
+	delivery.Redelivered = attempts > 1
+
+	if delivery.CorrelationId == "" {
+		id, _ := uuid.NewV4()
+		delivery.CorrelationId = id.String()
+	}
+
+	ctx, cancel := newDeliveryContext(subCtx, pubSub.AppID, delivery, pubSub.deliveryTimeout)
+	defer cancel()
+
+	ctx, seg := tracing.BeginSegmentFromEventDelivery(ctx, pubSub.AppID, delivery)
+
+	processErr := deliveryFailure(ctx, processFunc(ctx, delivery.Body, delivery.ContentType))
+
+	seg.Close(processErr)
+
+	var result sql.Result
+
+	switch {
+	case processErr == nil:
+		result, err = pubSub.sqlDb.GetDB().Exec(deleteMessage, id, lockedUntil)
+
+	case subCtx.Err() != nil:
+		log.Errorf(ctx, componentPostgres, "Error handling delivery, %s", processErr)
+		log.Printf(ctx, componentPostgres, "Subscription ended while processing. Re-queue delivery")
+		result, err = pubSub.sqlDb.GetDB().Exec(requeueMessage, id, lockedUntil)
+
+	case delivery.Redelivered:
+		log.Errorf(ctx, componentPostgres, "Error handling delivery, %s", processErr)
+		log.Printf(ctx, componentPostgres, "2nd attempt failure. Dead-letter delivery, %s", processErr)
+		result, err = pubSub.sqlDb.GetDB().Exec(deadLetterMessage, id, lockedUntil, formDeadLetterName(pubSub.AppID, queue))
+
+	default:
+		log.Errorf(ctx, componentPostgres, "Error handling delivery, %s", processErr)
+		log.Printf(ctx, componentPostgres, "1st attempt failure. Re-queue delivery, %s", processErr)
+		result, err = pubSub.sqlDb.GetDB().Exec(retryMessage, id, lockedUntil)
+	}
+
+	if err != nil {
+		return true, err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return true, err
+	}
+
+	if affected == 0 {
+		return true, fmt.Errorf("lease of message %s expired while processing, it was delivered again", delivery.MessageId)
+	}
+
+	return true, nil
+}
+
+// leaseTimeout
+// Returns the lease of a delivery, at least the delivery timeout so a handler within its deadline keeps the message
+func (pubSub *PostgresPubSub) leaseTimeout() time.Duration {
+
+	lease := pubSub.LeaseTimeout
+
+	if lease <= 0 {
+		lease = defaultLeaseTimeout
+	}
+
+	if pubSub.deliveryTimeout > lease {
+		lease = pubSub.deliveryTimeout
+	}
+
+	return lease
+}
+
+func (pgTx *PostgresTx) PublishToTopic(ctx context.Context, topic string, event []byte, contentType string) (err error) {
+
+	appID := ctx.Value(appctx.AppIdHeader).(string)
+
+	pgTx.pubSub.mu.Lock()
+	registered := pgTx.pubSub.registeredTopic[topic]
+	pgTx.pubSub.mu.Unlock()
+
+	if !registered {
+		return fmt.Errorf("app %s is not registered for topic %s", appID, topic)
+	}
+
+	publishing, err := newContextPublishing(ctx, event, contentType)
+
+	if err != nil {
+		return err
+	}
+
+	headersJSON, err := json.Marshal(publishing.Headers)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = pgTx.tx.ExecContext(ctx, insertMessage, topic, publishing.MessageId, publishing.CorrelationId, publishing.AppId, publishing.ContentType, headersJSON, publishing.Body, time.Now().UTC().UnixNano())
+
+	if err != nil {
+		return fmt.Errorf("error publishing to topic %s, %s", topic, err)
+	}
+
+	// notifications are only sent when the transaction commits
+	_, err = pgTx.tx.ExecContext(ctx, notifyTopic, notifyChannel, topic)
+
+	if err != nil {
+		return fmt.Errorf("error notifying topic %s, %s", topic, err)
+	}
+
+	return nil
+}
+
+func (pgTx *PostgresTx) Commit() (err error) {
+
+	if pgTx.external {
+		return ErrExternalTx
+	}
+
+	return pgTx.tx.Commit()
+}
+
+func (pgTx *PostgresTx) Rollback() (err error) {
+
+	if pgTx.external {
+		return ErrExternalTx
+	}
+
+	return pgTx.tx.Rollback()
+}
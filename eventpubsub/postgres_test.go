@@ -0,0 +1,180 @@
+package eventpubsub
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/db"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func newMockPostgresPubSub(t *testing.T) (*PostgresPubSub, sqlmock.Sqlmock) {
+
+	mockDb, mock, err := db.NewMockDB()
+
+	assert.NoError(t, err)
+
+	expectMigrations(mock, pubSubMigrationsTable, "CREATE TABLE IF NOT EXISTS eventpubsub_topic")
+
+	pubSub, err := NewPostgresPubSub("testApp", mockDb, "")
+
+	assert.NoError(t, err)
+
+	return pubSub, mock
+}
+
+// expectMigrations
+// Expects the migrations of an empty database, one statement per migration
+func expectMigrations(mock sqlmock.Sqlmock, table string, statements ...string) {
+
+	mock.ExpectQuery("pg_try_advisory_lock").WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	mock.ExpectQuery("to_regclass").WithArgs(table).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%s"`, table)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	for _, statement := range statements {
+		mock.ExpectBegin()
+		mock.ExpectExec(statement).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(fmt.Sprintf(`INSERT INTO "%s"`, table)).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+
+	mock.ExpectExec("pg_advisory_unlock").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestPostgresPubSub_PublishToTopic(t *testing.T) {
+
+	pubSub, mock := newMockPostgresPubSub(t)
+
+	ctx := appctx.NewContextFromValues("testApp", "correlationID")
+
+	err := pubSub.PublishToTopic(ctx, "user", []byte(`{}`), "application/json")
+
+	assert.Error(t, err)
+
+	mock.ExpectExec("INSERT INTO eventpubsub_topic").WithArgs("user").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(t, pubSub.RegisterTopic("user"))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO eventpubsub_message").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("SELECT pg_notify").WithArgs(notifyChannel, "user").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	err = pubSub.PublishToTopic(ctx, "user", []byte(`{}`), "application/json")
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresPubSub_ProcessNext(t *testing.T) {
+
+	type testDef struct {
+		Attempts   int
+		ProcessErr error
+		Expected   string
+		Affected   int64
+		HasErr     bool
+	}
+
+	Tests := []testDef{
+		{1, nil, "DELETE FROM eventpubsub_message", 1, false},
+		{1, errors.New("failed"), "UPDATE eventpubsub_message SET locked_until = 0 WHERE", 1, false},
+		{2, errors.New("failed"), "UPDATE eventpubsub_message SET queue_name", 1, false},
+		{1, nil, "DELETE FROM eventpubsub_message", 0, true},
+	}
+
+	for idx, test := range Tests {
+
+		pubSub, mock := newMockPostgresPubSub(t)
+
+		rows := sqlmock.NewRows([]string{"id", "topic", "message_id", "correlation_id", "app_id", "content_type", "headers", "body", "attempts"}).
+			AddRow(1, "user", "messageID", "correlationID", "otherApp", "application/json", []byte(`{}`), []byte(`{}`), test.Attempts)
+
+		// the handler runs outside of a transaction
+		mock.ExpectQuery("UPDATE eventpubsub_message SET locked_until").WithArgs("testApp->user", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnRows(rows)
+		mock.ExpectExec(test.Expected).WillReturnResult(sqlmock.NewResult(0, test.Affected))
+
+		processed, err := pubSub.processNext(context.Background(), "user", func(ctx context.Context, event []byte, contentType string) error {
+
+			assert.Equalf(t, "user", appctx.GetSourceTopic(ctx), "Failed test %d", idx)
+
+			return test.ProcessErr
+		})
+
+		assert.Truef(t, processed, "Failed test %d", idx)
+		assert.Equalf(t, test.HasErr, err != nil, "Failed test %d", idx)
+		assert.NoErrorf(t, mock.ExpectationsWereMet(), "Failed test %d", idx)
+	}
+}
+
+func TestPostgresPubSub_ProcessNextSubscriptionEnded(t *testing.T) {
+
+	pubSub, mock := newMockPostgresPubSub(t)
+
+	rows := sqlmock.NewRows([]string{"id", "topic", "message_id", "correlation_id", "app_id", "content_type", "headers", "body", "attempts"}).
+		AddRow(1, "user", "messageID", "correlationID", "otherApp", "application/json", []byte(`{}`), []byte(`{}`), 1)
+
+	mock.ExpectQuery("UPDATE eventpubsub_message SET locked_until").WillReturnRows(rows)
+	mock.ExpectExec("attempts = attempts - 1").WithArgs(1, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	subCtx, cancel := context.WithCancel(context.Background())
+
+	processed, err := pubSub.processNext(subCtx, "user", func(ctx context.Context, event []byte, contentType string) error {
+		cancel()
+		return ctx.Err()
+	})
+
+	assert.True(t, processed)
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresPubSub_LeaseTimeout(t *testing.T) {
+
+	pubSub, _ := newMockPostgresPubSub(t)
+
+	assert.Equal(t, defaultLeaseTimeout, pubSub.leaseTimeout())
+
+	pubSub.SetDeliveryTimeout(time.Hour)
+
+	assert.Equal(t, time.Hour, pubSub.leaseTimeout())
+}
+
+func TestPostgresPubSub_CleanUp(t *testing.T) {
+
+	pubSub, mock := newMockPostgresPubSub(t)
+
+	// the db given to NewPostgresPubSub is owned by the caller
+	assert.NoError(t, pubSub.CleanUp())
+
+	pubSub.ownedDb = pubSub.sqlDb.GetDB()
+
+	mock.ExpectClose()
+
+	assert.NoError(t, pubSub.CleanUp())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresPubSub_InitializeMultiTopicQueue(t *testing.T) {
+
+	pubSub, mock := newMockPostgresPubSub(t)
+
+	mock.ExpectBegin()
+
+	for _, topic := range []string{"user", "chat"} {
+		mock.ExpectQuery("SELECT topic FROM eventpubsub_topic").WithArgs(topic).WillReturnRows(sqlmock.NewRows([]string{"topic"}).AddRow(topic))
+		mock.ExpectExec("INSERT INTO eventpubsub_queue").WithArgs("testApp->events.deadletter", topic, "testApp", true).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO eventpubsub_queue").WithArgs("testApp->events", topic, "testApp", false).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	mock.ExpectCommit()
+
+	assert.NoError(t, pubSub.InitializeMultiTopicQueue("events", "user", "chat"))
+	assert.Error(t, pubSub.InitializeMultiTopicQueue("events"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -7,6 +7,9 @@ import (
 	"github.com/HelloSundayMorning/apputils/log"
 	"github.com/HelloSundayMorning/apputils/tracing"
 	"github.com/gofrs/uuid"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/streadway/amqp"
 	"golang.org/x/net/context"
@@ -19,11 +22,24 @@ type (
 		registeredTopic      map[string]bool
 		publishChannel       *amqp.Channel
 		subscriptionChannels map[string]chan bool
+		subscriptionMutex    sync.Mutex
+		queueMonitor         queueMonitor
+		schemaRegistry       *SchemaRegistry
+		validateOnPublish    bool
+		validateOnConsume    bool
+		claimCheck           *claimCheck
+		compressor           *compressor
+		encryptor            *encryptor
+		signer               *signer
+		verifier             *verifier
+		deliveryTimeout      time.Duration
 	}
 )
 
 const (
 	component = "eventpubsub_rabbitmq"
+
+	deadLetterSuffix = ".deadletter"
 )
 
 func NewRabbitMq(appID app.ApplicationID, user, pw, host string) (rabbitMq *RabbitMq, err error) {
@@ -76,11 +92,26 @@ func (rabbit *RabbitMq) watchConnection() {
 
 func (rabbit *RabbitMq) CleanUp() error {
 
+	rabbit.subscriptionMutex.Lock()
+
 	for _, subChannel := range rabbit.subscriptionChannels {
 		close(subChannel)
 	}
 
 	rabbit.subscriptionChannels = make(map[string]chan bool, 0)
+
+	rabbit.subscriptionMutex.Unlock()
+
+	if rabbit.queueMonitor.monitorChan != nil {
+		close(rabbit.queueMonitor.monitorChan)
+		rabbit.queueMonitor.monitorChan = nil
+	}
+
+	if rabbit.claimCheck != nil && rabbit.claimCheck.collectorChan != nil {
+		close(rabbit.claimCheck.collectorChan)
+		rabbit.claimCheck.collectorChan = nil
+	}
+
 	rabbit.registeredTopic = make(map[string]bool)
 
 	if rabbit.publishChannel != nil {
@@ -94,6 +125,28 @@ func (rabbit *RabbitMq) CleanUp() error {
 	return nil
 }
 
+// EnableSchemaValidation
+// Validates AppEvents against the registry schemas when publishing and/or before processing a delivery.
+// Invalid deliveries are sent straight to the dead letter queue with the validation errors in
+// the x-schema-validation-errors header.
+func (rabbit *RabbitMq) EnableSchemaValidation(registry *SchemaRegistry, onPublish, onConsume bool) {
+
+	rabbit.schemaRegistry = registry
+	rabbit.validateOnPublish = onPublish
+	rabbit.validateOnConsume = onConsume
+
+	log.PrintfNoContext(rabbit.AppID, component, "Schema validation enabled. On publish %t, on consume %t", onPublish, onConsume)
+}
+
+// SetDeliveryTimeout
+// Sets the deadline of the handler context of each delivery. Handlers exceeding it are
+// nacked as failed, even if they return no error. The x-delivery-deadline header of a
+// delivery shortens it. No timeout by default.
+func (rabbit *RabbitMq) SetDeliveryTimeout(timeout time.Duration) {
+
+	rabbit.deliveryTimeout = timeout
+}
+
 // RegisterTopic Should be called in the initialization to create an exchange
 // If the exchange exists it's ignored
 func (rabbit *RabbitMq) RegisterTopic(topic string) (err error) {
@@ -138,7 +191,7 @@ func (rabbit *RabbitMq) InitializeQueue(topic string) (err error) {
 
 	//for attempts := 1; attempts < 4; attempts++ {
 
-	err = rabbit.declareQueue(topic)
+	err = rabbit.declareQueue(topic, []string{topic})
 	//	if err == nil {
 	//		break
 	//	}
@@ -157,6 +210,27 @@ func (rabbit *RabbitMq) InitializeQueue(topic string) (err error) {
 	return nil
 }
 
+// InitializeMultiTopicQueue
+// Creates one app queue, and its dead letter queue, bound to all the topics, so they can be
+// consumed by a single handler with SubscribeToQueue.
+// The queue is named after the app and the queue name, same as a topic queue. The handler
+// gets the topic of each delivery with appctx.GetSourceTopic.
+func (rabbit *RabbitMq) InitializeMultiTopicQueue(queue string, topics ...string) (err error) {
+
+	if len(topics) == 0 {
+		return fmt.Errorf("no topics to bind queue %s", formQueueName(rabbit.AppID, queue))
+	}
+
+	err = rabbit.declareQueue(queue, topics)
+
+	if err != nil {
+		log.PrintfNoContext(rabbit.AppID, component, "Failed to initialize queue %s for topics %s. %s", queue, strings.Join(topics, ","), err)
+		return err
+	}
+
+	return nil
+}
+
 // InitializeQueue should be called at the application start for each topic the app
 // will subscribe to.
 // It will create the topic queue for the subscription and the dead
@@ -165,8 +239,9 @@ func (rabbit *RabbitMq) InitializeQueue(topic string) (err error) {
 // Attempt to subscribe to a non existent topic will return a error
 //
 // - appID : unique name for the application that will subscribe to a topic
-// - topic : topic name
-func (rabbit *RabbitMq) declareQueue(topic string) (err error) {
+// - queue : queue name, the topic name for a single topic queue
+// - topics : topics bound to the queue
+func (rabbit *RabbitMq) declareQueue(queue string, topics []string) (err error) {
 
 	channel, err := rabbit.MqConnection.Channel()
 
@@ -179,8 +254,8 @@ func (rabbit *RabbitMq) declareQueue(topic string) (err error) {
 
 	}()
 
-	appQueueName := formQueueName(rabbit.AppID, topic)
-	deadLetterName := formDeadLetterName(rabbit.AppID, topic)
+	appQueueName := formQueueName(rabbit.AppID, queue)
+	deadLetterName := formDeadLetterName(rabbit.AppID, queue)
 
 	// topic exchange
 	err = channel.ExchangeDeclare(
@@ -203,10 +278,13 @@ func (rabbit *RabbitMq) declareQueue(topic string) (err error) {
 		return fmt.Errorf("error creating dead letter queue: %s", err)
 	}
 
-	_, err = newFanOutQueue(channel, topic, appQueueName, deadLetterName)
+	for _, topic := range topics {
 
-	if err != nil {
-		return fmt.Errorf("error creating queue: %s", err)
+		_, err = newFanOutQueue(channel, topic, appQueueName, deadLetterName)
+
+		if err != nil {
+			return fmt.Errorf("error creating queue: %s", err)
+		}
 	}
 
 	return nil
@@ -231,6 +309,7 @@ func (rabbit *RabbitMq) PublishWithTx(txFunc PublishTxHandler) (err error) {
 	}
 
 	err = txFunc(&ChannelTx{
+		rabbit:          rabbit,
 		publishChannel:  ch,
 		registeredTopic: rabbit.registeredTopic,
 	})
@@ -253,24 +332,15 @@ func (rabbit *RabbitMq) PublishWithTx(txFunc PublishTxHandler) (err error) {
 func (rabbit *RabbitMq) PublishToTopic(ctx context.Context, topic string, event []byte, contentType string) (err error) {
 
 	appID := ctx.Value(appctx.AppIdHeader).(string)
-	correlationID := ctx.Value(appctx.CorrelationIdHeader).(string)
-
-	valueUserID := ctx.Value(appctx.AuthorizedUserIDHeader)
-	userID := ""
 
-	if valueUserID != nil {
-		userID = valueUserID.(string)
+	if !rabbit.registeredTopic[topic] {
+		return fmt.Errorf("app %s is not registered for topic %s", appID, topic)
 	}
 
-	valUserRoles := ctx.Value(appctx.AuthorizedUserRolesHeader)
-	userRoles := ""
+	publishing, err := rabbit.newPublishing(ctx, topic, event, contentType)
 
-	if valUserRoles != nil {
-		userRoles = valUserRoles.(string)
-	}
-
-	if !rabbit.registeredTopic[topic] {
-		return fmt.Errorf("app %s is not registered for topic %s", appID, topic)
+	if err != nil {
+		return err
 	}
 
 	if rabbit.publishChannel == nil {
@@ -283,30 +353,12 @@ func (rabbit *RabbitMq) PublishToTopic(ctx context.Context, topic string, event
 
 	}
 
-	msgID, err := uuid.NewV4()
-
-	if err != nil {
-		return fmt.Errorf("error getting uuid message ID, %s", err)
-	}
-
 	err = rabbit.publishChannel.Publish(
 		topic,
 		"",
 		false,
 		false,
-		amqp.Publishing{
-			ContentType:   contentType,
-			Body:          event,
-			MessageId:     msgID.String(),
-			DeliveryMode:  uint8(2),
-			CorrelationId: correlationID,
-			AppId:         string(appID),
-			Headers: amqp.Table{
-				appctx.AuthorizedUserIDHeader: userID,
-				appctx.AuthorizedUserRolesHeader: userRoles,
-				tracing.AWSXrayTraceId: tracing.GetParentSegmentTraceIDHeader(ctx),
-			},
-		})
+		publishing)
 
 	if err == amqp.ErrClosed {
 		log.ErrorfNoContext(rabbit.AppID, component, "Error while publishing on channel or connection, %s. Retry open channel for publishing...", err)
@@ -322,19 +374,7 @@ func (rabbit *RabbitMq) PublishToTopic(ctx context.Context, topic string, event
 			"",
 			false,
 			false,
-			amqp.Publishing{
-				ContentType:   contentType,
-				Body:          event,
-				MessageId:     msgID.String(),
-				DeliveryMode:  uint8(2),
-				CorrelationId: correlationID,
-				AppId:         string(appID),
-				Headers: amqp.Table{
-					appctx.AuthorizedUserIDHeader: userID,
-					appctx.AuthorizedUserRolesHeader: userRoles,
-					tracing.AWSXrayTraceId: tracing.GetParentSegmentTraceIDHeader(ctx),
-				},
-			})
+			publishing)
 
 		if err != nil {
 			return err
@@ -349,6 +389,59 @@ func (rabbit *RabbitMq) PublishToTopic(ctx context.Context, topic string, event
 	return nil
 }
 
+// newPublishing
+// Builds the AMQP message for the event, with the correlation, user and tracing headers from the context
+func (rabbit *RabbitMq) newPublishing(ctx context.Context, topic string, event []byte, contentType string) (publishing amqp.Publishing, err error) {
+
+	if rabbit.schemaRegistry != nil && rabbit.validateOnPublish {
+
+		err = rabbit.schemaRegistry.ValidateEvent(event, contentType)
+
+		if err != nil {
+			return publishing, err
+		}
+	}
+
+	publishing, err = newContextPublishing(ctx, event, contentType)
+
+	if err != nil {
+		return publishing, err
+	}
+
+	if rabbit.encryptor != nil {
+
+		err = rabbit.encryptor.encrypt(ctx, topic, &publishing)
+
+		if err != nil {
+			return publishing, err
+		}
+	}
+
+	if rabbit.compressor != nil {
+
+		err = rabbit.compressor.compress(&publishing)
+
+		if err != nil {
+			return publishing, err
+		}
+	}
+
+	if rabbit.signer != nil {
+		rabbit.signer.sign(topic, &publishing)
+	}
+
+	if rabbit.claimCheck != nil {
+
+		err = rabbit.claimCheck.checkIn(ctx, &publishing)
+
+		if err != nil {
+			return publishing, err
+		}
+	}
+
+	return publishing, nil
+}
+
 func (rabbit *RabbitMq) newPublishChannel() (err error) {
 
 	channel, err := rabbit.MqConnection.Channel()
@@ -372,7 +465,36 @@ func (rabbit *RabbitMq) SubscribeToTopic(topic string, processFunc ProcessEvent)
 
 func (rabbit *RabbitMq) SubscribeToTopicWithMaxMsg(topic string, processFunc ProcessEvent, maxMessages int) (err error) {
 
-	appQueueName := formQueueName(rabbit.AppID, topic)
+	err = rabbit.subscribe(topic, processFunc, maxMessages)
+
+	if err != nil {
+		return err
+	}
+
+	log.PrintfNoContext(rabbit.AppID, component, "App %s Subscribed to topic %s", rabbit.AppID, topic)
+
+	return nil
+}
+
+// SubscribeToQueue
+// Consumes a queue created with InitializeMultiTopicQueue. Deliveries that fail twice go to the
+// queue dead letter queue. UnSubscribe with the queue name ends the subscription.
+func (rabbit *RabbitMq) SubscribeToQueue(queue string, processFunc ProcessEvent, maxMessages int) (err error) {
+
+	err = rabbit.subscribe(queue, processFunc, maxMessages)
+
+	if err != nil {
+		return err
+	}
+
+	log.PrintfNoContext(rabbit.AppID, component, "App %s Subscribed to queue %s", rabbit.AppID, queue)
+
+	return nil
+}
+
+func (rabbit *RabbitMq) subscribe(queue string, processFunc ProcessEvent, maxMessages int) (err error) {
+
+	appQueueName := formQueueName(rabbit.AppID, queue)
 
 	channel, err := rabbit.MqConnection.Channel()
 
@@ -402,16 +524,23 @@ func (rabbit *RabbitMq) SubscribeToTopicWithMaxMsg(topic string, processFunc Pro
 		return err
 	}
 
-	rabbit.subscriptionChannels[topic] = make(chan bool)
+	subChan := make(chan bool)
+
+	rabbit.subscriptionMutex.Lock()
+	rabbit.subscriptionChannels[queue] = subChan
+	rabbit.subscriptionMutex.Unlock()
+
+	// cancels the handler context of the delivery in process when the subscription ends
+	subCtx := subscriptionContext(subChan)
 
 	go func() {
 		for {
 			select {
 			case delivery := <-deliveries:
 
-				rabbit.handleDelivery(delivery, processFunc)
+				rabbit.handleDelivery(subCtx, channel, queue, delivery, processFunc)
 
-			case <-rabbit.subscriptionChannels[topic]:
+			case <-subChan:
 
 				err := channel.Close()
 
@@ -425,55 +554,175 @@ func (rabbit *RabbitMq) SubscribeToTopicWithMaxMsg(topic string, processFunc Pro
 		}
 	}()
 
-	log.PrintfNoContext(rabbit.AppID, component, "App %s Subscribed to topic %s", rabbit.AppID, topic)
-
 	return nil
 }
 
 func (rabbit *RabbitMq) UnSubscribe(topic string) {
 
+	rabbit.subscriptionMutex.Lock()
+	defer rabbit.subscriptionMutex.Unlock()
+
 	subChan := rabbit.subscriptionChannels[topic]
 
 	if subChan != nil {
 		close(subChan)
+		delete(rabbit.subscriptionChannels, topic)
 	}
 
 }
 
 // handleDelivery
 // Call process function. If it fails requeue the first time.
-// the second fail will send it to dead letter
-func (rabbit *RabbitMq) handleDelivery(delivery amqp.Delivery, processFunc ProcessEvent) {
+// the second fail will send it to dead letter of the queue
+func (rabbit *RabbitMq) handleDelivery(subCtx context.Context, channel *amqp.Channel, queue string, delivery amqp.Delivery, processFunc ProcessEvent) {
 
 	if delivery.CorrelationId == "" {
 		id, _ := uuid.NewV4()
 		delivery.CorrelationId = id.String()
 	}
 
-	ctx := appctx.NewContextFromDelivery(rabbit.AppID, delivery)
+	ctx, cancel := newDeliveryContext(subCtx, rabbit.AppID, delivery, rabbit.deliveryTimeout)
+	defer cancel()
 
 	ctx, seg := tracing.BeginSegmentFromEventDelivery(ctx, rabbit.AppID, delivery)
 
-	err := processFunc(ctx, delivery.Body, delivery.ContentType)
+	// the delivery as received, to dead-letter it still encoded
+	received := delivery
 
-	if err != nil {
+	if rabbit.claimCheck != nil {
+
+		body, err := rabbit.claimCheck.checkOut(ctx, delivery)
+
+		if err != nil {
+			log.Errorf(ctx, component, "Error handling delivery, %s", err)
+
+			seg.Close(err)
+
+			rabbit.nackDelivery(ctx, delivery, err)
+
+			return
+		}
+
+		delivery.Body = body
+	}
+
+	if rabbit.verifier != nil {
+
+		err := rabbit.verifier.verify(delivery)
+
+		if err != nil {
+
+			switch rabbit.verifier.policy {
+			case SignatureLogOnly:
+
+				log.Errorf(ctx, component, "Signature verification failed from app %s. Processing delivery anyway, %s", delivery.AppId, err)
+
+			case SignatureDiscard:
+
+				log.Errorf(ctx, component, "Signature verification failed from app %s. Discarding delivery, %s", delivery.AppId, err)
 
+				ackErr := delivery.Ack(false)
+
+				if ackErr != nil {
+					log.Errorf(ctx, component, "Error while Ack delivery, %s", ackErr)
+				}
+
+				seg.Close(err)
+
+				return
+
+			default:
+
+				log.Errorf(ctx, component, "Signature verification failed from app %s. Dead-letter delivery, %s", delivery.AppId, err)
+
+				rabbit.deadLetter(ctx, channel, queue, received, amqp.Table{
+					SignatureErrorHeader: err.Error(),
+				})
+
+				seg.Close(err)
+
+				return
+			}
+		}
+	}
+
+	body, err := decompress(delivery)
+
+	if err != nil {
 		log.Errorf(ctx, component, "Error handling delivery, %s", err)
 
 		seg.Close(err)
 
-		if delivery.Redelivered {
-			log.Printf(ctx, component, "2nd attempt failure. Dead-letter delivery, %s", err)
-			err = delivery.Nack(false, false)
-		} else {
-			log.Printf(ctx, component, "1st attempt failure. Re-queue delivery, %s", err)
-			err = delivery.Nack(false, true)
+		rabbit.nackDelivery(ctx, delivery, err)
+
+		return
+	}
+
+	delivery.Body = body
+	delivery.ContentEncoding = ""
+
+	if rabbit.encryptor != nil {
+
+		// the source topic key, the queue may be bound to several topics
+		topic := delivery.Exchange
+
+		if topic == "" {
+			topic = queue
 		}
 
+		body, err := rabbit.encryptor.decrypt(ctx, topic, delivery)
+
 		if err != nil {
-			log.Errorf(ctx, component, "Error while Nack delivery, %s", err)
+			log.Errorf(ctx, component, "Error handling delivery, %s", err)
+
+			seg.Close(err)
+
+			rabbit.nackDelivery(ctx, delivery, err)
+
+			return
 		}
 
+		delivery.Body = body
+	}
+
+	if rabbit.schemaRegistry != nil && rabbit.validateOnConsume {
+
+		err := rabbit.schemaRegistry.ValidateEvent(delivery.Body, delivery.ContentType)
+
+		if err != nil {
+
+			log.Errorf(ctx, component, "Invalid delivery. Dead-letter delivery, %s", err)
+
+			validationErrors := []string{err.Error()}
+
+			if schemaErr, ok := err.(*SchemaValidationError); ok {
+				validationErrors = schemaErr.Errors
+			}
+
+			rabbit.deadLetter(ctx, channel, queue, received, amqp.Table{
+				SchemaValidationErrorsHeader: strings.Join(validationErrors, "\n"),
+			})
+
+			seg.Close(err)
+
+			return
+		}
+	}
+
+	err = deliveryFailure(ctx, processFunc(ctx, delivery.Body, delivery.ContentType))
+
+	if err != nil {
+
+		log.Errorf(ctx, component, "Error handling delivery, %s", err)
+
+		seg.Close(err)
+
+		if subCtx.Err() != nil {
+			rabbit.requeueDelivery(ctx, delivery)
+			return
+		}
+
+		rabbit.nackDelivery(ctx, delivery, err)
 
 		return
 	}
@@ -484,16 +733,162 @@ func (rabbit *RabbitMq) handleDelivery(delivery amqp.Delivery, processFunc Proce
 		log.Errorf(ctx, component, "Error while Ack delivery, %s", err)
 	}
 
+	if rabbit.claimCheck != nil {
+		rabbit.claimCheck.release(ctx, delivery)
+	}
+
 	seg.Close(nil)
 }
 
+// nackDelivery
+// Re-queue the delivery on the first failure and dead-letter it on the second
+func (rabbit *RabbitMq) nackDelivery(ctx context.Context, delivery amqp.Delivery, cause error) {
+
+	var err error
+
+	if delivery.Redelivered {
+		log.Printf(ctx, component, "2nd attempt failure. Dead-letter delivery, %s", cause)
+		err = delivery.Nack(false, false)
+	} else {
+		log.Printf(ctx, component, "1st attempt failure. Re-queue delivery, %s", cause)
+		err = delivery.Nack(false, true)
+	}
+
+	if err != nil {
+		log.Errorf(ctx, component, "Error while Nack delivery, %s", err)
+	}
+}
+
+// requeueDelivery
+// Re-queue the delivery when the subscription ended while processing it, instead of dead-lettering it
+func (rabbit *RabbitMq) requeueDelivery(ctx context.Context, delivery amqp.Delivery) {
+
+	log.Printf(ctx, component, "Subscription ended while processing. Re-queue delivery")
+
+	err := delivery.Nack(false, true)
+
+	if err != nil {
+		log.Errorf(ctx, component, "Error while Nack delivery, %s", err)
+	}
+}
+
+// deadLetter
+// Publish a copy of the delivery with the extra headers straight to the queue dead letter exchange
+// and Ack the original. If the copy can't be published the delivery is rejected, so the
+// broker dead-letters it without the extra headers.
+func (rabbit *RabbitMq) deadLetter(ctx context.Context, channel *amqp.Channel, queue string, delivery amqp.Delivery, headers amqp.Table) {
+
+	deadLetterHeaders := amqp.Table{}
+
+	for key, value := range delivery.Headers {
+		deadLetterHeaders[key] = value
+	}
+
+	for key, value := range headers {
+		deadLetterHeaders[key] = value
+	}
+
+	err := channel.Publish(
+		formDeadLetterName(rabbit.AppID, queue),
+		"",
+		false,
+		false,
+		amqp.Publishing{
+			ContentType:     delivery.ContentType,
+			ContentEncoding: delivery.ContentEncoding,
+			Body:            delivery.Body,
+			MessageId:       delivery.MessageId,
+			DeliveryMode:    uint8(2),
+			CorrelationId:   delivery.CorrelationId,
+			AppId:           delivery.AppId,
+			Timestamp:       delivery.Timestamp,
+			Headers:         deadLetterHeaders,
+		})
+
+	if err != nil {
+		log.Errorf(ctx, component, "Error publishing to dead letter, rejecting delivery instead, %s", err)
+
+		err = delivery.Nack(false, false)
+
+		if err != nil {
+			log.Errorf(ctx, component, "Error while Nack delivery, %s", err)
+		}
+
+		return
+	}
+
+	err = delivery.Ack(false)
+
+	if err != nil {
+		log.Errorf(ctx, component, "Error while Ack delivery, %s", err)
+	}
+}
+
+// newContextPublishing
+// Builds the message for the event with a new message ID, and the correlation, user and tracing headers from the context
+func newContextPublishing(ctx context.Context, event []byte, contentType string) (publishing amqp.Publishing, err error) {
+
+	appID := ctx.Value(appctx.AppIdHeader).(string)
+	correlationID := ctx.Value(appctx.CorrelationIdHeader).(string)
+
+	valueUserID := ctx.Value(appctx.AuthorizedUserIDHeader)
+	userID := ""
+
+	if valueUserID != nil {
+		userID = valueUserID.(string)
+	}
+
+	valUserRoles := ctx.Value(appctx.AuthorizedUserRolesHeader)
+	userRoles := ""
+
+	if valUserRoles != nil {
+		userRoles = valUserRoles.(string)
+	}
+
+	msgID, err := uuid.NewV4()
+
+	if err != nil {
+		return publishing, fmt.Errorf("error getting uuid message ID, %s", err)
+	}
+
+	publishing = amqp.Publishing{
+		ContentType:   contentType,
+		Body:          event,
+		MessageId:     msgID.String(),
+		DeliveryMode:  uint8(2),
+		CorrelationId: correlationID,
+		AppId:         appID,
+		Headers: amqp.Table{
+			appctx.AuthorizedUserIDHeader:    userID,
+			appctx.AuthorizedUserRolesHeader: userRoles,
+			tracing.AWSXrayTraceId:           tracing.GetParentSegmentTraceIDHeader(ctx),
+		},
+	}
+
+	setDeliveryDeadline(ctx, &publishing)
+
+	return publishing, nil
+}
+
+// QueueName
+// Returns the name of the app queue subscribed to the topic
+func QueueName(appID app.ApplicationID, topic string) string {
+	return formQueueName(appID, topic)
+}
+
+// DeadLetterQueueName
+// Returns the name of the app dead letter queue, and exchange, for the topic
+func DeadLetterQueueName(appID app.ApplicationID, topic string) string {
+	return formDeadLetterName(appID, topic)
+}
+
 func formQueueName(appID app.ApplicationID, topic string) string {
 	return fmt.Sprintf("%s->%s", appID, topic)
 
 }
 
 func formDeadLetterName(appID app.ApplicationID, topic string) string {
-	return fmt.Sprintf("%s->%s.deadletter", appID, topic)
+	return fmt.Sprintf("%s->%s%s", appID, topic, deadLetterSuffix)
 }
 
 // newFanOutQueue
@@ -190,3 +190,53 @@ func TestRabbitMq_Subscribe(t *testing.T) {
 
 
 }
+
+func TestRabbitMq_SubscribeToQueue(t *testing.T) {
+
+	const queue, appID, event = "testMultiTopic", "testApp", "testEvent"
+	topics := []string{"testMultiTopicUser", "testMultiTopicChat"}
+	expQueueName := fmt.Sprintf("%s->%s", appID, queue)
+	expDeadQueueName := fmt.Sprintf("%s->%s.deadletter", appID, queue)
+	rb, _ := NewRabbitMq(appID, "rabbitmq", "rabbitmq", "localhost")
+
+	ch, _ := rb.MqConnection.Channel()
+	defer ch.Close()
+
+	ctx := appctx.NewContextFromValuesWithUser(appID, "corrID", "userID")
+
+	for _, topic := range topics {
+		rb.RegisterTopic(topic)
+	}
+
+	err := rb.InitializeMultiTopicQueue(queue, topics...)
+
+	assert.Nil(t, err)
+
+	rChan := make(chan string)
+
+	err = rb.SubscribeToQueue(queue, func(ctx context.Context, event []byte, contentType string) error {
+
+		rChan <- appctx.GetSourceTopic(ctx)
+
+		return nil
+	}, 0)
+
+	assert.Nil(t, err)
+
+	for _, topic := range topics {
+
+		rb.PublishToTopic(ctx, topic, []byte(event), "")
+
+		assert.Equal(t, topic, <-rChan)
+	}
+
+	ch.QueueDelete(expDeadQueueName, false, false, true)
+	ch.QueueDelete(expQueueName, false, false, true)
+	ch.ExchangeDelete(expDeadQueueName, false, true)
+
+	for _, topic := range topics {
+		ch.ExchangeDelete(topic, false, true)
+	}
+
+	rb.CleanUp()
+}
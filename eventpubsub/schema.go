@@ -0,0 +1,204 @@
+package eventpubsub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+type (
+	// SchemaRegistry
+	// Holds the JSON Schemas for the Data of AppEvents, keyed by event type and version.
+	// Events with no schema registered for its type are considered valid.
+	SchemaRegistry struct {
+		schemas map[schemaKey]*jsonschema.Schema
+	}
+
+	schemaKey struct {
+		eventType string
+		version   int
+	}
+
+	// SchemaValidationError
+	// Returned when an AppEvent data doesn't match the registered schema
+	SchemaValidationError struct {
+		EventType string
+		Version   int
+		Errors    []string
+	}
+)
+
+const (
+	// SchemaValidationErrorsHeader is set on dead-lettered deliveries that failed schema validation
+	SchemaValidationErrorsHeader = "x-schema-validation-errors"
+
+	jsonContentType = "application/json"
+)
+
+var (
+	schemaFileName = regexp.MustCompile(`^(.+?)(?:\.v(\d+))?\.json$`)
+)
+
+// NewSchemaRegistry
+// Loads all the JSON Schema files in dir from the file system, usually an embed.FS.
+// Files are named after the event type they validate, with an optional version:
+//
+// 		user_created.json     - any version of user_created without a specific schema
+// 		user_created.v2.json  - version 2 of user_created
+func NewSchemaRegistry(fsys fs.FS, dir string) (registry *SchemaRegistry, err error) {
+
+	registry = &SchemaRegistry{
+		schemas: make(map[schemaKey]*jsonschema.Schema),
+	}
+
+	entries, err := fs.ReadDir(fsys, dir)
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema directory %s, %s", dir, err)
+	}
+
+	for _, entry := range entries {
+
+		if entry.IsDir() {
+			continue
+		}
+
+		parts := schemaFileName.FindStringSubmatch(entry.Name())
+
+		if parts == nil {
+			continue
+		}
+
+		version := 0
+
+		if parts[2] != "" {
+			version, _ = strconv.Atoi(parts[2])
+		}
+
+		schema, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+
+		if err != nil {
+			return nil, fmt.Errorf("error reading schema file %s, %s", entry.Name(), err)
+		}
+
+		err = registry.AddSchema(parts[1], version, schema)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return registry, nil
+}
+
+// AddSchema
+// Compiles and registers the schema for the event type data.
+// Version 0 is used for events without a version or without a schema for its version.
+func (registry *SchemaRegistry) AddSchema(eventType string, version int, schema []byte) (err error) {
+
+	url := fmt.Sprintf("%s.v%d.json", eventType, version)
+
+	compiler := jsonschema.NewCompiler()
+
+	err = compiler.AddResource(url, bytes.NewReader(schema))
+
+	if err != nil {
+		return fmt.Errorf("error adding schema for event type %s version %d, %s", eventType, version, err)
+	}
+
+	compiled, err := compiler.Compile(url)
+
+	if err != nil {
+		return fmt.Errorf("error compiling schema for event type %s version %d, %s", eventType, version, err)
+	}
+
+	registry.schemas[schemaKey{eventType: eventType, version: version}] = compiled
+
+	return nil
+}
+
+// ValidateEvent
+// Validates the Data of a serialized AppEvent against the registered schema.
+// Only JSON content is validated, any other content type is ignored.
+func (registry *SchemaRegistry) ValidateEvent(event []byte, contentType string) (err error) {
+
+	if !strings.HasPrefix(contentType, jsonContentType) {
+		return nil
+	}
+
+	appEvent, err := appevent.NewAppEventFromJSON(event)
+
+	if err != nil {
+		return &SchemaValidationError{Errors: []string{err.Error()}}
+	}
+
+	return registry.Validate(appEvent)
+}
+
+// Validate
+// Validates the AppEvent Data against the schema registered for its type and version
+func (registry *SchemaRegistry) Validate(appEvent appevent.AppEvent) (err error) {
+
+	schema := registry.schemas[schemaKey{eventType: appEvent.EventType, version: appEvent.Version}]
+
+	if schema == nil {
+		schema = registry.schemas[schemaKey{eventType: appEvent.EventType}]
+	}
+
+	if schema == nil {
+		return nil
+	}
+
+	validationErr := &SchemaValidationError{
+		EventType: appEvent.EventType,
+		Version:   appEvent.Version,
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(appEvent.Data))
+	decoder.UseNumber()
+
+	var data interface{}
+
+	err = decoder.Decode(&data)
+
+	if err != nil {
+		validationErr.Errors = []string{fmt.Sprintf("invalid JSON data, %s", err)}
+		return validationErr
+	}
+
+	err = schema.Validate(data)
+
+	if err == nil {
+		return nil
+	}
+
+	schemaErr, ok := err.(*jsonschema.ValidationError)
+
+	if !ok {
+		validationErr.Errors = []string{err.Error()}
+		return validationErr
+	}
+
+	for _, basicErr := range schemaErr.BasicOutput().Errors {
+
+		if len(basicErr.Error) == 0 {
+			continue
+		}
+
+		validationErr.Errors = append(validationErr.Errors, fmt.Sprintf("%s: %s", basicErr.InstanceLocation, basicErr.Error))
+	}
+
+	return validationErr
+}
+
+func (e *SchemaValidationError) Error() string {
+	return fmt.Sprintf("event type %s version %d failed schema validation, %s", e.EventType, e.Version, strings.Join(e.Errors, "; "))
+}
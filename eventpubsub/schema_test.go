@@ -0,0 +1,113 @@
+package eventpubsub
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testUserCreatedSchema = `{
+		"type": "object",
+		"properties": {
+			"userID": {"type": "string"},
+			"age": {"type": "integer", "minimum": 18}
+		},
+		"required": ["userID"]
+	}`
+
+	testUserCreatedV2Schema = `{
+		"type": "object",
+		"properties": {
+			"userID": {"type": "string"},
+			"email": {"type": "string"}
+		},
+		"required": ["userID", "email"]
+	}`
+)
+
+func TestNewSchemaRegistry(t *testing.T) {
+
+	fsys := fstest.MapFS{
+		"schemas/user_created.json":    {Data: []byte(testUserCreatedSchema)},
+		"schemas/user_created.v2.json": {Data: []byte(testUserCreatedV2Schema)},
+		"schemas/README.md":            {Data: []byte("not a schema")},
+	}
+
+	registry, err := NewSchemaRegistry(fsys, "schemas")
+
+	assert.Nil(t, err)
+	assert.Len(t, registry.schemas, 2)
+
+	_, err = NewSchemaRegistry(fstest.MapFS{
+		"schemas/broken.json": {Data: []byte(`{"type": 1`)},
+	}, "schemas")
+
+	assert.NotNil(t, err)
+}
+
+func TestSchemaRegistry_Validate(t *testing.T) {
+
+	registry, err := NewSchemaRegistry(fstest.MapFS{
+		"schemas/user_created.json":    {Data: []byte(testUserCreatedSchema)},
+		"schemas/user_created.v2.json": {Data: []byte(testUserCreatedV2Schema)},
+	}, "schemas")
+
+	assert.Nil(t, err)
+
+	type testDef struct {
+		Event appevent.AppEvent
+		Valid bool
+	}
+
+	Tests := []testDef{
+		{appevent.NewAppEvent("user_created", []byte(`{"userID": "1", "age": 20}`)), true},
+		{appevent.NewAppEvent("user_created", []byte(`{"age": 20}`)), false},
+		{appevent.NewAppEvent("user_created", []byte(`{"userID": "1", "age": 10}`)), false},
+		{appevent.NewAppEvent("user_created", []byte(`{"userID": "1", "age": 20.5}`)), false},
+		{appevent.NewAppEvent("user_created", []byte(`not json`)), false},
+		{appevent.NewVersionedAppEvent("user_created", 2, []byte(`{"userID": "1", "email": "a@b.c"}`)), true},
+		{appevent.NewVersionedAppEvent("user_created", 2, []byte(`{"userID": "1"}`)), false},
+		{appevent.NewVersionedAppEvent("user_created", 3, []byte(`{"userID": "1"}`)), true},
+		{appevent.NewAppEvent("user_deleted", []byte(`{}`)), true},
+	}
+
+	for idx, test := range Tests {
+
+		err := registry.Validate(test.Event)
+
+		if test.Valid {
+			assert.Nilf(t, err, "Failed test %d", idx)
+			continue
+		}
+
+		assert.NotNilf(t, err, "Failed test %d", idx)
+		assert.IsTypef(t, &SchemaValidationError{}, err, "Failed test %d", idx)
+		assert.NotEmptyf(t, err.(*SchemaValidationError).Errors, "Failed test %d", idx)
+	}
+}
+
+func TestSchemaRegistry_ValidateEvent(t *testing.T) {
+
+	registry, _ := NewSchemaRegistry(fstest.MapFS{
+		"schemas/user_created.json": {Data: []byte(testUserCreatedSchema)},
+	}, "schemas")
+
+	invalid := appevent.NewAppEvent("user_created", []byte(`{"age": 20}`))
+	invalidJSON, _ := invalid.ToJSON()
+
+	err := registry.ValidateEvent(invalidJSON, "application/json")
+
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "user_created")
+
+	err = registry.ValidateEvent(invalidJSON, "text/plain")
+
+	assert.Nil(t, err)
+
+	err = registry.ValidateEvent([]byte("testEvent"), "application/json")
+
+	assert.NotNil(t, err)
+}
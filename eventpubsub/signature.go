@@ -0,0 +1,231 @@
+package eventpubsub
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/log"
+	"github.com/streadway/amqp"
+)
+
+type (
+	// SigningKeyFunc
+	// Returns the signing key with keyID of the publishing app
+	SigningKeyFunc func(appID, keyID string) (key []byte, err error)
+
+	// SignaturePolicy
+	// What to do with deliveries that are unsigned or fail signature verification
+	SignaturePolicy string
+
+	signer struct {
+		keyID string
+		key   []byte
+	}
+
+	verifier struct {
+		keyFunc SigningKeyFunc
+		policy  SignaturePolicy
+		maxAge  time.Duration
+	}
+)
+
+const (
+	// SignatureHeader is the base64 HMAC-SHA256 of the body, the topic, the timestamp and the security relevant properties
+	SignatureHeader = "x-signature"
+	// SignatureKeyIDHeader is the ID of the publishing app key used to sign
+	SignatureKeyIDHeader = "x-signature-key-id"
+	// SignatureErrorHeader is set on deliveries dead-lettered for failing verification
+	SignatureErrorHeader = "x-signature-error"
+	// SignatureTopicHeader is the signed topic the message was published to, kept when the delivery is dead-lettered
+	SignatureTopicHeader = "x-signature-topic"
+
+	// signatureClockSkew is the tolerance for timestamps of publishers whose clock is ahead
+	signatureClockSkew = time.Minute
+
+	// SignatureDeadLetter sends the delivery to the dead letter queue with the x-signature-error header
+	SignatureDeadLetter = SignaturePolicy("deadletter")
+	// SignatureDiscard acknowledges and drops the delivery
+	SignatureDiscard = SignaturePolicy("discard")
+	// SignatureLogOnly logs the failure and processes the delivery, meant for rolling out signing
+	SignatureLogOnly = SignaturePolicy("log")
+)
+
+var (
+	ErrUnsignedDelivery = errors.New("delivery is not signed")
+	ErrInvalidSignature = errors.New("delivery signature is invalid")
+	ErrExpiredSignature = errors.New("delivery signature is expired")
+)
+
+// EnableSigning
+// Signs published messages with the app key, so consumers can verify the publishing app,
+// the authorized user headers and the body weren't forged or tampered. The topic, timestamp and
+// delivery deadline are signed too, so a message can't be replayed to another topic or with a new deadline.
+func (rabbit *RabbitMq) EnableSigning(keyID string, key []byte) {
+
+	rabbit.signer = &signer{
+		keyID: keyID,
+		key:   key,
+	}
+
+	log.PrintfNoContext(rabbit.AppID, component, "Signing enabled with key %s", keyID)
+}
+
+// EnableSignatureVerification
+// Verifies the signature of deliveries before processing them, with the keys of the publishing apps.
+// Deliveries signed more than maxAge ago are expired, so old messages can't be replayed. 0 doesn't check the age.
+// Unsigned, tampered and expired deliveries are handled according to the policy.
+func (rabbit *RabbitMq) EnableSignatureVerification(keyFunc SigningKeyFunc, policy SignaturePolicy, maxAge time.Duration) (err error) {
+
+	if policy != SignatureDeadLetter && policy != SignatureDiscard && policy != SignatureLogOnly {
+		return fmt.Errorf("invalid signature policy %s. Expected %s | %s | %s", policy, SignatureDeadLetter, SignatureDiscard, SignatureLogOnly)
+	}
+
+	rabbit.verifier = &verifier{
+		keyFunc: keyFunc,
+		policy:  policy,
+		maxAge:  maxAge,
+	}
+
+	log.PrintfNoContext(rabbit.AppID, component, "Signature verification enabled with policy %s, max age %s", policy, maxAge)
+
+	return nil
+}
+
+func (s *signer) sign(topic string, publishing *amqp.Publishing) {
+
+	// AMQP timestamps have a precision of seconds
+	if publishing.Timestamp.IsZero() {
+		publishing.Timestamp = time.Now().UTC().Truncate(time.Second)
+	}
+
+	mac := hmac.New(sha256.New, s.key)
+
+	writeSigned(mac, publishing.AppId, publishing.MessageId, publishing.ContentType, publishing.ContentEncoding, topic, publishing.Timestamp, publishing.Headers, publishing.Body)
+
+	publishing.Headers[SignatureTopicHeader] = topic
+	publishing.Headers[SignatureKeyIDHeader] = s.keyID
+	publishing.Headers[SignatureHeader] = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (v *verifier) verify(delivery amqp.Delivery) (err error) {
+
+	signature, _ := delivery.Headers[SignatureHeader].(string)
+	keyID, _ := delivery.Headers[SignatureKeyIDHeader].(string)
+
+	if signature == "" {
+		return ErrUnsignedDelivery
+	}
+
+	signatureBytes, err := base64.StdEncoding.DecodeString(signature)
+
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	key, err := v.keyFunc(delivery.AppId, keyID)
+
+	if err != nil {
+		return fmt.Errorf("error getting signing key %s for app %s, %s", keyID, delivery.AppId, err)
+	}
+
+	// messages signed before the topic header are verified against the topic they were delivered from
+	topic, _ := delivery.Headers[SignatureTopicHeader].(string)
+
+	if topic == "" {
+		topic = publishedTopic(delivery)
+	}
+
+	mac := hmac.New(sha256.New, key)
+
+	writeSigned(mac, delivery.AppId, delivery.MessageId, delivery.ContentType, delivery.ContentEncoding, topic, delivery.Timestamp, delivery.Headers, delivery.Body)
+
+	if !hmac.Equal(signatureBytes, mac.Sum(nil)) {
+		return ErrInvalidSignature
+	}
+
+	// a message signed for other topic can't be replayed to this one
+	if !isDeadLettered(delivery) && delivery.Exchange != topic {
+		return ErrInvalidSignature
+	}
+
+	if v.maxAge > 0 {
+
+		now := time.Now()
+
+		if delivery.Timestamp.Before(now.Add(-v.maxAge)) || delivery.Timestamp.After(now.Add(signatureClockSkew)) {
+			return ErrExpiredSignature
+		}
+	}
+
+	return nil
+}
+
+// publishedTopic
+// Returns the topic the delivery was published to. A delivery dead-lettered by the broker is routed
+// by the dead letter exchange, its topic is the exchange of the oldest x-death entry.
+func publishedTopic(delivery amqp.Delivery) string {
+
+	deaths, _ := delivery.Headers["x-death"].([]interface{})
+
+	if len(deaths) > 0 {
+
+		death, _ := deaths[len(deaths)-1].(amqp.Table)
+
+		if exchange, ok := death["exchange"].(string); ok {
+			return exchange
+		}
+	}
+
+	return delivery.Exchange
+}
+
+// isDeadLettered
+// Returns true if the delivery comes from a dead letter exchange, dead-lettered by the broker
+// or re-published by deadLetter, so its exchange is not the published topic
+func isDeadLettered(delivery amqp.Delivery) bool {
+
+	_, hasDeaths := delivery.Headers["x-death"]
+
+	return hasDeaths || strings.HasSuffix(delivery.Exchange, deadLetterSuffix)
+}
+
+// writeSigned
+// Writes the signed content to the mac. Every value is length prefixed so values
+// can't be moved from one field to another.
+func writeSigned(mac hash.Hash, appID, messageID, contentType, contentEncoding, topic string, timestamp time.Time, headers amqp.Table, body []byte) {
+
+	headerValue := func(name string) string {
+		value, _ := headers[name].(string)
+		return value
+	}
+
+	values := []string{
+		appID,
+		messageID,
+		contentType,
+		contentEncoding,
+		topic,
+		strconv.FormatInt(timestamp.Unix(), 10),
+		headerValue(DeliveryDeadlineHeader),
+		headerValue(appctx.AuthorizedUserIDHeader),
+		headerValue(appctx.AuthorizedUserRolesHeader),
+		headerValue(EncryptionKeyIDHeader),
+		headerValue(EncryptionDataKeyHeader),
+		headerValue(EncryptedFieldsHeader),
+	}
+
+	for _, value := range values {
+		_, _ = fmt.Fprintf(mac, "%d:%s\n", len(value), value)
+	}
+
+	_, _ = fmt.Fprintf(mac, "%d:", len(body))
+	_, _ = mac.Write(body)
+}
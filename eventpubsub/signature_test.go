@@ -0,0 +1,156 @@
+package eventpubsub
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSigner_Verify(t *testing.T) {
+
+	keys := map[string][]byte{
+		"appA/v1": []byte("appA secret"),
+		"appB/v1": []byte("appB secret"),
+	}
+
+	v := &verifier{
+		keyFunc: func(appID, keyID string) (key []byte, err error) {
+
+			key, ok := keys[fmt.Sprintf("%s/%s", appID, keyID)]
+
+			if !ok {
+				return nil, fmt.Errorf("unknown key")
+			}
+
+			return key, nil
+		},
+		policy: SignatureDeadLetter,
+	}
+
+	// zero signs with the current time
+	var signedAt time.Time
+
+	newSignedDelivery := func() amqp.Delivery {
+
+		publishing := amqp.Publishing{
+			Timestamp:   signedAt,
+			AppId:       "appA",
+			MessageId:   "msgID",
+			ContentType: "application/json",
+			Body:        []byte(`{"EventType":"test"}`),
+			Headers: amqp.Table{
+				appctx.AuthorizedUserIDHeader:    "userID",
+				appctx.AuthorizedUserRolesHeader: "User",
+				DeliveryDeadlineHeader:           "2020-01-01T10:00:00Z",
+			},
+		}
+
+		(&signer{keyID: "v1", key: keys["appA/v1"]}).sign("topicA", &publishing)
+
+		return amqp.Delivery{
+			AppId:       publishing.AppId,
+			MessageId:   publishing.MessageId,
+			ContentType: publishing.ContentType,
+			Timestamp:   publishing.Timestamp,
+			Exchange:    "topicA",
+			Body:        publishing.Body,
+			Headers:     publishing.Headers,
+		}
+	}
+
+	delivery := newSignedDelivery()
+
+	assert.Nil(t, v.verify(delivery))
+
+	delivery = newSignedDelivery()
+	delivery.Headers[appctx.AuthorizedUserRolesHeader] = "User,Admin"
+
+	assert.Equal(t, ErrInvalidSignature, v.verify(delivery))
+
+	delivery = newSignedDelivery()
+	delivery.AppId = "appB"
+
+	assert.Equal(t, ErrInvalidSignature, v.verify(delivery))
+
+	delivery = newSignedDelivery()
+	delivery.Body = []byte(`{"EventType":"other"}`)
+
+	assert.Equal(t, ErrInvalidSignature, v.verify(delivery))
+
+	delivery = newSignedDelivery()
+	delivery.Exchange = "topicB"
+
+	assert.Equal(t, ErrInvalidSignature, v.verify(delivery))
+
+	delivery = newSignedDelivery()
+	delivery.Timestamp = delivery.Timestamp.Add(time.Hour)
+
+	assert.Equal(t, ErrInvalidSignature, v.verify(delivery))
+
+	delivery = newSignedDelivery()
+	delivery.Headers[DeliveryDeadlineHeader] = "2020-01-02T10:00:00Z"
+
+	assert.Equal(t, ErrInvalidSignature, v.verify(delivery))
+
+	delivery = newSignedDelivery()
+	delivery.Exchange = "appB.topicA.dlx"
+	delivery.Headers["x-death"] = []interface{}{amqp.Table{"exchange": "topicA", "reason": "rejected"}}
+
+	assert.Nil(t, v.verify(delivery))
+
+	// re-published to the dead letter exchange by deadLetter
+	delivery = newSignedDelivery()
+	delivery.Exchange = formDeadLetterName("appB", "topicA")
+
+	assert.Nil(t, v.verify(delivery))
+
+	delivery = newSignedDelivery()
+	delivery.Exchange = "topicB"
+	delivery.Headers[SignatureTopicHeader] = "topicB"
+
+	assert.Equal(t, ErrInvalidSignature, v.verify(delivery))
+
+	// signed before the topic header
+	delivery = newSignedDelivery()
+	delete(delivery.Headers, SignatureTopicHeader)
+
+	assert.Nil(t, v.verify(delivery))
+
+	delivery = newSignedDelivery()
+	delivery.Headers[SignatureKeyIDHeader] = "v2"
+
+	assert.NotNil(t, v.verify(delivery))
+
+	delivery = newSignedDelivery()
+	delete(delivery.Headers, SignatureHeader)
+
+	assert.Equal(t, ErrUnsignedDelivery, v.verify(delivery))
+
+	type testDef struct {
+		MaxAge   time.Duration
+		SignedAt time.Time
+		Expected error
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+
+	Tests := []testDef{
+		{0, now.Add(-48 * time.Hour), nil},
+		{time.Hour, now.Add(-30 * time.Minute), nil},
+		{time.Hour, now.Add(-2 * time.Hour), ErrExpiredSignature},
+		{time.Hour, now.Add(30 * time.Second), nil},
+		{time.Hour, now.Add(time.Hour), ErrExpiredSignature},
+	}
+
+	for idx, test := range Tests {
+
+		v.maxAge = test.MaxAge
+		signedAt = test.SignedAt
+
+		assert.Equalf(t, test.Expected, v.verify(newSignedDelivery()), "Failed test %d", idx)
+	}
+}
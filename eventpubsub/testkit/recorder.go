@@ -0,0 +1,419 @@
+package testkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/app"
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/HelloSundayMorning/apputils/eventpubsub"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+type (
+	// PublishedEvent
+	// An event published through the Recorder with the context headers at publish time
+	PublishedEvent struct {
+		Topic         string
+		ContentType   string
+		Event         []byte
+		AppEvent      *appevent.AppEvent // nil if the event is not an AppEvent
+		AppID         string
+		CorrelationID string
+		UserID        string
+		UserRoles     string
+		Transactional bool // published with PublishWithTx
+	}
+
+	// Recorder
+	// EventPubSub implementation for tests. It records every publish, including the ones
+	// in transactions committed through PubSubTx, and delivers events to subscribers on demand with Deliver.
+	Recorder struct {
+		AppID app.ApplicationID
+
+		// RequireRegisteredTopic makes publishing to a topic not registered fail as RabbitMq does
+		RequireRegisteredTopic bool
+
+		// PublishErr is returned by every publish while set
+		PublishErr error
+
+		mu               sync.Mutex
+		published        []PublishedEvent
+		publishedChan    chan bool
+		registeredTopics map[string]bool
+		queues           map[string][]string
+		subscriptions    map[string]eventpubsub.ProcessEvent
+	}
+
+	recorderTx struct {
+		recorder  *Recorder
+		published []PublishedEvent
+	}
+)
+
+var (
+	_ eventpubsub.EventPubSub     = &Recorder{}
+	_ eventpubsub.QueueSubscriber = &Recorder{}
+)
+
+func NewRecorder(appID app.ApplicationID) *Recorder {
+
+	return &Recorder{
+		AppID:            appID,
+		publishedChan:    make(chan bool),
+		registeredTopics: make(map[string]bool),
+		queues:           make(map[string][]string),
+		subscriptions:    make(map[string]eventpubsub.ProcessEvent),
+	}
+}
+
+func (rec *Recorder) RegisterTopic(topic string) (err error) {
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.registeredTopics[topic] = true
+
+	return nil
+}
+
+func (rec *Recorder) InitializeQueue(topic string) (err error) {
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.queues[topic] = []string{topic}
+
+	return nil
+}
+
+func (rec *Recorder) InitializeMultiTopicQueue(queue string, topics ...string) (err error) {
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.queues[queue] = topics
+
+	return nil
+}
+
+func (rec *Recorder) PublishToTopic(ctx context.Context, topic string, event []byte, contentType string) (err error) {
+
+	published, err := rec.newPublishedEvent(ctx, topic, event, contentType, false)
+
+	if err != nil {
+		return err
+	}
+
+	rec.record(published)
+
+	return nil
+}
+
+func (rec *Recorder) SubscribeToTopic(topic string, processFunc eventpubsub.ProcessEvent) (err error) {
+
+	return rec.SubscribeToTopicWithMaxMsg(topic, processFunc, 0)
+}
+
+func (rec *Recorder) SubscribeToTopicWithMaxMsg(topic string, processFunc eventpubsub.ProcessEvent, maxMessages int) (err error) {
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.subscriptions[topic] = processFunc
+
+	return nil
+}
+
+func (rec *Recorder) SubscribeToQueue(queue string, processFunc eventpubsub.ProcessEvent, maxMessages int) (err error) {
+
+	return rec.SubscribeToTopicWithMaxMsg(queue, processFunc, maxMessages)
+}
+
+func (rec *Recorder) UnSubscribe(topic string) {
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	delete(rec.subscriptions, topic)
+}
+
+func (rec *Recorder) CleanUp() (err error) {
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.subscriptions = make(map[string]eventpubsub.ProcessEvent)
+
+	return nil
+}
+
+func (rec *Recorder) PublishWithTx(txFunc eventpubsub.PublishTxHandler) (err error) {
+
+	tx := &recorderTx{
+		recorder: rec,
+	}
+
+	err = txFunc(tx)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Deliver
+// Calls the handler subscribed to the topic, or to a multi topic queue bound to it, with the event,
+// as a delivery from the broker would. The topic is set as the source topic of the context.
+func (rec *Recorder) Deliver(ctx context.Context, topic string, event []byte, contentType string) (err error) {
+
+	rec.mu.Lock()
+
+	processFunc := rec.subscriptions[topic]
+
+	for queue, topics := range rec.queues {
+
+		if processFunc == nil && queue != topic && containsTopic(topics, topic) {
+			processFunc = rec.subscriptions[queue]
+		}
+	}
+
+	rec.mu.Unlock()
+
+	if processFunc == nil {
+		return fmt.Errorf("app %s is not subscribed to topic %s", rec.AppID, topic)
+	}
+
+	ctx = context.WithValue(ctx, appctx.SourceTopicHeader, topic)
+
+	return processFunc(ctx, event, contentType)
+}
+
+// Published
+// Returns all the events published so far, in publishing order
+func (rec *Recorder) Published() []PublishedEvent {
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	published := make([]PublishedEvent, len(rec.published))
+	copy(published, rec.published)
+
+	return published
+}
+
+// PublishedOfType
+// Returns the AppEvents published so far with the event type
+func (rec *Recorder) PublishedOfType(eventType string) []PublishedEvent {
+
+	var published []PublishedEvent
+
+	for _, event := range rec.Published() {
+
+		if event.AppEvent != nil && event.AppEvent.EventType == eventType {
+			published = append(published, event)
+		}
+	}
+
+	return published
+}
+
+// Reset
+// Forgets the events published so far
+func (rec *Recorder) Reset() {
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.published = nil
+}
+
+// WaitForPublished
+// Waits until count AppEvents with the event type are published, for async publishing.
+// Returns the events published with the type, or an error on timeout.
+func (rec *Recorder) WaitForPublished(eventType string, count int, timeout time.Duration) (published []PublishedEvent, err error) {
+
+	deadline := time.After(timeout)
+
+	for {
+
+		rec.mu.Lock()
+		publishedChan := rec.publishedChan
+		rec.mu.Unlock()
+
+		published = rec.PublishedOfType(eventType)
+
+		if len(published) >= count {
+			return published, nil
+		}
+
+		select {
+		case <-publishedChan:
+		case <-deadline:
+			return published, fmt.Errorf("timeout after %s waiting for %d events of type %s, got %d", timeout, count, eventType, len(published))
+		}
+	}
+}
+
+// AssertPublishedOnce
+// Asserts exactly one AppEvent of the type was published, and its Data is JSON equal to expectedData.
+// expectedData can be a JSON []byte, json.RawMessage, string or any value to marshal to JSON. Nil skips the Data check.
+func (rec *Recorder) AssertPublishedOnce(t assert.TestingT, eventType string, expectedData interface{}) bool {
+
+	published := rec.PublishedOfType(eventType)
+
+	if !assert.Lenf(t, published, 1, "expected exactly one event of type %s published", eventType) {
+		return false
+	}
+
+	if expectedData == nil {
+		return true
+	}
+
+	var expectedJSON []byte
+
+	switch data := expectedData.(type) {
+	case []byte:
+		expectedJSON = data
+	case json.RawMessage:
+		expectedJSON = data
+	case string:
+		expectedJSON = []byte(data)
+	default:
+
+		var err error
+
+		expectedJSON, err = json.Marshal(data)
+
+		if !assert.NoError(t, err, "expected data can't be serialized to JSON") {
+			return false
+		}
+	}
+
+	return assert.JSONEqf(t, string(expectedJSON), string(published[0].AppEvent.Data), "event of type %s published with unexpected data", eventType)
+}
+
+// AssertPublishedOnceMatching
+// Asserts exactly one AppEvent of the type was published, and that it satisfies the match function
+func (rec *Recorder) AssertPublishedOnceMatching(t assert.TestingT, eventType string, match func(event PublishedEvent) bool) bool {
+
+	published := rec.PublishedOfType(eventType)
+
+	if !assert.Lenf(t, published, 1, "expected exactly one event of type %s published", eventType) {
+		return false
+	}
+
+	return assert.Truef(t, match(published[0]), "event of type %s published doesn't match", eventType)
+}
+
+// AssertNotPublished
+// Asserts no AppEvent of the type was published
+func (rec *Recorder) AssertNotPublished(t assert.TestingT, eventType string) bool {
+
+	return assert.Emptyf(t, rec.PublishedOfType(eventType), "expected no event of type %s published", eventType)
+}
+
+func (rec *Recorder) newPublishedEvent(ctx context.Context, topic string, event []byte, contentType string, transactional bool) (published PublishedEvent, err error) {
+
+	rec.mu.Lock()
+	publishErr := rec.PublishErr
+	registered := rec.registeredTopics[topic]
+	rec.mu.Unlock()
+
+	if publishErr != nil {
+		return published, publishErr
+	}
+
+	if rec.RequireRegisteredTopic && !registered {
+		return published, fmt.Errorf("app %s is not registered for topic %s", rec.AppID, topic)
+	}
+
+	published = PublishedEvent{
+		Topic:         topic,
+		ContentType:   contentType,
+		Event:         event,
+		AppID:         contextValue(ctx, appctx.AppIdHeader),
+		CorrelationID: contextValue(ctx, appctx.CorrelationIdHeader),
+		UserID:        appctx.GetAuthorizedUserID(ctx),
+		UserRoles:     appctx.GetAuthorizedUserRoles(ctx),
+		Transactional: transactional,
+	}
+
+	if contentType == "" || strings.Contains(contentType, "json") {
+
+		appEvent, err := appevent.NewAppEventFromJSON(event)
+
+		if err == nil && appEvent.EventType != "" {
+			published.AppEvent = &appEvent
+		}
+	}
+
+	return published, nil
+}
+
+func (rec *Recorder) record(published ...PublishedEvent) {
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.published = append(rec.published, published...)
+
+	close(rec.publishedChan)
+	rec.publishedChan = make(chan bool)
+}
+
+func (tx *recorderTx) PublishToTopic(ctx context.Context, topic string, event []byte, contentType string) (err error) {
+
+	published, err := tx.recorder.newPublishedEvent(ctx, topic, event, contentType, true)
+
+	if err != nil {
+		return err
+	}
+
+	tx.published = append(tx.published, published)
+
+	return nil
+}
+
+func (tx *recorderTx) Commit() (err error) {
+
+	if len(tx.published) > 0 {
+		tx.recorder.record(tx.published...)
+	}
+
+	tx.published = nil
+
+	return nil
+}
+
+func (tx *recorderTx) Rollback() (err error) {
+
+	tx.published = nil
+
+	return nil
+}
+
+func contextValue(ctx context.Context, key string) string {
+
+	value, _ := ctx.Value(key).(string)
+
+	return value
+}
+
+func containsTopic(topics []string, topic string) bool {
+
+	for _, t := range topics {
+
+		if t == topic {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,172 @@
+package testkit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/HelloSundayMorning/apputils/appctx"
+	"github.com/HelloSundayMorning/apputils/appevent"
+	"github.com/HelloSundayMorning/apputils/eventpubsub"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestRecorder_PublishToTopic(t *testing.T) {
+
+	rec := NewRecorder("testApp")
+
+	ctx := appctx.NewContextFromValuesWithUserRoles("testApp", "corrID", "userID", "Admin")
+
+	event := appevent.NewAppEvent("user_created", []byte(`{"userID": "1", "name": "A"}`))
+	eventJSON, _ := event.ToJSON()
+
+	err := rec.PublishToTopic(ctx, "user", eventJSON, "application/json")
+
+	assert.Nil(t, err)
+
+	err = rec.PublishToTopic(ctx, "user", []byte("testEvent"), "text/plain")
+
+	assert.Nil(t, err)
+
+	published := rec.Published()
+
+	assert.Len(t, published, 2)
+	assert.Equal(t, "user", published[0].Topic)
+	assert.Equal(t, "corrID", published[0].CorrelationID)
+	assert.Equal(t, "userID", published[0].UserID)
+	assert.Equal(t, "Admin", published[0].UserRoles)
+	assert.False(t, published[0].Transactional)
+	assert.Nil(t, published[1].AppEvent)
+
+	rec.AssertPublishedOnce(t, "user_created", map[string]string{"name": "A", "userID": "1"})
+	rec.AssertPublishedOnce(t, "user_created", `{"name": "A", "userID": "1"}`)
+	rec.AssertPublishedOnceMatching(t, "user_created", func(event PublishedEvent) bool {
+		return event.UserID == "userID"
+	})
+	rec.AssertNotPublished(t, "user_deleted")
+
+	mockT := &testing.T{}
+
+	assert.False(t, rec.AssertPublishedOnce(mockT, "user_created", `{"userID": "2"}`))
+	assert.False(t, rec.AssertNotPublished(mockT, "user_created"))
+
+	rec.Reset()
+
+	assert.Empty(t, rec.Published())
+}
+
+func TestRecorder_PublishWithTx(t *testing.T) {
+
+	rec := NewRecorder("testApp")
+	rec.RequireRegisteredTopic = true
+
+	ctx := appctx.NewContextFromValues("testApp", "corrID")
+
+	event := appevent.NewAppEvent("user_created", []byte(`{}`))
+	eventJSON, _ := event.ToJSON()
+
+	err := rec.PublishWithTx(func(tx eventpubsub.PubSubTx) (err error) {
+		return tx.PublishToTopic(ctx, "user", eventJSON, "application/json")
+	})
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "app testApp is not registered for topic user", err.Error())
+
+	_ = rec.RegisterTopic("user")
+
+	err = rec.PublishWithTx(func(tx eventpubsub.PubSubTx) (err error) {
+
+		err = tx.PublishToTopic(ctx, "user", eventJSON, "application/json")
+
+		if err != nil {
+			return err
+		}
+
+		return errors.New("rolled back")
+	})
+
+	assert.NotNil(t, err)
+	assert.Empty(t, rec.Published())
+
+	err = rec.PublishWithTx(func(tx eventpubsub.PubSubTx) (err error) {
+		return tx.PublishToTopic(ctx, "user", eventJSON, "application/json")
+	})
+
+	assert.Nil(t, err)
+
+	published := rec.PublishedOfType("user_created")
+
+	assert.Len(t, published, 1)
+	assert.True(t, published[0].Transactional)
+}
+
+func TestRecorder_WaitForPublished(t *testing.T) {
+
+	rec := NewRecorder("testApp")
+
+	ctx := appctx.NewContextFromValues("testApp", "corrID")
+
+	event := appevent.NewAppEvent("user_created", []byte(`{}`))
+	eventJSON, _ := event.ToJSON()
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			time.Sleep(10 * time.Millisecond)
+			_ = rec.PublishToTopic(ctx, "user", eventJSON, "application/json")
+		}
+	}()
+
+	published, err := rec.WaitForPublished("user_created", 2, time.Second)
+
+	assert.Nil(t, err)
+	assert.Len(t, published, 2)
+
+	_, err = rec.WaitForPublished("user_deleted", 1, 20*time.Millisecond)
+
+	assert.NotNil(t, err)
+}
+
+func TestRecorder_Deliver(t *testing.T) {
+
+	rec := NewRecorder("testApp")
+
+	ctx := appctx.NewContextFromValues("testApp", "corrID")
+
+	err := rec.Deliver(ctx, "user", []byte("testEvent"), "text/plain")
+
+	assert.NotNil(t, err)
+
+	var received []byte
+
+	_ = rec.SubscribeToTopic("user", func(ctx context.Context, event []byte, contentType string) error {
+		received = event
+		return nil
+	})
+
+	err = rec.Deliver(ctx, "user", []byte("testEvent"), "text/plain")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "testEvent", string(received))
+}
+
+func TestRecorder_DeliverMultiTopicQueue(t *testing.T) {
+
+	rec := NewRecorder("testApp")
+
+	ctx := appctx.NewContextFromValues("testApp", "corrID")
+
+	_ = rec.InitializeMultiTopicQueue("events", "user", "chat")
+
+	var topics []string
+
+	_ = rec.SubscribeToQueue("events", func(ctx context.Context, event []byte, contentType string) error {
+		topics = append(topics, appctx.GetSourceTopic(ctx))
+		return nil
+	}, 0)
+
+	assert.Nil(t, rec.Deliver(ctx, "user", []byte("testEvent"), "text/plain"))
+	assert.Nil(t, rec.Deliver(ctx, "chat", []byte("testEvent"), "text/plain"))
+	assert.NotNil(t, rec.Deliver(ctx, "membership", []byte("testEvent"), "text/plain"))
+	assert.Equal(t, []string{"user", "chat"}, topics)
+}
@@ -3,8 +3,6 @@ package eventpubsub
 import (
 	"fmt"
 	"github.com/HelloSundayMorning/apputils/appctx"
-	"github.com/HelloSundayMorning/apputils/tracing"
-	"github.com/gofrs/uuid"
 	"github.com/streadway/amqp"
 	"golang.org/x/net/context"
 )
@@ -18,6 +16,7 @@ type (
 	}
 
 	ChannelTx struct {
+		rabbit          *RabbitMq
 		publishChannel  *amqp.Channel
 		registeredTopic map[string]bool
 	}
@@ -26,30 +25,15 @@ type (
 func (chTx *ChannelTx) PublishToTopic(ctx context.Context, topic string, event []byte, contentType string) (err error) {
 
 	appID := ctx.Value(appctx.AppIdHeader).(string)
-	correlationID := ctx.Value(appctx.CorrelationIdHeader).(string)
-
-	valueUserID := ctx.Value(appctx.AuthorizedUserIDHeader)
-	userID := ""
-
-	if valueUserID != nil {
-		userID = valueUserID.(string)
-	}
-
-	valUserRoles := ctx.Value(appctx.AuthorizedUserRolesHeader)
-	userRoles := ""
-
-	if valUserRoles != nil {
-		userRoles = valUserRoles.(string)
-	}
 
 	if !chTx.registeredTopic[topic] {
 		return fmt.Errorf("app %s is not registered for topic %s", appID, topic)
 	}
 
-	msgID, err := uuid.NewV4()
+	publishing, err := chTx.rabbit.newPublishing(ctx, topic, event, contentType)
 
 	if err != nil {
-		return fmt.Errorf("error getting uuid message ID, %s", err)
+		return err
 	}
 
 	err = chTx.publishChannel.Publish(
@@ -57,19 +41,7 @@ func (chTx *ChannelTx) PublishToTopic(ctx context.Context, topic string, event [
 		"",
 		false,
 		false,
-		amqp.Publishing{
-			ContentType:   contentType,
-			Body:          event,
-			MessageId:     msgID.String(),
-			DeliveryMode:  uint8(2),
-			CorrelationId: correlationID,
-			AppId:         string(appID),
-			Headers: amqp.Table{
-				appctx.AuthorizedUserIDHeader : userID,
-				appctx.AuthorizedUserRolesHeader: userRoles,
-				tracing.AWSXrayTraceId: tracing.GetParentSegmentTraceIDHeader(ctx),
-			},
-		})
+		publishing)
 
 	if err != nil {
 		return fmt.Errorf("error publishing to channel, %s", err)
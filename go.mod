@@ -1,6 +1,6 @@
 module github.com/HelloSundayMorning/apputils
 
-go 1.15
+go 1.16
 
 require (
 	github.com/99designs/gqlgen v0.17.42
@@ -10,7 +10,9 @@ require (
 	github.com/gofrs/uuid v3.3.0+incompatible
 	github.com/gorilla/handlers v1.5.1
 	github.com/gorilla/mux v1.8.0
+	github.com/klauspost/compress v1.16.7
 	github.com/lib/pq v1.8.0
+	github.com/santhosh-tekuri/jsonschema/v5 v5.2.0
 	github.com/sideshow/apns2 v0.20.0
 	github.com/sirupsen/logrus v1.7.0
 	github.com/streadway/amqp v1.0.0
@@ -0,0 +1,14 @@
+-- adopts the notification_token table created before the schema was versioned, which may miss updated_at
+CREATE TABLE IF NOT EXISTS notification_token
+(
+    user_id    uuid         not null,
+    token      varchar(500) not null,
+    device_os  varchar(50)  not null,
+    created_at bigint       not null,
+    error_msg  varchar(500) null default null,
+    updated_at bigint       not null default 0,
+    PRIMARY KEY (user_id, token, device_os)
+);
+
+ALTER TABLE notification_token
+    ADD COLUMN IF NOT EXISTS updated_at bigint not null default 0;
@@ -56,39 +56,11 @@ func NewMobileNotificationManagerApp(appID app.ApplicationID, sqlDb db.AppSqlDb,
 
 }
 
+// initialize
+// Applies the pending migrations of the notification_token table, see the migrations directory
 func (manager *AppMobileNotificationManager) initialize() (err error) {
 
-	conn := manager.sqlDb.GetDB()
-
-	ctx := context.Background()
-
-	tx, err := conn.BeginTx(ctx, nil)
-
-	if err != nil {
-		return err
-	}
-
-	stmt, err := tx.Prepare(createTokenTable)
-
-	if err != nil {
-		_ = tx.Rollback()
-		return err
-	}
-
-	_, err = stmt.Exec()
-
-	if err != nil {
-		_ = tx.Rollback()
-		return err
-	}
-
-	err = tx.Commit()
-
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return db.MigrateSchema(context.Background(), manager.sqlDb, tokenMigrations, "migrations", tokenMigrationsTable)
 }
 
 func (manager *AppMobileNotificationManager) SendAlert(ctx context.Context, userID, title, message string) (err error) {
@@ -2,6 +2,7 @@ package notification
 
 import (
 	"database/sql"
+	"embed"
 	"time"
 
 	"golang.org/x/net/context"
@@ -20,21 +21,18 @@ type (
 	}
 )
 
+var (
+	//go:embed migrations/*.sql
+	tokenMigrations embed.FS
+)
+
 const (
 	IOS     = MobileOS("ios")
 	Android = MobileOS("android")
 	Unknown = MobileOS("unknown")
 
-	createTokenTable = `CREATE TABLE IF NOT EXISTS notification_token
-	(
-		user_id    uuid         not null,
-		token      varchar(500) not null,
-		device_os  varchar(50)  not null,
-		created_at bigint       not null,
-		error_msg  varchar(500) null default null,
-		updated_at bigint       not null default 0,
-		PRIMARY KEY (user_id, token, device_os)
-	);`
+	// table recording the applied notification_token migrations
+	tokenMigrationsTable = "notification_token_migrations"
 
 	insertToken = `INSERT INTO notification_token (user_id, token, device_os, created_at, error_msg, updated_at)
 					VALUES ($1, $2, $3, $4, $5, $6)
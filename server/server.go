@@ -28,6 +28,10 @@ type (
 	Initialize func(srv *AppServer) (err error)
 	CleanUp    func(srv *AppServer) (err error)
 
+	// ReadinessCheck
+	// Returns an error when the app is not ready to receive traffic
+	ReadinessCheck func(ctx context.Context) (err error)
+
 	// AppServer
 	// Application Server object that controls the application state and life cycle.
 	// It's based on the http Server from net/http package, and offers the ability to register HTTP routes.
@@ -42,6 +46,7 @@ type (
 		cleanupFunc    CleanUp           // Custom cleanup function
 		corsOrigins    []string          // Enable CORS and set origins
 		environment    string            // The environment name
+		readyChecks    map[string]ReadinessCheck
 	}
 )
 
@@ -320,6 +325,7 @@ func (srv *AppServer) Start() {
 
 	srv.addVersionHandler()
 	srv.addHealthHandler()
+	srv.addReadinessHandler()
 
 	if srv.initializeFunc != nil {
 
@@ -407,6 +413,61 @@ func (srv *AppServer) addHealthHandler() {
 	log.PrintfNoContext(srv.AppID, component, "Added route %s %s for app %s", method, pathAppID, srv.AppID)
 }
 
+// AddReadinessCheck
+// Add a named check to the readiness route GET /readyz and /appID/readyz.
+// The route returns 503 with the failing checks errors if any check fails.
+// Must be called before server.Start()
+func (srv *AppServer) AddReadinessCheck(name string, check ReadinessCheck) {
+
+	if srv.readyChecks == nil {
+		srv.readyChecks = make(map[string]ReadinessCheck)
+	}
+
+	srv.readyChecks[name] = check
+
+	log.PrintfNoContext(srv.AppID, component, "Added readiness check %s for app %s", name, srv.AppID)
+}
+
+func (srv *AppServer) addReadinessHandler() {
+
+	path := "/readyz"
+	pathAppID := fmt.Sprintf("/%s/readyz", srv.AppID)
+	method := "GET"
+
+	f := func(writer http.ResponseWriter, request *http.Request) {
+
+		failures := make(map[string]string)
+
+		for name, check := range srv.readyChecks {
+
+			err := check(request.Context())
+
+			if err != nil {
+				failures[name] = err.Error()
+			}
+		}
+
+		if len(failures) == 0 {
+			return
+		}
+
+		log.ErrorfNoContext(srv.AppID, component, "App not ready, %s", failures)
+
+		failuresJSON, _ := json.Marshal(failures)
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusServiceUnavailable)
+
+		_, _ = writer.Write(failuresJSON)
+	}
+
+	srv.router().HandleFunc(path, f).Methods(method)
+	srv.router().HandleFunc(pathAppID, f).Methods(method)
+
+	log.PrintfNoContext(srv.AppID, component, "Added route %s %s for app %s", method, path, srv.AppID)
+	log.PrintfNoContext(srv.AppID, component, "Added route %s %s for app %s", method, pathAppID, srv.AppID)
+}
+
 func (srv *AppServer) addVersionHandler() {
 
 	path := fmt.Sprintf("/%s/version", srv.AppID)
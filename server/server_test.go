@@ -1,9 +1,11 @@
 package server
 
 import (
+	"errors"
 	"github.com/HelloSundayMorning/apputils/app"
 	"github.com/HelloSundayMorning/apputils/appctx"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -71,3 +73,45 @@ func TestAppServer_AddAuthorizedRoute(t *testing.T) {
 }
 
 
+
+func TestAppServer_AddReadinessCheck(t *testing.T) {
+
+	getAppEnv = func() string {
+		return app.LocalEnvironment
+	}
+
+	srv := NewServer("APPID", 8000)
+
+	ready := true
+
+	srv.AddReadinessCheck("queues", func(ctx context.Context) (err error) {
+
+		if !ready {
+			return errors.New("queue backing up")
+		}
+
+		return nil
+	})
+
+	srv.addReadinessHandler()
+
+	for _, path := range []string{"/readyz", "/APPID/readyz"} {
+
+		ready = true
+
+		wri := httptest.NewRecorder()
+
+		srv.Handler.ServeHTTP(wri, httptest.NewRequest("GET", path, nil))
+
+		assert.Equal(t, http.StatusOK, wri.Result().StatusCode)
+
+		ready = false
+
+		wri = httptest.NewRecorder()
+
+		srv.Handler.ServeHTTP(wri, httptest.NewRequest("GET", path, nil))
+
+		assert.Equal(t, http.StatusServiceUnavailable, wri.Result().StatusCode)
+		assert.JSONEq(t, `{"queues": "queue backing up"}`, wri.Body.String())
+	}
+}
@@ -27,11 +27,13 @@ const (
 	workloadTypeAnnotationTitle = "WorkloadType"
 	workloadGQLPath             = "GraphQLPath"
 	workloadEventType           = "EventType"
+	workloadWorkflowStep        = "WorkflowStep"
 	WorkloadTypeHTTPCall        = WorkloadType("HttpRequest")
 	WorkloadTypeGraphQL         = WorkloadType("GraphQLRequest")
 	WorkloadTypeGraphQLMutation = WorkloadType("GraphQLMutation")
 	WorkloadTypeGraphQLQuery    = WorkloadType("GraphQLQuery")
 	WorkloadTypeEventHandling   = WorkloadType("EventHandling")
+	WorkloadTypeWorkflowStep    = WorkloadType("WorkflowStep")
 
 	AWSXrayTraceId = "X-Amzn-Trace-Id"
 )
@@ -154,3 +156,24 @@ func BeginSegmentFromEventDelivery(ctx context.Context, appID app.ApplicationID,
 
 	return ctx, seg
 }
+
+// BeginWorkflowStepSegment
+// Return a XRay subsegment for a saga workflow step, annotated with the step name.
+// If the context has no segment, like in background jobs, a new segment for the app is started instead.
+func BeginWorkflowStepSegment(ctx context.Context, appID app.ApplicationID, stepName string) (context.Context, *xray.Segment) {
+
+	var seg *xray.Segment
+
+	if xray.GetSegment(ctx) == nil {
+		ctx, seg = xray.BeginSegment(ctx, string(appID))
+	} else {
+		ctx, seg = xray.BeginSubsegment(ctx, stepName)
+	}
+
+	_ = xray.AddAnnotation(ctx, workloadWorkflowStep, stepName)
+
+	AddCustomTracingWorkloadType(ctx, WorkloadTypeWorkflowStep)
+	AddTracingAnnotationFromCtx(ctx)
+
+	return ctx, seg
+}